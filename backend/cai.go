@@ -10,52 +10,59 @@ import (
 	"strings"
 )
 
+// CAIEndpoint is the request endpoint of the hosted SAP Conversational AI API.
+const CAIEndpoint = "https://api.cai.tools.sap/v2/request"
+
 // CAI is the SAP Conversational AI interface.
 type CAI struct {
-	Token string
+	Token    string
+	Endpoint string
+	Client   *http.Client
+}
+
+// caiEntity is an entity as returned by the SAP CAI request API.
+type caiEntity struct {
+	FullName   string  `json:"fullname,omitempty"`
+	Lat        float64 `json:"lat,omitempty"`
+	Lng        float64 `json:"lng,omitempty"`
+	Scalar     float64 `json:"scalar,omitempty"`
+	Value      string  `json:"value,omitempty"`
+	Grams      float64 `json:"grams,omitempty"`
+	Formatted  string  `json:"formatted,omitempty"`
+	Dollars    float64 `json:"dollars,omitempty"`
+	Amount     float64 `json:"amount,omitempty"`
+	Currency   string  `json:"currency,omitempty"`
+	Index      int     `json:"index,omitempty"`
+	Raw        string  `json:"raw,omitempty"`
+	Confidence float64 `json:"confidence,omitempty"`
+}
+
+// caiIntent is an intent as returned by the SAP CAI request API.
+type caiIntent struct {
+	Slug       string  `json:"slug"`
+	Confidence float64 `json:"confidence,omitempty"`
 }
 
-// Intent defines the intent of a message.
-type Intent struct {
-	Slug     string
-	FullName string
-	Lat      float64
-	Lng      float64
-	Address  string
-	Product  string
-	Mass     float64
-	Number   uint
-	Dollars  float64
+// caiResult is the response body of the SAP CAI request API.
+type caiResult struct {
+	Results struct {
+		Source   string                 `json:"source,omitempty"`
+		Language string                 `json:"language,omitempty"`
+		Intents  []caiIntent            `json:"intents"`
+		Entities map[string][]caiEntity `json:"entities"`
+	} `json:"results"`
+	Message string `json:"message,omitempty"`
 }
 
 // NewCAI initializes a new CAI interface.
 func NewCAI(token string) *CAI {
-	return &CAI{Token: token}
+	return &CAI{Token: token, Endpoint: CAIEndpoint, Client: http.DefaultClient}
 }
 
 // Intent returns the intent of a message.
 func (cai *CAI) Intent(message string) (*Intent, error) {
-	type IntentResult struct {
-		Results struct {
-			Intents []struct {
-				Slug string `json:"slug"`
-			} `json:"intents"`
-			Entities map[string][]struct {
-				FullName  string  `json:"fullname"`
-				Lat       float64 `json:"lat"`
-				Lng       float64 `json:"lng"`
-				Scalar    float64 `json:"scalar"`
-				Value     string  `json:"value"`
-				Grams     float64 `json:"grams"`
-				Formatted string  `json:"formatted"`
-				Dollars   float64 `json:"dollars"`
-			} `json:"entities"`
-		} `json:"results"`
-	}
-
 	payload := url.Values{"text": {message}, "language": {"en"}}
-	req, err := http.NewRequest("POST", "https://api.cai.tools.sap/v2/request",
-		strings.NewReader(payload.Encode()))
+	req, err := http.NewRequest("POST", cai.Endpoint, strings.NewReader(payload.Encode()))
 	if err != nil {
 		return nil, err
 	}
@@ -63,16 +70,20 @@ func (cai *CAI) Intent(message string) (*Intent, error) {
 	req.Header.Add("Authorization", fmt.Sprintf("Token %s", cai.Token))
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := cai.Client.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 	bytes, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CAI request failed with status %s", resp.Status)
+	}
 
-	var result IntentResult
+	var result caiResult
 	err = json.Unmarshal(bytes, &result)
 	if err != nil {
 		return nil, err
@@ -83,25 +94,39 @@ func (cai *CAI) Intent(message string) (*Intent, error) {
 	}
 
 	intent := &Intent{Slug: result.Results.Intents[0].Slug}
-	if value, ok := result.Results.Entities["person"]; ok {
+	if value, ok := result.Results.Entities["person"]; ok && len(value) > 0 {
 		intent.FullName = value[0].FullName
 	}
-	if values, ok := result.Results.Entities["location"]; ok {
+	if values, ok := result.Results.Entities["location"]; ok && len(values) > 0 {
 		intent.Lat = values[0].Lat
 		intent.Lng = values[0].Lng
 		intent.Address = values[0].Formatted
 	}
-	if values, ok := result.Results.Entities["product"]; ok {
+	if values, ok := result.Results.Entities["product"]; ok && len(values) > 0 {
 		intent.Product = values[0].Value
 	}
-	if values, ok := result.Results.Entities["mass"]; ok {
+	if values, ok := result.Results.Entities["mass"]; ok && len(values) > 0 {
 		intent.Mass = values[0].Grams
 	}
-	if values, ok := result.Results.Entities["number"]; ok {
-		intent.Number = uint(values[0].Scalar)
+	if values, ok := result.Results.Entities["ordinal"]; ok && len(values) > 0 {
+		intent.Reference = uint(values[0].Index)
+	}
+	if values, ok := result.Results.Entities["number"]; ok && len(values) > 0 {
+		// Offer commands refer to an offer by its number, e.g. "change offer 2 to 8 plantains".
+		if intent.Reference == 0 && (intent.Slug == "update_offer" || intent.Slug == "withdraw_offer") {
+			intent.Reference = uint(values[0].Scalar)
+			values = values[1:]
+		}
+		if len(values) > 0 {
+			intent.Number = uint(values[0].Scalar)
+		}
+	}
+	if values, ok := result.Results.Entities["measure"]; ok && len(values) > 0 {
+		intent.Measure = values[0].Value
 	}
-	if values, ok := result.Results.Entities["money"]; ok {
-		intent.Dollars = values[0].Dollars
+	if values, ok := result.Results.Entities["money"]; ok && len(values) > 0 {
+		// Amounts without currency are given in the default currency of the deployment.
+		intent.Price = Money{values[0].Amount, values[0].Currency}
 	}
 
 	return intent, nil
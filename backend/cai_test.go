@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCAIEntities(t *testing.T) {
+	fake := NewFakeCAI([]CAIFixture{
+		{Text: "My name is Amina Bello", Intent: "get_name", Entities: map[string][]caiEntity{
+			"person": {{FullName: "Amina Bello", Raw: "Amina Bello"}}}},
+		{Text: "I live in Mfou", Intent: "get_location", Entities: map[string][]caiEntity{
+			"location": {{Lat: 3.7186, Lng: 11.6392, Formatted: "Mfou, Cameroon", Raw: "Mfou"}}}},
+		{Text: "sell 5kg of cassava for 3$", Intent: "sell", Entities: map[string][]caiEntity{
+			"product": {{Value: "cassava", Raw: "cassava"}},
+			"mass":    {{Grams: 5000, Scalar: 5, Raw: "5kg"}},
+			"money":   {{Amount: 3, Currency: "USD", Dollars: 3, Scalar: 3, Raw: "3$"}}}},
+		{Text: "sell 2 bags of cassava for 40000 FCFA", Intent: "sell", Entities: map[string][]caiEntity{
+			"product": {{Value: "cassava", Raw: "cassava"}},
+			"number":  {{Scalar: 2, Raw: "2"}},
+			"measure": {{Value: "bag", Raw: "bags"}},
+			"money":   {{Amount: 40000, Currency: "XAF", Scalar: 40000, Raw: "40000 FCFA"}}}},
+		{Text: "buy 10 plantains for 2000", Intent: "buy", Entities: map[string][]caiEntity{
+			"product": {{Value: "plantains", Raw: "plantains"}},
+			"number":  {{Scalar: 10, Raw: "10"}},
+			"money":   {{Amount: 2000, Scalar: 2000, Raw: "2000"}}}},
+		{Text: "change offer 2 to 8 plantains", Intent: "update_offer", Entities: map[string][]caiEntity{
+			"product": {{Value: "plantains", Raw: "plantains"}},
+			"number":  {{Scalar: 2, Raw: "2"}, {Scalar: 8, Raw: "8"}}}},
+		{Text: "change the second offer to 8 plantains", Intent: "update_offer", Entities: map[string][]caiEntity{
+			"product": {{Value: "plantains", Raw: "plantains"}},
+			"ordinal": {{Index: 2, Raw: "second"}},
+			"number":  {{Scalar: 8, Raw: "8"}}}},
+		{Text: "withdraw offer 3", Intent: "withdraw_offer", Entities: map[string][]caiEntity{
+			"number": {{Scalar: 3, Raw: "3"}}}},
+	})
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	cai := NewCAI("token")
+	cai.Endpoint = server.URL
+
+	cases := []struct {
+		Message  string
+		Expected Intent
+	}{
+		{"My name is Amina Bello", Intent{Slug: "get_name", FullName: "Amina Bello"}},
+		{"I live in Mfou.", Intent{Slug: "get_location", Lat: 3.7186, Lng: 11.6392, Address: "Mfou, Cameroon"}},
+		{"Sell 5kg of  cassava for 3$", Intent{Slug: "sell", Product: "cassava", Mass: 5000, Price: Money{3, "USD"}}},
+		{"sell 2 bags of cassava for 40000 FCFA", Intent{Slug: "sell", Product: "cassava", Number: 2,
+			Measure: "bag", Price: Money{40000, "XAF"}}},
+		{"buy 10 plantains for 2000", Intent{Slug: "buy", Product: "plantains", Number: 10, Price: Money{2000, ""}}},
+		{"change offer 2 to 8 plantains", Intent{Slug: "update_offer", Product: "plantains", Number: 8, Reference: 2}},
+		{"change the second offer to 8 plantains", Intent{Slug: "update_offer", Product: "plantains", Number: 8,
+			Reference: 2}},
+		{"withdraw offer 3", Intent{Slug: "withdraw_offer", Reference: 3}},
+	}
+	for _, c := range cases {
+		intent, err := cai.Intent(c.Message)
+		if err != nil || *intent != c.Expected {
+			t.Errorf("expected %q to be %+v, got %+v, %v", c.Message, c.Expected, intent, err)
+		}
+	}
+
+	if intent, err := cai.Intent("what is the weather like?"); err == nil {
+		t.Errorf("expected no intent without fallback, got %+v", intent)
+	}
+}
+
+func TestFakeCAIFallback(t *testing.T) {
+	fake, err := LoadFakeCAI("fixtures/cai.json")
+	mustNil(t, err)
+	fake.Fallback = NewRuleClassifier()
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	cai := NewCAI("token")
+	cai.Endpoint = server.URL
+
+	// Utterances without fixture are answered with the entities of the rule-based classifier.
+	for _, message := range []string{
+		"sell 3 bags of maize for 20000 FCFA",
+		"buy 4kg of tomatoes for 5$",
+		"change offer 2 to 8 plantains",
+		"what is the price of cassava?",
+	} {
+		expected, err := fake.Fallback.Intent(message)
+		mustNil(t, err)
+		intent, err := cai.Intent(message)
+		if err != nil || *intent != *expected {
+			t.Errorf("expected %q to be %+v, got %+v, %v", message, expected, intent, err)
+		}
+	}
+}
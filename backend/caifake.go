@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// CAIFixture maps an utterance to the intent and entities the fake CAI server responds with.
+type CAIFixture struct {
+	Text     string                 `json:"text"`
+	Intent   string                 `json:"intent"`
+	Entities map[string][]caiEntity `json:"entities"`
+}
+
+// FakeCAI is a local stand-in for the SAP CAI request API. It answers with fixtures and, if
+// configured, falls back to another classifier for unknown utterances.
+type FakeCAI struct {
+	Fixtures map[string]CAIFixture
+	Fallback IntentClassifier
+}
+
+// NewFakeCAI initializes a fake CAI server with the given fixtures.
+func NewFakeCAI(fixtures []CAIFixture) *FakeCAI {
+	fake := &FakeCAI{Fixtures: make(map[string]CAIFixture)}
+	for _, fixture := range fixtures {
+		fake.Fixtures[normalizeUtterance(fixture.Text)] = fixture
+	}
+	return fake
+}
+
+// LoadFakeCAI initializes a fake CAI server with fixtures from a JSON file.
+func LoadFakeCAI(path string) (*FakeCAI, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fixtures []CAIFixture
+	err = json.Unmarshal(bytes, &fixtures)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFakeCAI(fixtures), nil
+}
+
+// ServeHTTP answers a CAI request in the same response format as the hosted API.
+func (fake *FakeCAI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "Token ") {
+		http.Error(w, "Request can not be completed without being authenticated", http.StatusUnauthorized)
+		return
+	}
+	text := r.FormValue("text")
+
+	var result caiResult
+	result.Results.Source = text
+	result.Results.Language = "en"
+	result.Results.Intents = []caiIntent{}
+	result.Results.Entities = map[string][]caiEntity{}
+	if fixture, ok := fake.Fixtures[normalizeUtterance(text)]; ok {
+		result.Results.Intents = append(result.Results.Intents, caiIntent{Slug: fixture.Intent, Confidence: 0.99})
+		if fixture.Entities != nil {
+			result.Results.Entities = fixture.Entities
+		}
+	} else if fake.Fallback != nil {
+		intent, err := fake.Fallback.Intent(text)
+		if err == nil {
+			result.Results.Intents = append(result.Results.Intents, caiIntent{Slug: intent.Slug, Confidence: 0.5})
+			result.Results.Entities = caiEntities(intent)
+		}
+	}
+	result.Message = "Requests rendered with success"
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(result)
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+	}
+}
+
+// caiEntities converts the entities of an intent into the CAI response format.
+func caiEntities(intent *Intent) map[string][]caiEntity {
+	entities := map[string][]caiEntity{}
+	if intent.FullName != "" {
+		entities["person"] = []caiEntity{{FullName: intent.FullName, Raw: intent.FullName}}
+	}
+	if intent.Lat != 0.0 || intent.Lng != 0.0 {
+		entities["location"] = []caiEntity{{Lat: intent.Lat, Lng: intent.Lng,
+			Formatted: intent.Address, Raw: intent.Address}}
+	}
+	if intent.Product != "" {
+		entities["product"] = []caiEntity{{Value: intent.Product, Raw: intent.Product}}
+	}
+	if intent.Mass != 0.0 {
+		entities["mass"] = []caiEntity{{Grams: intent.Mass, Scalar: intent.Mass}}
+	}
+	if intent.Number != 0 {
+		entities["number"] = []caiEntity{{Scalar: float64(intent.Number)}}
+	}
+	if intent.Measure != "" {
+		entities["measure"] = []caiEntity{{Value: intent.Measure, Raw: intent.Measure}}
+	}
+	if intent.Reference != 0 {
+		entities["ordinal"] = []caiEntity{{Index: int(intent.Reference)}}
+	}
+	if intent.Price.Amount != 0.0 {
+		money := caiEntity{Amount: intent.Price.Amount, Currency: intent.Price.Currency, Scalar: intent.Price.Amount}
+		if intent.Price.Currency == "USD" {
+			money.Dollars = intent.Price.Amount
+		}
+		entities["money"] = []caiEntity{money}
+	}
+	return entities
+}
+
+// normalizeUtterance normalizes case, whitespace and trailing punctuation of an utterance.
+func normalizeUtterance(text string) string {
+	return strings.TrimRight(strings.Join(strings.Fields(strings.ToLower(text)), " "), ".!?")
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// CatalogProduct is a product which can be traded. Its name is the canonical name used in
+// replies, its synonyms are other names in English, French or Pidgin.
+type CatalogProduct struct {
+	Name     string   `json:"name"`
+	Synonyms []string `json:"synonyms"`
+}
+
+// Catalog is the curated list of products which can be traded.
+type Catalog struct {
+	Products []CatalogProduct
+	// names maps the normalized names, synonyms and their singular forms to canonical names.
+	names map[string]string
+}
+
+// NewCatalog initializes a catalog with the given products.
+func NewCatalog(products []CatalogProduct) *Catalog {
+	catalog := &Catalog{Products: products, names: map[string]string{}}
+	for _, product := range products {
+		for _, name := range append([]string{product.Name}, product.Synonyms...) {
+			name = normalizeProduct(name)
+			catalog.names[name] = product.Name
+			if _, ok := catalog.names[singular(name)]; !ok {
+				catalog.names[singular(name)] = product.Name
+			}
+		}
+	}
+	return catalog
+}
+
+// LoadCatalog loads a catalog from a JSON file with a list of products.
+func LoadCatalog(path string) (*Catalog, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var products []CatalogProduct
+	err = json.Unmarshal(bytes, &products)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewCatalog(products), nil
+}
+
+// Lookup returns the canonical name of a product given by its name, a synonym or a plural form.
+// Single typos in longer names are corrected. If the product is unknown, it returns an empty
+// name and up to three similar products instead.
+func (c *Catalog) Lookup(name string) (string, []string) {
+	name = normalizeProduct(name)
+	if canonical, ok := c.names[name]; ok {
+		return canonical, nil
+	}
+	if canonical, ok := c.names[singular(name)]; ok {
+		return canonical, nil
+	}
+
+	// Rank the products by the edit distance of their closest name.
+	distances := map[string]int{}
+	for known, canonical := range c.names {
+		distance := levenshtein(name, known)
+		if current, ok := distances[canonical]; !ok || distance < current {
+			distances[canonical] = distance
+		}
+	}
+	limit := len([]rune(name)) / 3
+	if limit < 1 {
+		limit = 1
+	}
+	var suggestions []string
+	for canonical, distance := range distances {
+		if distance <= limit {
+			suggestions = append(suggestions, canonical)
+		}
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		a, b := distances[suggestions[i]], distances[suggestions[j]]
+		return a < b || a == b && suggestions[i] < suggestions[j]
+	})
+	if len(suggestions) > 3 {
+		suggestions = suggestions[:3]
+	}
+	if len(suggestions) > 0 && len([]rune(name)) >= 5 && distances[suggestions[0]] == 1 &&
+		(len(suggestions) == 1 || distances[suggestions[1]] > 1) {
+		return suggestions[0], nil
+	}
+	return "", suggestions
+}
+
+// normalizeProduct lowercases a product name, removes French accents and collapses whitespace.
+func normalizeProduct(name string) string {
+	name = strings.NewReplacer("é", "e", "è", "e", "ê", "e", "ë", "e", "à", "a", "â", "a", "î", "i",
+		"ï", "i", "ô", "o", "œ", "oe", "ù", "u", "û", "u", "ç", "c").Replace(strings.ToLower(name))
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// singular returns the singular form of an English or French plural, e.g. "tomato" for
+// "tomatoes" or "chou" for "choux".
+func singular(word string) string {
+	switch {
+	case len(word) > 4 && strings.HasSuffix(word, "ies"):
+		return strings.TrimSuffix(word, "ies") + "y"
+	case strings.HasSuffix(word, "oes"), strings.HasSuffix(word, "ches"), strings.HasSuffix(word, "shes"),
+		strings.HasSuffix(word, "sses"), strings.HasSuffix(word, "xes"):
+		return word[:len(word)-2]
+	case strings.HasSuffix(word, "ss"):
+		return word
+	case len(word) > 3 && (strings.HasSuffix(word, "s") || strings.HasSuffix(word, "x")):
+		return word[:len(word)-1]
+	}
+	return word
+}
+
+// levenshtein returns the number of inserted, removed or replaced characters to turn one word
+// into another.
+func levenshtein(a string, b string) int {
+	first, second := []rune(a), []rune(b)
+	previous := make([]int, len(second)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(first); i++ {
+		current := make([]int, len(second)+1)
+		current[0] = i
+		for j := 1; j <= len(second); j++ {
+			cost := 1
+			if first[i-1] == second[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(second)]
+}
+
+// min3 returns the smallest of three numbers.
+func min3(a int, b int, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
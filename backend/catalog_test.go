@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCatalogLookup(t *testing.T) {
+	catalog, err := LoadCatalog("products.json")
+	mustNil(t, err)
+	cases := []struct {
+		Name        string
+		Expected    string
+		Suggestions []string
+	}{
+		{"Cassava", "cassava", nil},
+		{"manioc", "cassava", nil},
+		{"tomates", "tomatoes", nil},
+		{"Tomato", "tomatoes", nil},
+		{"tomatos", "tomatoes", nil},
+		{"choux", "cabbages", nil},
+		{"maïs", "maize", nil},
+		{"Pommes  de terre", "potatoes", nil},
+		{"granat", "groundnuts", nil},
+		{"cassva", "cassava", nil},
+		{"rize", "", []string{"rice"}},
+		{"coca", "", []string{"cocoa"}},
+		{"fufu", "", nil},
+	}
+	for _, c := range cases {
+		name, suggestions := catalog.Lookup(c.Name)
+		if name != c.Expected || fmt.Sprint(suggestions) != fmt.Sprint(c.Suggestions) {
+			t.Errorf("expected %q to be %q %v, got %q %v", c.Name, c.Expected, c.Suggestions, name, suggestions)
+		}
+	}
+}
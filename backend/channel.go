@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Message is an inbound text message of a user.
+type Message struct {
+	From int64
+	Text string
+}
+
+// Channel is a messaging transport between the users and the Machine. Users are identified by an
+// opaque numeric address, e.g. a Telegram chat ID or a phone number.
+type Channel interface {
+	// Receive starts listening and returns the stream of inbound messages.
+	Receive() (<-chan Message, error)
+	// Send delivers a message to a user.
+	Send(to int64, text string) error
+}
+
+// NewChannel initializes the channel with the given name. Supported channels are "telegram" and
+// "sms".
+func NewChannel(name string) (Channel, error) {
+	switch name {
+	case "", "telegram":
+		return NewTelegramChannel(os.Getenv("TELEGRAM_TOKEN"), os.Getenv("TELEGRAM_WEBHOOK_URL"))
+	case "sms":
+		sms, err := NewSMSChannel(os.Getenv("SMS_GATEWAY_URL"))
+		if err != nil {
+			return nil, err
+		}
+		if method := os.Getenv("SMS_GATEWAY_METHOD"); method != "" {
+			sms.GatewayMethod = strings.ToUpper(method)
+		}
+		if code := os.Getenv("SMS_COUNTRY_CODE"); code != "" {
+			sms.CountryCode = code
+		}
+		sms.Secret = os.Getenv("SMS_WEBHOOK_SECRET")
+		sms.UDH = os.Getenv("SMS_GATEWAY_UDH") == "true"
+		return sms, nil
+	default:
+		return nil, fmt.Errorf("Unknown channel %s", name)
+	}
+}
+
+// Serve answers the inbound messages of a channel until it is closed. Between messages, stale
+// purchase proposals and offers are expired every minute and market prices are recorded daily.
+// Both run on the same goroutine, so the Machine and the channel are never used concurrently.
+func Serve(channel Channel, machine *Machine) error {
+	messages, err := channel.Receive()
+	if err != nil {
+		return err
+	}
+
+	machine.SendMessage = channel.Send
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			reply, err := machine.Generate(message.From, message.Text)
+			if err != nil {
+				log.Printf("Error: %s", err.Error())
+				reply = fmt.Sprintf("Error: %s", err.Error())
+			}
+
+			err = channel.Send(message.From, reply)
+			if err != nil {
+				log.Printf("Error: %s", err.Error())
+			}
+		case <-ticker.C:
+			sweep(machine)
+		}
+	}
+}
+
+// sweep runs the periodic background tasks of the Machine and logs their errors.
+func sweep(machine *Machine) {
+	err := machine.ExpireProposals()
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+	}
+	err = machine.SweepOffers()
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+	}
+	err = machine.SnapshotPrices()
+	if err != nil {
+		log.Printf("Error: %s", err.Error())
+	}
+}
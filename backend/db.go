@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/x/bsonx"
+	"log"
+	"strings"
 	"time"
 )
 
@@ -28,6 +32,11 @@ func MakeGeoJSONPnt(lat float64, lon float64) GeoJSON {
 	return GeoJSON{Type: "Point", Coords: []float64{lon, lat}}
 }
 
+// geoNearLimit is the maximum number of documents returned by $geoNear stages, which return only
+// 100 documents by default on MongoDB 3.4. The filters of the later stages belong into the query
+// of the stage, such that they are applied before the limit.
+const geoNearLimit = 1000000
+
 // User object bundles all relevant information about an user.
 type User struct {
 	ID       primitive.ObjectID `bson:"_id"`
@@ -37,6 +46,14 @@ type User struct {
 	Kind     *string            `bson:"kind"`
 	Action   string             `bson:"action"`
 	Reqs     []string           `bson:"requirements"`
+	// PIN is the bcrypt hash of the PIN confirming sensitive actions.
+	PIN         *string   `bson:"pin"`
+	PINFailures int       `bson:"pin_failures"`
+	LockedUntil time.Time `bson:"locked_until"`
+	// FarmerAlerts subscribes the user to messages about new farmers nearby. LastAlert is the
+	// time of the last message, such that users are not flooded with alerts.
+	FarmerAlerts bool      `bson:"farmer_alerts"`
+	LastAlert    time.Time `bson:"last_alert"`
 }
 
 // Product object bundles all relevant information about a product.
@@ -54,6 +71,102 @@ type Offer struct {
 	NormalizedPrice float64            `bson:"normalized_price"`
 	Mass            float64            `bson:"mass"`
 	Units           uint64             `bson:"units"`
+	Location        *GeoJSON           `bson:"location,omitempty"`
+	Status          string             `bson:"status"`
+	Created         time.Time          `bson:"created"`
+	Expires         time.Time          `bson:"expires"`
+	Closed          time.Time          `bson:"closed"`
+}
+
+// Offer statuses. Sold out, expired and withdrawn offers are closed and archived after a while.
+const (
+	OfferOpen            = "open"
+	OfferPartiallyFilled = "partially_filled"
+	OfferSoldOut         = "sold_out"
+	OfferExpired         = "expired"
+	OfferWithdrawn       = "withdrawn"
+)
+
+// Seller is a farmer together with the available offers of a product, oldest first.
+type Seller struct {
+	User   `bson:",inline"`
+	Offers []Offer `bson:"offers"`
+}
+
+// closedOffers are the statuses of offers which can not be traded anymore.
+var closedOffers = []string{OfferSoldOut, OfferExpired, OfferWithdrawn}
+
+// availableOffers restricts an offer filter to offers which can be traded at a point in time.
+// Offers without an expiry date never expire.
+func availableOffers(filter bson.M, now time.Time) bson.M {
+	filter["status"] = bson.M{"$nin": closedOffers}
+	filter["expires"] = bson.M{"$not": bson.M{"$lte": now}}
+	return filter
+}
+
+// Trade statuses.
+const (
+	TradeProposed  = "proposed"
+	TradeRequested = "requested"
+	TradeCompleted = "completed"
+	TradeCancelled = "cancelled"
+	TradeDeclined  = "declined"
+	TradeExpired   = "expired"
+)
+
+// Trade object bundles all relevant information about a purchase of an offer.
+type Trade struct {
+	ID      primitive.ObjectID `bson:"_id"`
+	Buyer   primitive.ObjectID `bson:"buyer"`
+	Seller  primitive.ObjectID `bson:"seller"`
+	Offer   primitive.ObjectID `bson:"offer"`
+	Product primitive.ObjectID `bson:"product"`
+	Mass    float64            `bson:"mass"`
+	Units   uint64             `bson:"units"`
+	Price   float64            `bson:"price"`
+	Created time.Time          `bson:"created"`
+	Status  string             `bson:"status"`
+	// Location is the location of the offer at the time of the trade.
+	Location *GeoJSON `bson:"location,omitempty"`
+}
+
+// tradePrice returns the price of the traded mass or units at the normalized price of an offer.
+func tradePrice(offer *Offer, trade *Trade) float64 {
+	if trade.Units > 0 {
+		return offer.NormalizedPrice * float64(trade.Units)
+	}
+	return offer.NormalizedPrice * trade.Mass
+}
+
+// Order statuses.
+const (
+	OrderOpen      = "open"
+	OrderMatched   = "matched"
+	OrderCancelled = "cancelled"
+)
+
+// Order is a standing buy order which could not be filled yet. It is matched with new offers of
+// its product at a normalized price not above its own.
+type Order struct {
+	ID              primitive.ObjectID `bson:"_id"`
+	Buyer           primitive.ObjectID `bson:"buyer"`
+	Product         primitive.ObjectID `bson:"product"`
+	Price           float64            `bson:"price"`
+	NormalizedPrice float64            `bson:"normalized_price"`
+	Mass            float64            `bson:"mass"`
+	Units           uint64             `bson:"units"`
+	Location        *GeoJSON           `bson:"location,omitempty"`
+	Status          string             `bson:"status"`
+	Created         time.Time          `bson:"created"`
+	Expires         time.Time          `bson:"expires,omitempty"`
+}
+
+// openOrders restricts an order filter to open orders which did not expire at a point in time.
+// Orders without an expiry date never expire.
+func openOrders(filter bson.M, now time.Time) bson.M {
+	filter["status"] = OrderOpen
+	filter["expires"] = bson.M{"$not": bson.M{"$lte": now}}
+	return filter
 }
 
 // NewORM initializes the ORM.
@@ -63,17 +176,60 @@ func NewORM(client *mongo.Client, database string) *ORM {
 
 // CreateIndicies initializes the ORM indicies.
 func (orm *ORM) CreateIndicies() error {
-	index := mongo.IndexModel{Keys: bsonx.Doc{{"location", bsonx.String("2dsphere")}},
+	index := mongo.IndexModel{Keys: bsonx.Doc{{Key: "location", Value: bsonx.String("2dsphere")}},
 		Options: options.Index().SetName("user-loc-2dsphere")}
-	ctx, _ := context.WithTimeout(context.Background(), 30*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 	users := orm.DB.Collection("users")
 	_, err := users.Indexes().CreateOne(ctx, index)
+	if err != nil {
+		return err
+	}
+
+	offers := orm.DB.Collection("offers")
+	_, err = offers.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bsonx.Doc{{Key: "location", Value: bsonx.String("2dsphere")}},
+			Options: options.Index().SetName("offer-loc-2dsphere")},
+		{Keys: bsonx.Doc{{Key: "status", Value: bsonx.Int32(1)}, {Key: "expires", Value: bsonx.Int32(1)}},
+			Options: options.Index().SetName("offer-status")}})
+	if err != nil {
+		return err
+	}
+
+	trades := orm.DB.Collection("trades")
+	_, err = trades.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bsonx.Doc{{Key: "buyer", Value: bsonx.Int32(1)}, {Key: "created", Value: bsonx.Int32(-1)}},
+			Options: options.Index().SetName("trade-buyer")},
+		{Keys: bsonx.Doc{{Key: "seller", Value: bsonx.Int32(1)}, {Key: "created", Value: bsonx.Int32(-1)}},
+			Options: options.Index().SetName("trade-seller")},
+		{Keys: bsonx.Doc{{Key: "status", Value: bsonx.Int32(1)}},
+			Options: options.Index().SetName("trade-status")},
+		{Keys: bsonx.Doc{{Key: "location", Value: bsonx.String("2dsphere")}},
+			Options: options.Index().SetName("trade-loc-2dsphere")}})
+	if err != nil {
+		return err
+	}
+
+	history := orm.DB.Collection("price_history")
+	_, err = history.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bsonx.Doc{{Key: "product", Value: bsonx.Int32(1)}, {Key: "units", Value: bsonx.Int32(1)},
+			{Key: "day", Value: bsonx.Int32(1)}},
+		Options: options.Index().SetName("price-history").SetUnique(true)})
+	if err != nil {
+		return err
+	}
+
+	orders := orm.DB.Collection("orders")
+	_, err = orders.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bsonx.Doc{{Key: "location", Value: bsonx.String("2dsphere")}},
+		Options: options.Index().SetName("order-loc-2dsphere")})
 	return err
 }
 
 // UserByPhone looks for a user by its phone number/username.
 func (orm *ORM) UserByPhone(phone int64) (*User, error) {
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 	users := orm.DB.Collection("users")
 	var user User
 	err := users.FindOne(ctx, bson.M{"phone": phone}).Decode(&user)
@@ -86,43 +242,138 @@ func (orm *ORM) UserByPhone(phone int64) (*User, error) {
 	return &user, nil
 }
 
+// UserByID looks for a user by its ID.
+func (orm *ORM) UserByID(id primitive.ObjectID) (*User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	users := orm.DB.Collection("users")
+	var user User
+	err := users.FindOne(ctx, bson.M{"_id": id}).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
 // NewUser adds a new user to the system.
 func (orm *ORM) NewUser(phone int64) error {
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 	users := orm.DB.Collection("users")
 	_, err := users.InsertOne(ctx, bson.M{"phone": phone,
-		"action": "onboarding", "requirements": []string{"name", "location", "type"}})
+		"action": "onboarding", "requirements": []string{"name", "location", "pin", "type"}})
 	return err
 }
 
 // ResetUserState resets the user state.
 func (orm *ORM) ResetUserState(user *User) error {
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 	users := orm.DB.Collection("users")
 	_, err := users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"action": "",
 		"requirements": []string{}}})
 	return err
 }
 
+// SetUserState sets the current action of the user and its requirements.
+func (orm *ORM) SetUserState(user *User, action string, reqs []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	users := orm.DB.Collection("users")
+	_, err := users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"action": action,
+		"requirements": reqs}})
+	return err
+}
+
 // SetUserName sets the name of the user.
 func (orm *ORM) SetUserName(user *User, name string) error {
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 	users := orm.DB.Collection("users")
 	_, err := users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"name": name}})
 	return err
 }
 
-// SetUserLocation sets the location of the user.
+// SetUserLocation sets the location of the user and its available offers.
 func (orm *ORM) SetUserLocation(user *User, lat float64, lng float64) error {
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 	users := orm.DB.Collection("users")
 	_, err := users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"location": MakeGeoJSONPnt(lat, lng)}})
+	if err != nil {
+		return err
+	}
+	offers := orm.DB.Collection("offers")
+	_, err = offers.UpdateMany(ctx, availableOffers(bson.M{"seller": user.ID}, time.Now()),
+		bson.M{"$set": bson.M{"location": MakeGeoJSONPnt(lat, lng)}})
+	return err
+}
+
+// DeleteUser removes a user from the system. Offers and trades of the user are kept.
+func (orm *ORM) DeleteUser(user *User) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	users := orm.DB.Collection("users")
+	_, err := users.DeleteOne(ctx, bson.M{"_id": user.ID})
+	return err
+}
+
+// SetUserPIN sets the hashed PIN of the user and clears its failed attempts.
+func (orm *ORM) SetUserPIN(user *User, hash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	users := orm.DB.Collection("users")
+	_, err := users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"pin": hash,
+		"pin_failures": 0, "locked_until": time.Time{}}})
+	return err
+}
+
+// SetPINFailures records the number of consecutive wrong PINs of the user and until when it is
+// locked.
+func (orm *ORM) SetPINFailures(user *User, failures int, lockedUntil time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	users := orm.DB.Collection("users")
+	_, err := users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"pin_failures": failures,
+		"locked_until": lockedUntil}})
+	return err
+}
+
+// SetFarmerAlerts subscribes or unsubscribes the user from alerts about new farmers nearby.
+func (orm *ORM) SetFarmerAlerts(user *User, enabled bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	users := orm.DB.Collection("users")
+	_, err := users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"farmer_alerts": enabled}})
 	return err
 }
 
+// RecordAlert records that an alert is sent to the user at a point in time, unless the last
+// alert was sent after another point in time. It returns whether the alert was recorded.
+func (orm *ORM) RecordAlert(user *User, now time.Time, before time.Time) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	users := orm.DB.Collection("users")
+	res, err := users.UpdateOne(ctx, bson.M{"_id": user.ID, "last_alert": bson.M{"$not": bson.M{"$gt": before}}},
+		bson.M{"$set": bson.M{"last_alert": now}})
+	if err != nil {
+		return false, err
+	}
+	if res.MatchedCount == 0 {
+		return false, nil
+	}
+
+	user.LastAlert = now
+	return true, nil
+}
+
 // SetUserKind sets the type of the user.
 func (orm *ORM) SetUserKind(user *User, kind string) error {
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 	users := orm.DB.Collection("users")
 	_, err := users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$set": bson.M{"kind": kind}})
 	return err
@@ -130,7 +381,8 @@ func (orm *ORM) SetUserKind(user *User, kind string) error {
 
 // PopRequirement removes the top requirement of the current action.
 func (orm *ORM) PopRequirement(user *User) error {
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 	users := orm.DB.Collection("users")
 	_, err := users.UpdateOne(ctx, bson.M{"_id": user.ID}, bson.M{"$pop": bson.M{"requirements": -1}})
 	return err
@@ -138,9 +390,10 @@ func (orm *ORM) PopRequirement(user *User) error {
 
 // FindFarmersNear finds farmers near a geo point within a specific range in meters.
 func (orm *ORM) FindFarmersNear(lat float64, lng float64, dist float64) ([]User, error) {
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 	collection := orm.DB.Collection("users")
-	cur, err := collection.Aggregate(ctx, []bson.M{bson.M{"$geoNear": bson.M{"near": MakeGeoJSONPnt(lat, lng), "minDistance": 0, "maxDistance": dist, "distanceField": "location.distance", "spherical": true}}})
+	cur, err := collection.Aggregate(ctx, []bson.M{bson.M{"$geoNear": bson.M{"near": MakeGeoJSONPnt(lat, lng), "minDistance": 0, "maxDistance": dist, "distanceField": "location.distance", "spherical": true, "num": geoNearLimit}}})
 	if err != nil {
 		return nil, err
 	}
@@ -162,9 +415,56 @@ func (orm *ORM) FindFarmersNear(lat float64, lng float64, dist float64) ([]User,
 	return users, nil
 }
 
+// FindSellersNear finds the farmers near a geo point within a specific range in meters who have
+// available offers of a product, nearest first. The distance of each farmer is stored in its
+// location.
+func (orm *ORM) FindSellersNear(product primitive.ObjectID, lat float64, lng float64, dist float64) ([]Seller, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	offers := bson.M{}
+	for key, value := range availableOffers(bson.M{"product": product}, time.Now()) {
+		offers["offers."+key] = value
+	}
+	// Join the offers of the farmers nearby and group the available ones by farmer again.
+	collection := orm.DB.Collection("users")
+	cur, err := collection.Aggregate(ctx, []bson.M{
+		{"$geoNear": bson.M{"near": MakeGeoJSONPnt(lat, lng), "minDistance": 0, "maxDistance": dist,
+			"distanceField": "location.distance", "spherical": true, "query": bson.M{"kind": "farmer"},
+			"num": geoNearLimit}},
+		{"$lookup": bson.M{"from": "offers", "localField": "_id", "foreignField": "seller", "as": "offers"}},
+		{"$unwind": "$offers"},
+		{"$match": offers},
+		{"$sort": bson.D{{Key: "offers.created", Value: 1}, {Key: "offers._id", Value: 1}}},
+		{"$group": bson.M{"_id": "$_id", "user": bson.M{"$first": "$$ROOT"}, "offers": bson.M{"$push": "$offers"}}},
+		{"$addFields": bson.M{"user.offers": "$offers"}},
+		{"$replaceRoot": bson.M{"newRoot": "$user"}},
+		{"$sort": bson.D{{Key: "location.distance", Value: 1}, {Key: "_id", Value: 1}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var sellers []Seller
+	for cur.Next(ctx) {
+		var seller Seller
+		err := cur.Decode(&seller)
+		if err != nil {
+			return nil, err
+		}
+		sellers = append(sellers, seller)
+	}
+
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+
+	return sellers, nil
+}
+
 // FindOrCreateProduct finds a product or creates a new one.
 func (orm *ORM) FindOrCreateProduct(name string) (*Product, error) {
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 	products := orm.DB.Collection("products")
 
 	// In a real implementation, please use something atomic.
@@ -187,37 +487,542 @@ func (orm *ORM) FindOrCreateProduct(name string) (*Product, error) {
 
 }
 
+// ProductByID looks for a product by its ID.
+func (orm *ORM) ProductByID(id primitive.ObjectID) (*Product, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	products := orm.DB.Collection("products")
+	var product Product
+	err := products.FindOne(ctx, bson.M{"_id": id}).Decode(&product)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &product, nil
+}
+
+// Products returns all products.
+func (orm *ORM) Products() ([]Product, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cur, err := orm.DB.Collection("products").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var products []Product
+	for cur.Next(ctx) {
+		var product Product
+		err := cur.Decode(&product)
+		if err != nil {
+			return nil, err
+		}
+		products = append(products, product)
+	}
+
+	return products, cur.Err()
+}
+
 // CreateMassOffer creates a new offer based on a specific mass.
 func (orm *ORM) CreateMassOffer(user primitive.ObjectID, product primitive.ObjectID,
-	price float64, mass float64) error {
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	offers := orm.DB.Collection("offers")
-	_, err := offers.InsertOne(ctx, bson.M{"product": product, "seller": user, "price": price, "mass": mass, "normalized_price": price / mass})
-	return err
+	price float64, mass float64, expires time.Time) (*Offer, error) {
+	return orm.createOffer(user, expires, bson.M{"product": product, "seller": user, "price": price, "mass": mass, "normalized_price": price / mass})
 }
 
 // CreateUnitOffer creates a new offer based on a number of units to sell.
 func (orm *ORM) CreateUnitOffer(user primitive.ObjectID, product primitive.ObjectID,
-	price float64, units uint64) error {
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+	price float64, units uint64, expires time.Time) (*Offer, error) {
+	return orm.createOffer(user, expires, bson.M{"product": product, "seller": user, "price": price, "units": units, "normalized_price": price / float64(units)})
+}
+
+// createOffer inserts an open offer located at the current location of its seller and returns the
+// stored offer.
+func (orm *ORM) createOffer(user primitive.ObjectID, expires time.Time, offer bson.M) (*Offer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var seller User
+	err := orm.DB.Collection("users").FindOne(ctx, bson.M{"_id": user}).Decode(&seller)
+	if err != nil {
+		return nil, err
+	}
+	if seller.Location != nil {
+		offer["location"] = MakeGeoJSONPnt(seller.Location.Coords[1], seller.Location.Coords[0])
+	}
+	offer["status"] = OfferOpen
+	offer["created"] = time.Now().UTC()
+	if !expires.IsZero() {
+		offer["expires"] = expires
+	}
+
+	offers := orm.DB.Collection("offers")
+	res, err := offers.InsertOne(ctx, offer)
+	if err != nil {
+		return nil, err
+	}
+
+	var created Offer
+	err = offers.FindOne(ctx, bson.M{"_id": res.InsertedID}).Decode(&created)
+	if err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// LocateOffers sets the location of offers created before offers were located to the location
+// of their sellers.
+func (orm *ORM) LocateOffers() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 	offers := orm.DB.Collection("offers")
-	_, err := offers.InsertOne(ctx, bson.M{"product": product, "seller": user, "price": price, "units": units, "normalized_price": price / float64(units)})
+	cur, err := offers.Find(ctx, bson.M{"location": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	users := orm.DB.Collection("users")
+	for cur.Next(ctx) {
+		var offer Offer
+		err := cur.Decode(&offer)
+		if err != nil {
+			return err
+		}
+		var seller User
+		err = users.FindOne(ctx, bson.M{"_id": offer.Seller}).Decode(&seller)
+		if err == mongo.ErrNoDocuments || (err == nil && seller.Location == nil) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		_, err = offers.UpdateOne(ctx, bson.M{"_id": offer.ID}, bson.M{"$set": bson.M{
+			"location": MakeGeoJSONPnt(seller.Location.Coords[1], seller.Location.Coords[0])}})
+		if err != nil {
+			return err
+		}
+		log.Printf("Located offer %s of seller %s.", offer.ID.Hex(), seller.ID.Hex())
+	}
+
+	return cur.Err()
+}
+
+// MergeProducts renames the products created before the catalog was introduced to their canonical
+// names. If the canonical product exists already, the offers, trades, orders and price history of
+// the old product are moved to it and the old product is removed. Products which are not in the
+// catalog are kept.
+func (orm *ORM) MergeProducts(catalog *Catalog) error {
+	products, err := orm.Products()
+	if err != nil {
+		return err
+	}
+	ids := map[string]primitive.ObjectID{}
+	for _, product := range products {
+		ids[product.Name] = product.ID
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	for _, product := range products {
+		name, _ := catalog.Lookup(product.Name)
+		if name == "" {
+			log.Printf("Product %s is not in the catalog.", product.Name)
+			continue
+		} else if name == product.Name {
+			continue
+		}
+
+		canonical, ok := ids[name]
+		if !ok {
+			_, err = orm.DB.Collection("products").UpdateOne(ctx, bson.M{"_id": product.ID},
+				bson.M{"$set": bson.M{"name": name}})
+			if err != nil {
+				return err
+			}
+			ids[name] = product.ID
+			log.Printf("Renamed product %s to %s.", product.Name, name)
+			continue
+		}
+
+		for _, collection := range []string{"offers", "offers_archive", "trades", "orders"} {
+			_, err = orm.DB.Collection(collection).UpdateMany(ctx, bson.M{"product": product.ID},
+				bson.M{"$set": bson.M{"product": canonical}})
+			if err != nil {
+				return err
+			}
+		}
+		err = orm.mergePriceHistory(ctx, product.ID, canonical)
+		if err != nil {
+			return err
+		}
+		_, err = orm.DB.Collection("products").DeleteOne(ctx, bson.M{"_id": product.ID})
+		if err != nil {
+			return err
+		}
+		log.Printf("Merged product %s into %s.", product.Name, name)
+	}
+
+	return nil
+}
+
+// mergePriceHistory moves the price snapshots of a product to another one. Snapshots of days
+// which the other product has a snapshot of already are dropped.
+func (orm *ORM) mergePriceHistory(ctx context.Context, from primitive.ObjectID, to primitive.ObjectID) error {
+	history := orm.DB.Collection("price_history")
+	cur, err := history.Find(ctx, bson.M{"product": from})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var snapshot PriceSnapshot
+		err = cur.Decode(&snapshot)
+		if err != nil {
+			return err
+		}
+		count, err := history.CountDocuments(ctx,
+			bson.M{"product": to, "units": snapshot.Units, "day": snapshot.Day})
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			_, err = history.DeleteOne(ctx, bson.M{"_id": snapshot.ID})
+		} else {
+			_, err = history.UpdateOne(ctx, bson.M{"_id": snapshot.ID}, bson.M{"$set": bson.M{"product": to}})
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return cur.Err()
+}
+
+// pricedCollections lists the price fields of the collections which store prices.
+var pricedCollections = []struct {
+	Name   string
+	Fields []string
+}{
+	{"offers", []string{"price", "normalized_price"}},
+	{"offers_archive", []string{"price", "normalized_price"}},
+	{"trades", []string{"price"}},
+	{"orders", []string{"price", "normalized_price"}},
+	{"price_history", []string{"median", "min", "max"}},
+}
+
+// PriceMigration records the conversion of the stored prices into another currency. It is stored
+// in the settings collection before any price is converted, such that an interrupted migration
+// can be resumed.
+type PriceMigration struct {
+	ID string `bson:"_id"`
+	// From is the currency of the prices of documents without currency.
+	From string `bson:"from"`
+	To   string `bson:"to"`
+	// Before limits the migration to documents created before it started.
+	Before time.Time `bson:"before"`
+	Done   bool      `bson:"done"`
+}
+
+// priceMigration returns the recorded price migration or nil if prices were never migrated.
+func (orm *ORM) priceMigration(ctx context.Context) (*PriceMigration, error) {
+	var migration PriceMigration
+	err := orm.DB.Collection("settings").FindOne(ctx, bson.M{"_id": "price-migration"}).Decode(&migration)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &migration, nil
+}
+
+// CheckPrices ensures that the stored prices are in the default currency. It fails if a price
+// migration into another currency was recorded or did not finish. Without any recorded migration,
+// the default currency is recorded for a new database, while prices stored before currencies were
+// introduced have to be migrated first.
+func (orm *ORM) CheckPrices(currencies *Currencies) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	migration, err := orm.priceMigration(ctx)
+	if err != nil {
+		return err
+	}
+	if migration == nil {
+		for _, collection := range pricedCollections {
+			count, err := orm.DB.Collection(collection.Name).CountDocuments(ctx, bson.M{},
+				options.Count().SetLimit(1))
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				return fmt.Errorf("Prices of %s are stored without currency, run migrate-prices -from with their currency",
+					collection.Name)
+			}
+		}
+		migration = &PriceMigration{ID: "price-migration", From: currencies.Default,
+			To: currencies.Default, Before: nextSecond(), Done: true}
+		_, err = orm.DB.Collection("settings").InsertOne(ctx, migration)
+		return err
+	}
+	if !migration.Done {
+		return fmt.Errorf("Migration of prices into %s did not finish, run migrate-prices again",
+			migration.To)
+	}
+	if migration.To != currencies.Default {
+		return fmt.Errorf("Prices are stored in %s, run migrate-prices to convert them into %s",
+			migration.To, currencies.Default)
+	}
+
+	return nil
+}
+
+// nextSecond returns the start of the next second, which is after all documents created so far.
+func nextSecond() time.Time {
+	return time.Now().UTC().Truncate(time.Second).Add(time.Second)
+}
+
+// MigratePrices converts all stored prices into the default currency. Prices of documents without
+// currency are taken in the currency of the previous migration or, if prices were never migrated,
+// in the given currency. Converted documents are marked with their new currency in the same
+// update, so running an interrupted migration again does not convert prices twice.
+func (orm *ORM) MigratePrices(from string, currencies *Currencies) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	migration, err := orm.priceMigration(ctx)
+	if err != nil {
+		return err
+	}
+	switch {
+	case migration == nil && from == "":
+		return errors.New("Cannot migrate prices without the currency of the stored prices.")
+	case migration == nil:
+		migration = &PriceMigration{From: strings.ToUpper(from), To: currencies.Default,
+			Before: nextSecond()}
+	case migration.To != currencies.Default:
+		migration = &PriceMigration{From: migration.To, To: currencies.Default,
+			Before: nextSecond()}
+	case migration.Done:
+		log.Printf("Prices are already stored in %s.", migration.To)
+		return nil
+	}
+	migration.ID = "price-migration"
+	migration.Done = false
+	settings := orm.DB.Collection("settings")
+	_, err = settings.ReplaceOne(ctx, bson.M{"_id": migration.ID}, migration,
+		options.Replace().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+
+	// Object IDs start with the second of their creation.
+	var before primitive.ObjectID
+	binary.BigEndian.PutUint32(before[:4], uint32(migration.Before.Unix()))
+	created := bson.M{"$lt": before}
+	for _, collection := range pricedCollections {
+		prices := orm.DB.Collection(collection.Name)
+		marked, err := prices.Distinct(ctx, "currency",
+			bson.M{"_id": created, "currency": bson.M{"$ne": migration.To}})
+		if err != nil {
+			return err
+		}
+		sources := map[string]bool{migration.From: true}
+		for _, currency := range marked {
+			if code, ok := currency.(string); ok {
+				sources[code] = true
+			}
+		}
+		for source := range sources {
+			if source == migration.To {
+				continue
+			}
+			rate, ok := currencies.Convert(Money{1, source})
+			if !ok {
+				return fmt.Errorf("Cannot convert prices of %s from %s into %s without exchange rate",
+					collection.Name, source, migration.To)
+			}
+			factors := bson.M{}
+			for _, field := range collection.Fields {
+				factors[field] = rate
+			}
+			filter := bson.M{"_id": created, "currency": source}
+			if source == migration.From {
+				filter["currency"] = bson.M{"$in": []interface{}{nil, source}}
+			}
+			res, err := prices.UpdateMany(ctx, filter,
+				bson.M{"$mul": factors, "$set": bson.M{"currency": migration.To}})
+			if err != nil {
+				return err
+			}
+			log.Printf("Converted prices of %d %s from %s into %s.", res.ModifiedCount,
+				collection.Name, source, migration.To)
+		}
+	}
+
+	_, err = settings.UpdateOne(ctx, bson.M{"_id": migration.ID}, bson.M{"$set": bson.M{"done": true}})
 	return err
 }
 
-// FindMassOffer finds a offer fulfilling pricing criterea.
-func (orm *ORM) FindMassOffer(product primitive.ObjectID, price float64, mass float64) (*Offer,
-	*User, error) {
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+// FindOffers finds the mass or unit offers of a product with a normalized price not above the
+// given one, located within a range in meters, cheapest first. The distance of each offer is
+// stored in its location.
+func (orm *ORM) FindOffers(product primitive.ObjectID, units bool, price float64, lat float64,
+	lng float64, dist float64) ([]Offer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	filter := availableOffers(bson.M{"product": product, "normalized_price": bson.M{"$lte": price}, "mass": bson.M{"$gt": 0}}, time.Now())
+	if units {
+		delete(filter, "mass")
+		filter["units"] = bson.M{"$gt": 0}
+	}
+	collection := orm.DB.Collection("offers")
+	cur, err := collection.Aggregate(ctx, []bson.M{
+		{"$geoNear": bson.M{"near": MakeGeoJSONPnt(lat, lng), "minDistance": 0, "maxDistance": dist, "distanceField": "location.distance", "spherical": true, "query": filter, "num": geoNearLimit}},
+		{"$sort": bson.M{"normalized_price": 1}}})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var offers []Offer
+	for cur.Next(ctx) {
+		var offer Offer
+		err := cur.Decode(&offer)
+		if err != nil {
+			return nil, err
+		}
+		offers = append(offers, offer)
+	}
+
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+
+	return offers, nil
+}
+
+// OfferPrices returns the normalized prices of the available mass or unit offers of a product
+// which were created since a point in time within a radius around a geo point.
+func (orm *ORM) OfferPrices(query PriceQuery) ([]float64, error) {
+	filter := availableOffers(bson.M{"product": query.Product, "created": bson.M{"$gte": query.Since},
+		"mass": bson.M{"$gt": 0}}, time.Now())
+	if query.Units {
+		delete(filter, "mass")
+		filter["units"] = bson.M{"$gt": 0}
+	}
+	return orm.prices(orm.DB.Collection("offers"), query, filter, "$normalized_price")
+}
+
+// TradePrices returns the normalized prices of the completed mass or unit trades of a product
+// since a point in time within a radius around a geo point.
+func (orm *ORM) TradePrices(query PriceQuery) ([]float64, error) {
+	filter := bson.M{"product": query.Product, "status": TradeCompleted, "created": bson.M{"$gte": query.Since},
+		"mass": bson.M{"$gt": 0}}
+	price := bson.M{"$divide": bson.A{"$price", "$mass"}}
+	if query.Units {
+		delete(filter, "mass")
+		filter["units"] = bson.M{"$gt": 0}
+		price = bson.M{"$divide": bson.A{"$price", "$units"}}
+	}
+	return orm.prices(orm.DB.Collection("trades"), query, filter, price)
+}
+
+// prices aggregates the prices of the documents of a collection matching a filter within the
+// radius of a price query.
+func (orm *ORM) prices(collection *mongo.Collection, query PriceQuery, filter bson.M, price interface{}) ([]float64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	pipeline := []bson.M{{"$match": filter}}
+	if query.Radius > 0 {
+		pipeline = []bson.M{{"$geoNear": bson.M{"near": MakeGeoJSONPnt(query.Lat, query.Lng), "minDistance": 0,
+			"maxDistance": query.Radius, "distanceField": "location.distance", "spherical": true, "query": filter,
+			"num": geoNearLimit}}}
+	}
+	pipeline = append(pipeline, bson.M{"$project": bson.M{"_id": 0, "price": price}})
+	cur, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var prices []float64
+	for cur.Next(ctx) {
+		var result struct {
+			Price float64 `bson:"price"`
+		}
+		err := cur.Decode(&result)
+		if err != nil {
+			return nil, err
+		}
+		prices = append(prices, result.Price)
+	}
+
+	return prices, cur.Err()
+}
+
+// ReserveOffer atomically finds an offer of the traded product with at least the traded mass or
+// units at a normalized price not above the bid, reduces it and records the trade at the price of
+// the offer. If the trade refers to an offer, only this offer is considered. Transactions across
+// documents need MongoDB 4.0 on a replica set, while the docker-compose setup runs a single
+// MongoDB 3.4 server, so the reservation is remembered in the offer until the trade is recorded
+// and RecoverReservations releases reservations without a trade. It returns nil if no offer
+// matches.
+func (orm *ORM) ReserveOffer(trade *Trade) (*Offer, *User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 	offers := orm.DB.Collection("offers")
+	trade.ID = primitive.NewObjectID()
+	trade.Created = time.Now().UTC().Truncate(time.Millisecond)
+	if trade.Status == "" {
+		trade.Status = TradeCompleted
+	}
+
+	filter := availableOffers(bson.M{"product": trade.Product}, trade.Created)
+	if !trade.Offer.IsZero() {
+		filter["_id"] = trade.Offer
+	}
+	var reduction bson.M
+	if trade.Units > 0 {
+		filter["units"] = bson.M{"$gte": trade.Units}
+		filter["normalized_price"] = bson.M{"$lte": trade.Price / float64(trade.Units)}
+		reduction = bson.M{"units": -1 * int64(trade.Units)}
+	} else {
+		filter["mass"] = bson.M{"$gte": trade.Mass}
+		filter["normalized_price"] = bson.M{"$lte": trade.Price / trade.Mass}
+		reduction = bson.M{"mass": -1 * trade.Mass}
+	}
+	update := bson.M{"$inc": reduction, "$push": bson.M{"pending_trades": bson.M{"_id": trade.ID,
+		"mass": trade.Mass, "units": trade.Units, "reserved": trade.Created}}}
+
 	var offer Offer
-	err := offers.FindOne(ctx, bson.M{"product": product, "mass": bson.M{"$gt": mass}, "normalized_price": bson.M{"$lt": (price / mass)}}).Decode(&offer)
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = offers.FindOneAndUpdate(ctx, filter, update,
+			options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&offer)
+		if !isWriteConflict(err) || attempt == 3 {
+			break
+		}
+	}
 	if err == mongo.ErrNoDocuments {
 		return nil, nil, nil
 	} else if err != nil {
 		return nil, nil, err
 	}
 
+	trade.Price = tradePrice(&offer, trade)
+	trade.Offer = offer.ID
+	trade.Seller = offer.Seller
+	trade.Location = offer.Location
+	err = orm.updateOfferStatus(ctx, offer.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = orm.DB.Collection("trades").InsertOne(ctx, trade)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = offers.UpdateOne(ctx, bson.M{"_id": offer.ID},
+		bson.M{"$pull": bson.M{"pending_trades": bson.M{"_id": trade.ID}}})
+	if err != nil {
+		return nil, nil, err
+	}
+
 	users := orm.DB.Collection("users")
 	var user User
 	err = users.FindOne(ctx, bson.M{"_id": offer.Seller}).Decode(&user)
@@ -228,65 +1033,503 @@ func (orm *ORM) FindMassOffer(product primitive.ObjectID, price float64, mass fl
 	return &offer, &user, nil
 }
 
-// FindUnitOffer finds a offer fulfilling pricing criterea.
-func (orm *ORM) FindUnitOffer(product primitive.ObjectID, price float64, units uint64) (*Offer,
-	*User, error) {
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+// isWriteConflict returns whether an operation failed due to a concurrent write.
+func isWriteConflict(err error) bool {
+	cmdErr, ok := err.(mongo.CommandError)
+	return ok && cmdErr.Code == 112
+}
+
+// RecoverReservations releases all offer reservations which were made before a point in time and
+// whose trade was not recorded.
+func (orm *ORM) RecoverReservations(before time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 	offers := orm.DB.Collection("offers")
-	var offer Offer
-	err := offers.FindOne(ctx, bson.M{"product": product, "units": bson.M{"$gt": units}, "normalized_price": bson.M{"$lt": price / float64(units)}}).Decode(&offer)
+	trades := orm.DB.Collection("trades")
+	cur, err := offers.Find(ctx, bson.M{"pending_trades.0": bson.M{"$exists": true}})
+	if err != nil {
+		return err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var offer struct {
+			ID      primitive.ObjectID `bson:"_id"`
+			Pending []struct {
+				ID       primitive.ObjectID `bson:"_id"`
+				Mass     float64            `bson:"mass"`
+				Units    uint64             `bson:"units"`
+				Reserved time.Time          `bson:"reserved"`
+			} `bson:"pending_trades"`
+		}
+		err := cur.Decode(&offer)
+		if err != nil {
+			return err
+		}
+
+		for _, pending := range offer.Pending {
+			if !pending.Reserved.Before(before) {
+				continue
+			}
+			recorded, err := trades.CountDocuments(ctx, bson.M{"_id": pending.ID})
+			if err != nil {
+				return err
+			}
+			update := bson.M{"$pull": bson.M{"pending_trades": bson.M{"_id": pending.ID}}}
+			if recorded == 0 {
+				update["$inc"] = bson.M{"mass": pending.Mass, "units": int64(pending.Units)}
+				log.Printf("Releasing reservation %s of offer %s.", pending.ID.Hex(), offer.ID.Hex())
+			}
+			_, err = offers.UpdateOne(ctx, bson.M{"_id": offer.ID}, update)
+			if err != nil {
+				return err
+			}
+		}
+		err = orm.updateOfferStatus(ctx, offer.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return cur.Err()
+}
+
+// TradeByID looks for a trade by its ID.
+func (orm *ORM) TradeByID(id primitive.ObjectID) (*Trade, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	trades := orm.DB.Collection("trades")
+	var trade Trade
+	err := trades.FindOne(ctx, bson.M{"_id": id}).Decode(&trade)
 	if err == mongo.ErrNoDocuments {
-		return nil, nil, nil
+		return nil, nil
 	} else if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
-	users := orm.DB.Collection("users")
-	var user User
-	err = users.FindOne(ctx, bson.M{"_id": offer.Seller}).Decode(&user)
+	return &trade, nil
+}
+
+// SetTradeStatus changes the status of a trade if it still has the expected status. It returns
+// whether the status was changed.
+func (orm *ORM) SetTradeStatus(trade *Trade, from string, to string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	trades := orm.DB.Collection("trades")
+	res, err := trades.UpdateOne(ctx, bson.M{"_id": trade.ID, "status": from},
+		bson.M{"$set": bson.M{"status": to}})
 	if err != nil {
-		return nil, nil, err
+		return false, err
+	}
+	if res.MatchedCount == 0 {
+		return false, nil
 	}
 
-	return &offer, &user, nil
+	trade.Status = to
+	return true, nil
 }
 
-// ReduceMassOffer reduces the publicly available offer by a specific mass.
-func (orm *ORM) ReduceMassOffer(offer primitive.ObjectID, mass float64) error {
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	users := orm.DB.Collection("offers")
-	_, err := users.UpdateOne(ctx, bson.M{"_id": offer}, bson.M{"$inc": bson.M{"mass": (-1 * mass)}})
-	return err
+// ReleaseOffer returns the reserved mass or units of a trade to its offer. Sold out offers become
+// partially filled again.
+func (orm *ORM) ReleaseOffer(trade *Trade) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	offers := orm.DB.Collection("offers")
+	release := bson.M{"mass": trade.Mass}
+	if trade.Units > 0 {
+		release = bson.M{"units": int64(trade.Units)}
+	}
+	_, err := offers.UpdateOne(ctx, bson.M{"_id": trade.Offer}, bson.M{"$inc": release})
+	if err != nil {
+		return err
+	}
+	return orm.updateOfferStatus(ctx, trade.Offer)
 }
 
-// ReduceUnitOffer reduces the publicly available offer by a specific amount.
-func (orm *ORM) ReduceUnitOffer(offer primitive.ObjectID, units uint64) error {
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	users := orm.DB.Collection("offers")
-	_, err := users.UpdateOne(ctx, bson.M{"_id": offer},
-		bson.M{"$inc": bson.M{"units": (-1 * int64(units))}})
+// updateOfferStatus updates the status of an offer after its mass or units changed. Every
+// transition is conditional on the current quantity, such that concurrent changes can not leave
+// a wrong status behind. Offers which were released after selling out are partially filled.
+func (orm *ORM) updateOfferStatus(ctx context.Context, id primitive.ObjectID) error {
+	offers := orm.DB.Collection("offers")
+	_, err := offers.UpdateOne(ctx, bson.M{"_id": id,
+		"status": bson.M{"$nin": closedOffers},
+		"mass":   bson.M{"$not": bson.M{"$gt": 0}},
+		"units":  bson.M{"$not": bson.M{"$gt": 0}}},
+		bson.M{"$set": bson.M{"status": OfferSoldOut, "closed": time.Now().UTC()}})
+	if err != nil {
+		return err
+	}
+
+	_, err = offers.UpdateOne(ctx, bson.M{"_id": id,
+		"status": bson.M{"$in": []string{OfferOpen, OfferSoldOut}},
+		"$or":    []bson.M{{"mass": bson.M{"$gt": 0}}, {"units": bson.M{"$gt": 0}}}},
+		bson.M{"$set": bson.M{"status": OfferPartiallyFilled}, "$unset": bson.M{"closed": ""}})
 	return err
 }
 
-// GetAveragePrice returns the average price for a product.
-func (orm *ORM) GetAveragePrice(product primitive.ObjectID) (*float64, error) {
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
+// SellerOffers returns the available offers of a seller, oldest first.
+func (orm *ORM) SellerOffers(seller primitive.ObjectID) ([]Offer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 	collection := orm.DB.Collection("offers")
-	cur, err := collection.Aggregate(ctx, []bson.M{bson.M{"$group": bson.M{"_id": "$product", "avgPrice": bson.M{"$avg": "$normalized_price"}}}, bson.M{"$match": bson.M{"_id": product}}})
+	cur, err := collection.Find(ctx, availableOffers(bson.M{"seller": seller}, time.Now()),
+		options.Find().SetSort(bson.D{{Key: "created", Value: 1}, {Key: "_id", Value: 1}}))
 	if err != nil {
 		return nil, err
 	}
 	defer cur.Close(ctx)
+	var offers []Offer
 	for cur.Next(ctx) {
-		var agg bson.M
-		err := cur.Decode(&agg)
+		var offer Offer
+		err := cur.Decode(&offer)
 		if err != nil {
 			return nil, err
 		}
-		if val, ok := agg["avgPrice"].(float64); ok {
-			return &val, nil
+		offers = append(offers, offer)
+	}
+
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+
+	return offers, nil
+}
+
+// UpdateOffer changes the price and quantity of an available offer of a seller, unless its mass
+// or units changed since it was read. It returns whether the offer was changed.
+func (orm *ORM) UpdateOffer(offer *Offer, price float64, mass float64, units uint64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	filter := availableOffers(bson.M{"_id": offer.ID, "seller": offer.Seller}, time.Now())
+	update := bson.M{"price": price}
+	if offer.Units > 0 {
+		filter["units"] = offer.Units
+		update["units"] = units
+		update["normalized_price"] = price / float64(units)
+	} else {
+		filter["mass"] = offer.Mass
+		update["mass"] = mass
+		update["normalized_price"] = price / mass
+	}
+	res, err := orm.DB.Collection("offers").UpdateOne(ctx, filter, bson.M{"$set": update})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// WithdrawOffer closes an available offer of a seller. Reservations of pending trades are not
+// affected. It returns whether the offer was withdrawn.
+func (orm *ORM) WithdrawOffer(offer *Offer) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := orm.DB.Collection("offers").UpdateOne(ctx,
+		availableOffers(bson.M{"_id": offer.ID, "seller": offer.Seller}, time.Now()),
+		bson.M{"$set": bson.M{"status": OfferWithdrawn, "closed": time.Now().UTC()}})
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount > 0, nil
+}
+
+// ExpireOffers closes all available offers whose expiry date passed and returns them.
+func (orm *ORM) ExpireOffers(now time.Time) ([]Offer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	offers := orm.DB.Collection("offers")
+	cur, err := offers.Find(ctx, bson.M{"status": bson.M{"$nin": closedOffers},
+		"expires": bson.M{"$lte": now}})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var expired []Offer
+	for cur.Next(ctx) {
+		var offer Offer
+		err := cur.Decode(&offer)
+		if err != nil {
+			return nil, err
 		}
+		res, err := offers.UpdateOne(ctx, bson.M{"_id": offer.ID, "status": offer.Status},
+			bson.M{"$set": bson.M{"status": OfferExpired, "closed": now}})
+		if err != nil {
+			return nil, err
+		}
+		if res.ModifiedCount > 0 {
+			offer.Status = OfferExpired
+			offer.Closed = now
+			expired = append(expired, offer)
+		}
+	}
+
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+
+	return expired, nil
+}
+
+// ArchiveOffers moves all offers which were closed before a point in time into the
+// offers_archive collection. It returns the number of archived offers.
+func (orm *ORM) ArchiveOffers(before time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	offers := orm.DB.Collection("offers")
+	archive := orm.DB.Collection("offers_archive")
+	cur, err := offers.Find(ctx, bson.M{"status": bson.M{"$in": closedOffers},
+		"closed": bson.M{"$lt": before}, "pending_trades.0": bson.M{"$exists": false}})
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(ctx)
+	archived := 0
+	for cur.Next(ctx) {
+		var offer bson.M
+		err := cur.Decode(&offer)
+		if err != nil {
+			return archived, err
+		}
+		_, err = archive.ReplaceOne(ctx, bson.M{"_id": offer["_id"]}, offer,
+			options.Replace().SetUpsert(true))
+		if err != nil {
+			return archived, err
+		}
+
+		// The offer might have been released in the meantime, so it is only removed if it is
+		// still closed.
+		res, err := offers.DeleteOne(ctx, bson.M{"_id": offer["_id"], "status": offer["status"]})
+		if err != nil {
+			return archived, err
+		}
+		if res.DeletedCount == 0 {
+			_, err = archive.DeleteOne(ctx, bson.M{"_id": offer["_id"]})
+			if err != nil {
+				return archived, err
+			}
+			continue
+		}
+		archived++
+	}
+
+	return archived, cur.Err()
+}
+
+// StaleTrades returns all trades with a status which were created before a point in time.
+func (orm *ORM) StaleTrades(status string, before time.Time) ([]Trade, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	collection := orm.DB.Collection("trades")
+	cur, err := collection.Find(ctx, bson.M{"status": status, "created": bson.M{"$lt": before}})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var trades []Trade
+	for cur.Next(ctx) {
+		var trade Trade
+		err := cur.Decode(&trade)
+		if err != nil {
+			return nil, err
+		}
+		trades = append(trades, trade)
+	}
+
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+
+	return trades, nil
+}
+
+// SellerTrades returns the trades of a seller with a status, oldest first.
+func (orm *ORM) SellerTrades(seller primitive.ObjectID, status string) ([]Trade, error) {
+	return orm.partyTrades("seller", seller, status)
+}
+
+// BuyerTrades returns the trades of a buyer with a status, oldest first.
+func (orm *ORM) BuyerTrades(buyer primitive.ObjectID, status string) ([]Trade, error) {
+	return orm.partyTrades("buyer", buyer, status)
+}
+
+// partyTrades returns the trades with a status in which a user was the given party, oldest first.
+func (orm *ORM) partyTrades(party string, user primitive.ObjectID, status string) ([]Trade, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	collection := orm.DB.Collection("trades")
+	cur, err := collection.Find(ctx, bson.M{party: user, "status": status},
+		options.Find().SetSort(bson.M{"created": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var trades []Trade
+	for cur.Next(ctx) {
+		var trade Trade
+		err := cur.Decode(&trade)
+		if err != nil {
+			return nil, err
+		}
+		trades = append(trades, trade)
+	}
+
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+
+	return trades, nil
+}
+
+// TradesByUser returns the latest trades with a status in which a user was buyer or seller.
+func (orm *ORM) TradesByUser(user primitive.ObjectID, status string, limit int64) ([]Trade, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	collection := orm.DB.Collection("trades")
+	cur, err := collection.Find(ctx, bson.M{"$or": []bson.M{{"buyer": user}, {"seller": user}}, "status": status},
+		options.Find().SetSort(bson.M{"created": -1}).SetLimit(limit))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var trades []Trade
+	for cur.Next(ctx) {
+		var trade Trade
+		err := cur.Decode(&trade)
+		if err != nil {
+			return nil, err
+		}
+		trades = append(trades, trade)
+	}
+
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+
+	return trades, nil
+}
+
+// SavePriceSnapshot stores a price snapshot in the price_history collection, replacing the
+// snapshot of the same product, day and pricing.
+func (orm *ORM) SavePriceSnapshot(snapshot *PriceSnapshot) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	history := orm.DB.Collection("price_history")
+	filter := bson.M{"product": snapshot.Product, "day": snapshot.Day, "units": snapshot.Units}
+	var existing PriceSnapshot
+	err := history.FindOne(ctx, filter).Decode(&existing)
+	if err == mongo.ErrNoDocuments {
+		snapshot.ID = primitive.NewObjectID()
+	} else if err != nil {
+		return err
+	} else {
+		snapshot.ID = existing.ID
+	}
+	_, err = history.ReplaceOne(ctx, filter, snapshot, options.Replace().SetUpsert(true))
+	return err
+}
+
+// PriceHistory returns the price snapshots of a product per gram or per unit since a day, oldest
+// first.
+func (orm *ORM) PriceHistory(product primitive.ObjectID, units bool, since time.Time) ([]PriceSnapshot, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	history := orm.DB.Collection("price_history")
+	cur, err := history.Find(ctx, bson.M{"product": product, "units": units, "day": bson.M{"$gte": since}},
+		options.Find().SetSort(bson.M{"day": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var snapshots []PriceSnapshot
+	for cur.Next(ctx) {
+		var snapshot PriceSnapshot
+		err := cur.Decode(&snapshot)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	return snapshots, cur.Err()
+}
+
+// CreateOrder stores a new open standing buy order.
+func (orm *ORM) CreateOrder(order *Order) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	order.ID = primitive.NewObjectID()
+	order.Status = OrderOpen
+	order.Created = time.Now().UTC().Truncate(time.Millisecond)
+	_, err := orm.DB.Collection("orders").InsertOne(ctx, order)
+	return err
+}
+
+// FindOrders finds the open mass or unit orders of a product with a normalized price not below
+// the given one, located within a range in meters, oldest first.
+func (orm *ORM) FindOrders(product primitive.ObjectID, units bool, price float64, lat float64,
+	lng float64, dist float64) ([]Order, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	filter := openOrders(bson.M{"product": product, "normalized_price": bson.M{"$gte": price}, "mass": bson.M{"$gt": 0}}, time.Now())
+	if units {
+		delete(filter, "mass")
+		filter["units"] = bson.M{"$gt": 0}
+	}
+	cur, err := orm.DB.Collection("orders").Aggregate(ctx, []bson.M{
+		{"$geoNear": bson.M{"near": MakeGeoJSONPnt(lat, lng), "minDistance": 0, "maxDistance": dist, "distanceField": "location.distance", "spherical": true, "query": filter, "num": geoNearLimit}},
+		{"$sort": bson.M{"created": 1}}})
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var orders []Order
+	for cur.Next(ctx) {
+		var order Order
+		err := cur.Decode(&order)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+
+	return orders, cur.Err()
+}
+
+// BuyerOrders returns the open orders of a buyer, oldest first.
+func (orm *ORM) BuyerOrders(buyer primitive.ObjectID) ([]Order, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cur, err := orm.DB.Collection("orders").Find(ctx, bson.M{"buyer": buyer, "status": OrderOpen},
+		options.Find().SetSort(bson.D{{Key: "created", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	var orders []Order
+	for cur.Next(ctx) {
+		var order Order
+		err := cur.Decode(&order)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+
+	return orders, cur.Err()
+}
+
+// SetOrderStatus changes the status of an order if it still has the expected status. It returns
+// whether the status was changed.
+func (orm *ORM) SetOrderStatus(order *Order, from string, to string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := orm.DB.Collection("orders").UpdateOne(ctx, bson.M{"_id": order.ID, "status": from},
+		bson.M{"$set": bson.M{"status": to}})
+	if err != nil {
+		return false, err
+	}
+	if res.MatchedCount == 0 {
+		return false, nil
 	}
 
-	return nil, nil
+	order.Status = to
+	return true, nil
 }
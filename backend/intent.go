@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Intent defines the intent of a message.
+type Intent struct {
+	Slug     string
+	FullName string
+	Lat      float64
+	Lng      float64
+	Address  string
+	Product  string
+	Mass     float64
+	Number   uint
+	// Measure is the unit of Number, e.g. "bag". Without a measure, Number counts pieces.
+	Measure string
+	Price   Money
+	// Reference is the number of an item in a list previously sent to the user, e.g. an offer.
+	Reference uint
+}
+
+// IntentClassifier extracts the intent and the entities of a message.
+type IntentClassifier interface {
+	Intent(message string) (*Intent, error)
+}
+
+// NewIntentClassifier initializes the intent classifier backend with the given name. Supported
+// backends are "cai" for SAP Conversational AI and "rules" for the offline rule-based classifier.
+func NewIntentClassifier(backend string) (IntentClassifier, error) {
+	switch backend {
+	case "", "cai":
+		cai := NewCAI(os.Getenv("CAI_TOKEN"))
+		if endpoint := os.Getenv("CAI_ENDPOINT"); endpoint != "" {
+			cai.Endpoint = endpoint
+		}
+		return cai, nil
+	case "rules":
+		return NewRuleClassifier(), nil
+	default:
+		return nil, fmt.Errorf("Unknown intent classifier %s", backend)
+	}
+}
@@ -2,39 +2,108 @@ package main
 
 import (
 	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/crypto/bcrypt"
 	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Machine is the state machine for messaging actions.
 type Machine struct {
-	ORM         *ORM
-	CAI         *CAI
-	SendMessage func(id int64, message string) error
+	Store           Store
+	NLP             IntentClassifier
+	SendMessage     func(id int64, message string) error
+	ProposalTimeout time.Duration
+	// SellerAcceptance requires sellers to accept confirmed purchases within RequestTimeout.
+	SellerAcceptance bool
+	RequestTimeout   time.Duration
+	// MaxDistance is the maximum distance in meters between a buyer and the offers of an order.
+	// Offers are ranked by their normalized price with a relative surcharge of DistanceWeight
+	// at MaxDistance.
+	MaxDistance    float64
+	DistanceWeight float64
+	// OfferLifetime is the time after which new offers expire. Closed offers are archived after
+	// ArchiveDelay.
+	OfferLifetime time.Duration
+	ArchiveDelay  time.Duration
+	// PINCost is the bcrypt cost of hashed PINs. After MaxPINFailures wrong PINs in a row, a user
+	// is locked out of sensitive actions for PINLockout.
+	PINCost        int
+	MaxPINFailures int
+	PINLockout     time.Duration
+	// Market prices consider the trades and offers within PriceRadius meters of the user during
+	// the last PriceWindow.
+	PriceRadius float64
+	PriceWindow time.Duration
+	// Farmers nearby, and those selling a product, are searched within SearchRadius meters.
+	SearchRadius float64
+	// New farmers are announced to subscribed users within AlertRadius meters, but at most once
+	// per AlertInterval to each user.
+	AlertRadius   float64
+	AlertInterval time.Duration
+	// snapshotDay is the last day whose prices were recorded in the price history.
+	snapshotDay time.Time
+	// Units converts the quantities of requests into grams or pieces and formats them in replies.
+	// Currencies converts prices into the default currency and formats them.
+	// Catalog restricts the tradable products and maps their synonyms to canonical names.
+	Units      *Units
+	Currencies *Currencies
+	Catalog    *Catalog
+	Now        func() time.Time
 }
 
 // NewMachine initializes a new Machine.
-func NewMachine(orm *ORM, cai *CAI) *Machine {
-	return &Machine{ORM: orm, CAI: cai}
+func NewMachine(store Store, nlp IntentClassifier) *Machine {
+	return &Machine{Store: store, NLP: nlp, ProposalTimeout: 10 * time.Minute,
+		RequestTimeout: time.Hour, MaxDistance: 50000, DistanceWeight: 0.2, OfferLifetime: 7 * 24 * time.Hour,
+		ArchiveDelay: 24 * time.Hour, PINCost: bcrypt.DefaultCost, MaxPINFailures: 3, PINLockout: 15 * time.Minute,
+		PriceRadius: 50000, PriceWindow: 30 * 24 * time.Hour, AlertRadius: 10000, AlertInterval: 24 * time.Hour,
+		SearchRadius: 10000, Units: NewUnits(), Currencies: NewCurrencies("XAF"), Now: time.Now}
 }
 
 // Generate creates a response for a new incoming message.
 func (m *Machine) Generate(phone int64, message string) (string, error) {
-	user, err := m.ORM.UserByPhone(phone)
+	user, err := m.Store.UserByPhone(phone)
 	if err != nil {
 		return "", err
 	}
 
 	if user == nil {
-		err = m.ORM.NewUser(phone)
+		err = m.Store.NewUser(phone)
 		return "Hi, here is your Chat4Bread market platform. Who are you?", err
 	} else if user.Action == "onboarding" {
 		return m.Onboarding(user, message)
-	} else {
-		intent, err := m.CAI.Intent(message)
+	} else if user.Action == "confirm_trade" {
+		return m.ConfirmTrade(user, message)
+	} else if user.Action == "confirm_profile" {
+		return m.ConfirmProfile(user, message)
+	} else if user.Action == "confirm_withdrawal" {
+		return m.ConfirmWithdrawal(user, message)
+	} else if user.Action == "" {
+		if accepted, ok := parseAnswer(message); ok {
+			reply, err := m.AnswerRequest(user, accepted)
+			if err != nil || reply != "" {
+				return reply, err
+			}
+		}
+
+		intent, err := m.NLP.Intent(message)
 		if err != nil {
 			return "", err
 		}
 
+		if requiresPIN(intent.Slug) {
+			if user.PIN == nil {
+				return m.RequestPIN(user)
+			} else if reply := m.lockout(user); reply != "" {
+				return reply, nil
+			}
+		}
+
 		switch intent.Slug {
 		case "greetings":
 			if user.Kind != nil && *user.Kind == "farmer" {
@@ -52,7 +121,21 @@ func (m *Machine) Generate(phone int64, message string) (string, error) {
 		case "buy":
 			return m.BuyProduct(user, intent)
 		case "price-question":
-			return m.MarketPrices(intent)
+			return m.MarketPrices(user, intent)
+		case "price-trend":
+			return m.PriceTrend(intent)
+		case "history":
+			return m.TradeHistory(user)
+		case "change_name", "change_location", "become_farmer", "become_consumer", "delete_account":
+			return m.ChangeProfile(user, intent)
+		case "my_offers":
+			return m.MyOffers(user)
+		case "update_offer":
+			return m.UpdateOffer(user, intent)
+		case "withdraw_offer":
+			return m.WithdrawOffer(user, intent)
+		case "subscribe_farmers", "unsubscribe_farmers":
+			return m.FarmerAlerts(user, intent.Slug == "subscribe_farmers")
 		default:
 			return fmt.Sprintf("Hey %s, we think you want to do %s, but this is not yet available.", *user.Name, intent.Slug), nil
 		}
@@ -64,7 +147,11 @@ func (m *Machine) Generate(phone int64, message string) (string, error) {
 
 // Onboarding handles the initialization workflow of a new user.
 func (m *Machine) Onboarding(user *User, message string) (string, error) {
-	intent, err := m.CAI.Intent(message)
+	if len(user.Reqs) > 0 && user.Reqs[0] == "pin" {
+		return m.ChoosePIN(user, message)
+	}
+
+	intent, err := m.NLP.Intent(message)
 	if err != nil {
 		return "", err
 	}
@@ -75,11 +162,11 @@ func (m *Machine) Onboarding(user *User, message string) (string, error) {
 			if intent.Slug != "get_name" || intent.FullName == "" {
 				return "We didn't understand you. What is your name?", nil
 			}
-			err = m.ORM.SetUserName(user, intent.FullName)
+			err = m.Store.SetUserName(user, intent.FullName)
 			if err != nil {
 				return "", err
 			}
-			err = m.ORM.PopRequirement(user)
+			err = m.Store.PopRequirement(user)
 			if err != nil {
 				return "", err
 			}
@@ -88,30 +175,30 @@ func (m *Machine) Onboarding(user *User, message string) (string, error) {
 			if intent.Slug != "get_location" || intent.Lat == 0.0 || intent.Lng == 0.0 {
 				return "We didn't understand you. What is your address?", nil
 			}
-			err = m.ORM.SetUserLocation(user, intent.Lat, intent.Lng)
+			err = m.Store.SetUserLocation(user, intent.Lat, intent.Lng)
 			if err != nil {
 				return "", err
 			}
-			err = m.ORM.PopRequirement(user)
+			err = m.Store.PopRequirement(user)
 			if err != nil {
 				return "", err
 			}
-			return "Great to have you here. Are you a farmer or a consumer?", nil
+			return "Great to have you here. " + onboardingQuestion(user.Reqs[1:]), nil
 		case "type":
 			if intent.Slug != "get_type_buyer" && intent.Slug != "get_type_farmer" {
 				return "We didn't understand you. Are you a farmer or a customer?", nil
 			}
 
 			if intent.Slug == "get_type_buyer" {
-				err = m.ORM.SetUserKind(user, "consumer")
+				err = m.Store.SetUserKind(user, "consumer")
 			} else {
-				err = m.ORM.SetUserKind(user, "farmer")
+				err = m.Store.SetUserKind(user, "farmer")
 			}
 			if err != nil {
 				return "", err
 			}
 
-			err = m.ORM.ResetUserState(user)
+			err = m.Store.ResetUserState(user)
 			if err != nil {
 				return "", err
 			}
@@ -119,153 +206,1602 @@ func (m *Machine) Onboarding(user *User, message string) (string, error) {
 			if intent.Slug == "get_type_buyer" {
 				return "Welcome to the market. You can now look for organic food or find a" +
 					" local farmer.", nil
-			} else {
-				return "Welcome to the market. You can now sell and buy products or learn about" +
-					" the current market prices for your goods.", nil
 			}
+			err = m.alertSubscribers(user)
+			if err != nil {
+				return "", err
+			}
+			return "Welcome to the market. You can now sell and buy products or learn about" +
+				" the current market prices for your goods.", nil
 		default:
 			return fmt.Sprintf("We think you want to do %s, but please register first.", user.Reqs[0]), nil
 		}
 	}
 
-	err = m.ORM.ResetUserState(user)
+	err = m.Store.ResetUserState(user)
 	if err != nil {
 		return "", err
 	}
 	return "Welcome to the market. Have fun!", nil
 }
 
+// onboardingQuestion returns the question for the next requirement of the onboarding after the
+// location. Users who started the onboarding before PINs were introduced are asked for their type.
+func onboardingQuestion(reqs []string) string {
+	if len(reqs) > 0 && reqs[0] == "pin" {
+		return "Please choose a PIN of 4 to 6 digits. You will need it to confirm purchases and account changes."
+	}
+	return "Are you a farmer or a consumer?"
+}
+
+// ChoosePIN stores the hash of a new PIN of the user. The message is not passed to the intent
+// classifier, as it should not leave the backend.
+func (m *Machine) ChoosePIN(user *User, message string) (string, error) {
+	pin, ok := parsePIN(message)
+	if !ok {
+		return "Please choose a PIN of 4 to 6 digits, e.g. 4821.", nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(pin), m.PINCost)
+	if err != nil {
+		return "", err
+	}
+	err = m.Store.SetUserPIN(user, string(hash))
+	if err != nil {
+		return "", err
+	}
+
+	if len(user.Reqs) > 1 {
+		err = m.Store.PopRequirement(user)
+		if err != nil {
+			return "", err
+		}
+		return "Thank you, please keep your PIN secret. Are you a farmer or a consumer?", nil
+	}
+	err = m.Store.ResetUserState(user)
+	if err != nil {
+		return "", err
+	}
+	return "Thank you, please keep your PIN secret. You can now send your request again.", nil
+}
+
+// RequestPIN asks a user who registered before PINs were introduced to choose one.
+func (m *Machine) RequestPIN(user *User) (string, error) {
+	err := m.Store.SetUserState(user, "onboarding", []string{"pin"})
+	if err != nil {
+		return "", err
+	}
+	return "Please choose a PIN of 4 to 6 digits first. You will need it to confirm purchases and" +
+		" account changes.", nil
+}
+
+// checkPIN verifies the PIN a user answered with. It returns an empty reply if the PIN is correct
+// and otherwise explains the problem.
+func (m *Machine) checkPIN(user *User, message string) (string, error) {
+	if reply := m.lockout(user); reply != "" {
+		return reply, nil
+	}
+	pin, ok := parsePIN(message)
+	if !ok {
+		return "Please answer with your PIN to confirm or no to cancel.", nil
+	}
+
+	if user.PIN != nil && bcrypt.CompareHashAndPassword([]byte(*user.PIN), []byte(pin)) == nil {
+		if user.PINFailures == 0 {
+			return "", nil
+		}
+		user.PINFailures = 0
+		return "", m.Store.SetPINFailures(user, 0, time.Time{})
+	}
+
+	user.PINFailures++
+	if user.PINFailures >= m.MaxPINFailures {
+		user.PINFailures = 0
+		user.LockedUntil = m.Now().Add(m.PINLockout)
+	}
+	err := m.Store.SetPINFailures(user, user.PINFailures, user.LockedUntil)
+	if err != nil {
+		return "", err
+	}
+	if reply := m.lockout(user); reply != "" {
+		return reply, nil
+	} else if left := m.MaxPINFailures - user.PINFailures; left > 1 {
+		return fmt.Sprintf("Wrong PIN. You have %d more attempts.", left), nil
+	}
+	return "Wrong PIN. You have 1 more attempt.", nil
+}
+
+// lockout returns a reply if the user is locked out because of too many wrong PINs.
+func (m *Machine) lockout(user *User) string {
+	if !m.locked(user) {
+		return ""
+	}
+	minutes := math.Ceil(user.LockedUntil.Sub(m.Now()).Minutes())
+	return fmt.Sprintf("Your account is locked because of too many wrong PINs. Please try again in %.0f minutes.", minutes)
+}
+
+// locked returns whether the user is locked out because of too many wrong PINs.
+func (m *Machine) locked(user *User) bool {
+	return user.LockedUntil.After(m.Now())
+}
+
+// ChangeProfile asks the user to confirm a change of the name, location or type of the account or
+// its deletion. The change is stored as requirements of the confirm_profile action.
+func (m *Machine) ChangeProfile(user *User, intent *Intent) (string, error) {
+	var reqs []string
+	var msg string
+	switch intent.Slug {
+	case "change_name":
+		if intent.FullName == "" {
+			return "Please tell us your new name, e.g. \"change my name to Amina Bello\".", nil
+		}
+		reqs = []string{"name", intent.FullName}
+		msg = fmt.Sprintf("Do you want to change your name from %s to %s?", *user.Name, intent.FullName)
+	case "change_location":
+		if intent.Lat == 0.0 || intent.Lng == 0.0 {
+			return "Please tell us where you live now, e.g. \"I moved to Douala\".", nil
+		}
+		address := intent.Address
+		if address == "" {
+			address = fmt.Sprintf("%.4f, %.4f", intent.Lat, intent.Lng)
+		}
+		reqs = []string{"location", strconv.FormatFloat(intent.Lat, 'f', -1, 64),
+			strconv.FormatFloat(intent.Lng, 'f', -1, 64), address}
+		msg = fmt.Sprintf("Do you want to change your location to %s?", address)
+		if user.Kind != nil && *user.Kind == "farmer" {
+			msg += " Your open offers will move with you."
+		}
+	case "become_farmer", "become_consumer":
+		kind := strings.TrimPrefix(intent.Slug, "become_")
+		if user.Kind != nil && *user.Kind == kind {
+			return fmt.Sprintf("You are already registered as a %s.", kind), nil
+		}
+		reqs = []string{"kind", kind}
+		msg = fmt.Sprintf("Do you want to switch your account to %s?", kind)
+		if kind == "consumer" {
+			msg += " Your open offers will be withdrawn and your pending sales declined."
+		}
+	case "delete_account":
+		reqs = []string{"delete"}
+		msg = "Do you really want to delete your account? Your open offers will be withdrawn and your pending purchase requests cancelled."
+	}
+
+	err := m.Store.SetUserState(user, "confirm_profile", reqs)
+	if err != nil {
+		return "", err
+	}
+	return msg + " Please answer with your PIN to confirm or no to cancel.", nil
+}
+
+// ConfirmProfile applies or discards the profile change the user was asked to confirm with its PIN.
+func (m *Machine) ConfirmProfile(user *User, message string) (string, error) {
+	if confirmed, ok := parseAnswer(message); ok && !confirmed {
+		return "We did not change your account.", m.Store.ResetUserState(user)
+	}
+	reply, err := m.checkPIN(user, message)
+	if err != nil {
+		return "", err
+	} else if reply != "" && !m.locked(user) {
+		return reply, nil
+	}
+
+	err = m.Store.ResetUserState(user)
+	if err != nil {
+		return "", err
+	}
+	if reply != "" {
+		return reply, nil
+	} else if len(user.Reqs) == 0 {
+		return "We did not understand which change to confirm. Please try again.", nil
+	}
+
+	switch user.Reqs[0] {
+	case "name":
+		if len(user.Reqs) < 2 {
+			break
+		}
+		err = m.Store.SetUserName(user, user.Reqs[1])
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("We changed your name to %s.", user.Reqs[1]), nil
+	case "location":
+		if len(user.Reqs) < 4 {
+			break
+		}
+		lat, errLat := strconv.ParseFloat(user.Reqs[1], 64)
+		lng, errLng := strconv.ParseFloat(user.Reqs[2], 64)
+		if errLat != nil || errLng != nil {
+			break
+		}
+		err = m.Store.SetUserLocation(user, lat, lng)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("We changed your location to %s.", user.Reqs[3]), nil
+	case "kind":
+		if len(user.Reqs) < 2 {
+			break
+		}
+		if user.Reqs[1] == "consumer" {
+			err = m.withdrawOffers(user)
+			if err != nil {
+				return "", err
+			}
+			err = m.declineRequests(user, "stopped selling")
+			if err != nil {
+				return "", err
+			}
+		}
+		err = m.Store.SetUserKind(user, user.Reqs[1])
+		if err != nil {
+			return "", err
+		}
+		if user.Reqs[1] == "farmer" {
+			return fmt.Sprintf("You are now registered as a farmer. You can now sell products, e.g. \"sell 5kg cassava for %s\".",
+				m.Currencies.Example(3)), nil
+		}
+		return "You are now registered as a consumer.", nil
+	case "delete":
+		err = m.DeleteAccount(user)
+		if err != nil {
+			return "", err
+		}
+		return "We deleted your account. Goodbye!", nil
+	}
+
+	return "We did not understand which change to confirm. Please try again.", nil
+}
+
+// DeleteAccount withdraws all offers of the user, cancels its purchase proposals, standing orders
+// and pending purchase requests and removes it. Completed trades are kept for the trading partners.
+func (m *Machine) DeleteAccount(user *User) error {
+	err := m.withdrawOffers(user)
+	if err != nil {
+		return err
+	}
+	err = m.declineRequests(user, "closed the account")
+	if err != nil {
+		return err
+	}
+
+	proposals, err := m.Store.SellerTrades(user.ID, TradeProposed)
+	if err != nil {
+		return err
+	}
+	for index := range proposals {
+		trade := &proposals[index]
+		quantity, buyer, err := m.describeTrade(trade, trade.Buyer)
+		if err != nil {
+			return err
+		}
+		ok, err := m.cancelTrade(trade, TradeProposed, TradeCancelled)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		err = m.SendMessage(buyer.Phone, fmt.Sprintf("%s (%d) closed the account, so your purchase of %s was cancelled.", *user.Name, user.Phone, quantity))
+		if err != nil {
+			return err
+		}
+	}
+
+	proposals, err = m.Store.BuyerTrades(user.ID, TradeProposed)
+	if err != nil {
+		return err
+	}
+	for index := range proposals {
+		_, err = m.cancelTrade(&proposals[index], TradeProposed, TradeCancelled)
+		if err != nil {
+			return err
+		}
+	}
+
+	orders, err := m.Store.BuyerOrders(user.ID)
+	if err != nil {
+		return err
+	}
+	for index := range orders {
+		_, err = m.Store.SetOrderStatus(&orders[index], OrderOpen, OrderCancelled)
+		if err != nil {
+			return err
+		}
+	}
+
+	purchases, err := m.Store.BuyerTrades(user.ID, TradeRequested)
+	if err != nil {
+		return err
+	}
+	for index := range purchases {
+		trade := &purchases[index]
+		quantity, merchant, err := m.describeTrade(trade, trade.Seller)
+		if err != nil {
+			return err
+		}
+		ok, err := m.cancelTrade(trade, TradeRequested, TradeCancelled)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		err = m.SendMessage(merchant.Phone, fmt.Sprintf("%s (%d) closed the account and cancelled the request to buy %s.", *user.Name, user.Phone, quantity))
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.Store.DeleteUser(user)
+}
+
+// declineRequests declines all pending purchase requests to a seller and tells the buyers why.
+func (m *Machine) declineRequests(user *User, reason string) error {
+	requests, err := m.Store.SellerTrades(user.ID, TradeRequested)
+	if err != nil {
+		return err
+	}
+	for index := range requests {
+		trade := &requests[index]
+		quantity, buyer, err := m.describeTrade(trade, trade.Buyer)
+		if err != nil {
+			return err
+		}
+		ok, err := m.cancelTrade(trade, TradeRequested, TradeDeclined)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		err = m.SendMessage(buyer.Phone, fmt.Sprintf("%s (%d) %s, so your request to buy %s was declined.", *user.Name, user.Phone, reason, quantity))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withdrawOffers withdraws all available offers of a user.
+func (m *Machine) withdrawOffers(user *User) error {
+	offers, err := m.Store.SellerOffers(user.ID)
+	if err != nil {
+		return err
+	}
+	for index := range offers {
+		_, err = m.Store.WithdrawOffer(&offers[index])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // FarmersNearby returns a list of farmers near the users location.
 func (m *Machine) FarmersNearby(user *User, intent *Intent) (string, error) {
-	users, err := m.ORM.FindFarmersNear(user.Location.Coords[1],
-		user.Location.Coords[0], 2000)
+	if intent.Product != "" {
+		return m.SellersNearby(user, intent)
+	}
+	users, err := m.Store.FindFarmersNear(user.Location.Coords[1],
+		user.Location.Coords[0], m.SearchRadius)
 	if err != nil {
 		return "", err
 	}
 
 	msg := "We found the following farmers nearby:\n"
 	index := 1
-	for index, farmer := range users {
-		if *farmer.Kind == "farmer" && user.ID != farmer.ID {
+	for _, farmer := range users {
+		if farmer.Kind != nil && *farmer.Kind == "farmer" && user.ID != farmer.ID {
 			msg += fmt.Sprintf("%d. %s (%.2f m)\n", index, *farmer.Name, farmer.Location.Distance)
 			index++
 		}
 	}
 
 	if index == 1 {
-		msg = "We could not find any farmers nearby. In the future we might notify you if something changed, but for now, please check from time to time if something changes."
+		msg = "We could not find any farmers nearby. Send \"notify me about new farmers\" to get a message when a farmer nearby joins."
+	}
+
+	return msg, nil
+}
+
+// SellersNearby lists the farmers within SearchRadius who sell the product of the intent,
+// together with the price and the available quantity of their offers.
+func (m *Machine) SellersNearby(user *User, intent *Intent) (string, error) {
+	product, reply, err := m.product(intent)
+	if err != nil || reply != "" {
+		return reply, err
+	}
+	sellers, err := m.Store.FindSellersNear(product.ID, user.Location.Coords[1], user.Location.Coords[0], m.SearchRadius)
+	if err != nil {
+		return "", err
+	}
+
+	msg := fmt.Sprintf("Farmers selling %s within %s:\n", product.Name, describeDistance(m.SearchRadius))
+	index := 1
+	for _, seller := range sellers {
+		if seller.ID == user.ID {
+			continue
+		}
+		var offers []string
+		for _, offer := range seller.Offers {
+			price := offer.NormalizedPrice * offer.Mass
+			if offer.Units > 0 {
+				price = offer.NormalizedPrice * float64(offer.Units)
+			}
+			offers = append(offers, fmt.Sprintf("%s for %s", m.Units.Format(offer.Mass, offer.Units, product.Name),
+				m.Currencies.Format(price)))
+		}
+		msg += fmt.Sprintf("%d. %s (%d), %s away: %s\n", index, *seller.Name, seller.Phone,
+			describeDistance(seller.Location.Distance), strings.Join(offers, ", "))
+		index++
+	}
+
+	if index == 1 {
+		msg = fmt.Sprintf("We could not find any farmers selling %s within %s. Send e.g. \"buy 5kg %s for %s\" and we will notify you as soon as a farmer offers it.",
+			product.Name, describeDistance(m.SearchRadius), product.Name, m.Currencies.Example(3))
 	}
 
 	return msg, nil
 }
 
+// FarmerAlerts subscribes or unsubscribes the user from messages about new farmers nearby.
+func (m *Machine) FarmerAlerts(user *User, enabled bool) (string, error) {
+	err := m.Store.SetFarmerAlerts(user, enabled)
+	if err != nil {
+		return "", err
+	}
+	if !enabled {
+		return "We will no longer notify you about new farmers nearby.", nil
+	}
+	return fmt.Sprintf("We will notify you when a new farmer joins within %s. Send \"stop farmer alerts\" to unsubscribe.",
+		describeDistance(m.AlertRadius)), nil
+}
+
+// alertSubscribers announces a new farmer to the subscribed users within AlertRadius who did not
+// get an alert during the last AlertInterval.
+func (m *Machine) alertSubscribers(farmer *User) error {
+	if farmer.Location == nil || farmer.Name == nil {
+		return nil
+	}
+	users, err := m.Store.FindFarmersNear(farmer.Location.Coords[1], farmer.Location.Coords[0], m.AlertRadius)
+	if err != nil {
+		return err
+	}
+
+	for index := range users {
+		user := &users[index]
+		if !user.FarmerAlerts || user.ID == farmer.ID {
+			continue
+		}
+		ok, err := m.Store.RecordAlert(user, m.Now(), m.Now().Add(-m.AlertInterval))
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		err = m.SendMessage(user.Phone, fmt.Sprintf("%s, a farmer %s away, just joined the market. Send \"farmers near me\" to see all farmers nearby or \"stop farmer alerts\" to unsubscribe.",
+			*farmer.Name, describeDistance(user.Location.Distance)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // SellProduct returns a workflow to sell a product as a farmer.
 func (m *Machine) SellProduct(user *User, intent *Intent) (string, error) {
 	if user.Kind == nil || *user.Kind != "farmer" {
-		return "You registered as a consumer. It is currently not possible to switch the account type without resetting it.", nil
+		return "You registered as a consumer. Send \"I want to become a farmer\" to sell products.", nil
 	}
 
-	if intent.Product == "" || intent.Dollars == 0.0 || (intent.Mass == 0.0 && intent.Number == 0) {
+	if intent.Product == "" || intent.Price.Amount == 0.0 || (intent.Mass == 0.0 && intent.Number == 0) {
 		return "It seems like you want to sell something, but we either didn't get the product, price or the amount you want to sell. Please retry with all required information.", nil
 	}
+	product, reply, err := m.product(intent)
+	if err != nil || reply != "" {
+		return reply, err
+	}
+	mass, units, reply := m.quantity(intent)
+	if reply != "" {
+		return reply, nil
+	}
+	price, reply := m.price(intent)
+	if reply != "" {
+		return reply, nil
+	}
 
-	product, err := m.ORM.FindOrCreateProduct(intent.Product)
+	var offer *Offer
+	if mass > 0.0 {
+		offer, err = m.Store.CreateMassOffer(user.ID, product.ID, price, mass, m.offerExpiry())
+	} else if units > 0 {
+		offer, err = m.Store.CreateUnitOffer(user.ID, product.ID, price, units, m.offerExpiry())
+	} else {
+		return "Please retry while specifying a mass or unit number greater than zero.", nil
+	}
 	if err != nil {
 		return "", err
 	}
 
-	var msg string
-	if intent.Mass > 0.0 {
-		err = m.ORM.CreateMassOffer(user.ID, product.ID, intent.Dollars, intent.Mass)
-		msg = fmt.Sprintf("We created a new offer. You are selling %dg of %s for %.2f$.", uint(intent.Mass), intent.Product, intent.Dollars)
-	} else if intent.Number > 0 {
-		err = m.ORM.CreateUnitOffer(user.ID, product.ID, intent.Dollars, uint64(intent.Number))
-		msg = fmt.Sprintf("We created a new offer. You are selling %d %s for %.2f$.", uint(intent.Number), intent.Product, intent.Dollars)
-	} else {
-		msg = "Please retry while specifying a mass or unit number greater than zero."
+	err = m.matchOrders(user, offer, product)
+	if err != nil {
+		return "", err
 	}
 
-	return msg, err
+	return fmt.Sprintf("We created a new offer. You are selling %s for %s.",
+		m.Units.Format(mass, units, product.Name), m.Currencies.Format(price)), nil
 }
 
-// BuyProduct returns a workflow to buy a product from a farmer.
-func (m *Machine) BuyProduct(user *User, intent *Intent) (string, error) {
-	if intent.Product == "" || intent.Dollars == 0.0 || (intent.Mass == 0.0 && intent.Number == 0) {
-		return "It seems like you want to buy something. But we need to product, your price and a quantity to match your bid.", nil
+// matchOrders proposes a new offer to the buyers of the standing orders it can fill, oldest first.
+// Buyers in the middle of another action are skipped, their orders stay open, as well as orders
+// of the seller.
+func (m *Machine) matchOrders(seller *User, offer *Offer, product *Product) error {
+	if offer.Location == nil {
+		return nil
 	}
-
-	// For a real implementation, do not create any products based on user input, maintain a list
-	// of supported products somewhere else and care about singular forms.
-	product, err := m.ORM.FindOrCreateProduct(intent.Product)
+	orders, err := m.Store.FindOrders(offer.Product, offer.Units > 0, offer.NormalizedPrice,
+		offer.Location.Coords[1], offer.Location.Coords[0], m.MaxDistance)
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	if intent.Mass > 0.0 {
-		offer, merchant, err := m.ORM.FindMassOffer(product.ID, intent.Dollars, float64(intent.Mass))
+	for index := range orders {
+		order := &orders[index]
+		if order.Buyer == seller.ID || order.Mass > offer.Mass || order.Units > offer.Units {
+			continue
+		}
+		buyer, err := m.Store.UserByID(order.Buyer)
 		if err != nil {
-			return "", err
+			return err
+		}
+		if buyer == nil {
+			_, err = m.Store.SetOrderStatus(order, OrderOpen, OrderCancelled)
+			if err != nil {
+				return err
+			}
+			continue
 		}
-		if offer == nil {
-			return "We are not able to fulfill your request. Please try again later.", nil
+		if buyer.Action != "" {
+			continue
 		}
-
-		err = m.ORM.ReduceMassOffer(offer.ID, intent.Mass)
+		ok, err := m.Store.SetOrderStatus(order, OrderOpen, OrderMatched)
 		if err != nil {
-			return "", err
+			return err
+		}
+		if !ok {
+			continue
 		}
 
-		err = m.SendMessage(merchant.Phone, fmt.Sprintf("%s (%d) bought %.2fg of %s for %.2f$ from you.", *user.Name, user.Phone, intent.Mass, intent.Product, intent.Dollars))
+		trade := &Trade{Buyer: buyer.ID, Product: offer.Product, Offer: offer.ID, Mass: order.Mass,
+			Units: order.Units, Price: order.Price, Status: TradeProposed}
+		reserved, _, err := m.Store.ReserveOffer(trade)
 		if err != nil {
-			return "", err
+			return err
+		}
+		if reserved == nil {
+			_, err = m.Store.SetOrderStatus(order, OrderMatched, OrderOpen)
+			if err != nil {
+				return err
+			}
+			continue
 		}
+		offer.Mass, offer.Units = reserved.Mass, reserved.Units
 
-		return fmt.Sprintf("You bought %.2fg of %s from %s (%d) for %.2f$.", intent.Mass, intent.Product, *merchant.Name, merchant.Phone, intent.Dollars), nil
-	} else if intent.Number > 0 {
-		offer, merchant, err := m.ORM.FindUnitOffer(product.ID, intent.Dollars, uint64(intent.Number))
+		err = m.Store.SetUserState(buyer, "confirm_trade", []string{trade.ID.Hex()})
 		if err != nil {
-			return "", err
+			return err
 		}
-		if offer == nil {
-			return "We are not able to fulfill your bid request. Please try again later.", nil
+		quantity := m.Units.Format(trade.Mass, trade.Units, product.Name)
+		err = m.SendMessage(buyer.Phone, fmt.Sprintf("Good news: %s (%d), %s away, now sells you %s for %s. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.",
+			*seller.Name, seller.Phone, describeDistance(order.Location.Distance), quantity, m.Currencies.Format(trade.Price)))
+		if err != nil {
+			return err
 		}
-
-		err = m.ORM.ReduceUnitOffer(offer.ID, uint64(intent.Number))
+		err = m.SendMessage(seller.Phone, fmt.Sprintf("%s (%d) was looking for %s. We proposed your new offer for %s and will notify you when the purchase is confirmed.",
+			*buyer.Name, buyer.Phone, quantity, m.Currencies.Format(trade.Price)))
 		if err != nil {
-			return "", err
+			return err
 		}
+	}
 
-		err = m.SendMessage(merchant.Phone, fmt.Sprintf("%s (%d) bought %d of %s for %.2f$ from you.", *user.Name, user.Phone, intent.Number, intent.Product, intent.Dollars))
-		if err != nil {
-			return "", err
+	return nil
+}
+
+// product looks up the product of an intent in the catalog and replaces it with its canonical
+// name. If the product is not in the catalog, a reply with similar products is returned instead.
+// Without a catalog, any product is accepted.
+func (m *Machine) product(intent *Intent) (*Product, string, error) {
+	if m.Catalog != nil {
+		name, suggestions := m.Catalog.Lookup(intent.Product)
+		if name == "" {
+			reply := fmt.Sprintf("We do not know the product \"%s\".", intent.Product)
+			if len(suggestions) == 0 {
+				return nil, reply + " Please check the spelling.", nil
+			}
+			return nil, reply + " Did you mean " + describeList(suggestions) + "?", nil
 		}
+		intent.Product = name
+	}
+	product, err := m.Store.FindOrCreateProduct(intent.Product)
+	return product, "", err
+}
 
-		return fmt.Sprintf("You bought %d of %s from %s (%d) for %.2f$.", intent.Number, intent.Product, *merchant.Name, merchant.Phone, intent.Dollars), nil
+// quantity converts the quantity of an intent into grams or pieces of its product. If a measure
+// is not known for the product, a reply explaining the problem is returned instead.
+func (m *Machine) quantity(intent *Intent) (float64, uint64, string) {
+	if intent.Mass > 0.0 || intent.Number == 0 {
+		return intent.Mass, 0, ""
+	} else if intent.Measure == "" {
+		return 0, uint64(intent.Number), ""
 	}
 
-	return "Please rephrase your buy request by specifying a positive unit number or mass.", nil
+	mass, units, ok := m.Units.Convert(intent.Product, float64(intent.Number), intent.Measure)
+	if !ok {
+		return 0, 0, fmt.Sprintf("We do not know how much a %s of %s is. Please tell us the quantity in kg or pieces, e.g. \"5kg\" or \"10 %s\".",
+			intent.Measure, intent.Product, intent.Product)
+	}
+	return mass, units, ""
 }
 
-// MarketPrices returns the market price for a product.
-func (m *Machine) MarketPrices(intent *Intent) (string, error) {
-	if intent.Product == "" {
-		return "Please rephrase your request and indicate which product you are looking for.", nil
+// price converts the price of an intent into the default currency. If there is no exchange rate
+// for its currency, a reply explaining the problem is returned instead.
+func (m *Machine) price(intent *Intent) (float64, string) {
+	price, ok := m.Currencies.Convert(intent.Price)
+	if !ok {
+		return 0, fmt.Sprintf("We do not know the exchange rate of %s. Please tell us the price in %s.",
+			intent.Price.Currency, m.Currencies.Default)
 	}
+	return price, ""
+}
 
-	// For a real implementation, do not create any products based on user input, maintain a list
-	// of supported products somewhere else and care about singular forms.
-	product, err := m.ORM.FindOrCreateProduct(intent.Product)
-	if err != nil {
-		return "", err
+// MyOffers lists the available offers of a farmer with the numbers to refer to them.
+func (m *Machine) MyOffers(user *User) (string, error) {
+	if user.Kind == nil || *user.Kind != "farmer" {
+		return "Only farmers can sell products and manage offers.", nil
 	}
 
-	price, err := m.ORM.GetAveragePrice(product.ID)
+	offers, err := m.Store.SellerOffers(user.ID)
 	if err != nil {
 		return "", err
 	}
-	if price == nil {
-		return "There are currently no offers for this product.", nil
+	if len(offers) == 0 {
+		return "You do not have any open offers.", nil
 	}
 
-	return fmt.Sprintf("The average price per gram/unit is %.2f$.", *price), nil
+	msg := "Your open offers:\n"
+	for index, offer := range offers {
+		product, err := m.Store.ProductByID(offer.Product)
+		if err != nil {
+			return "", err
+		}
+		if product == nil {
+			return "", fmt.Errorf("Offer %s refers to unknown product", offer.ID.Hex())
+		}
+		quantity := m.Units.Format(offer.Mass, offer.Units, product.Name)
+		price := offer.NormalizedPrice * offer.Mass
+		if offer.Units > 0 {
+			price = offer.NormalizedPrice * float64(offer.Units)
+		}
+		msg += fmt.Sprintf("%d. %s for %s", index+1, quantity, m.Currencies.Format(price))
+		if !offer.Expires.IsZero() {
+			msg += fmt.Sprintf(" until %s", offer.Expires.Format("2006-01-02"))
+		}
+		msg += "\n"
+	}
+
+	return msg + fmt.Sprintf("Send e.g. \"change offer 1 to %s\" or \"withdraw offer 1\" to manage them.", m.Currencies.Example(5)), nil
+}
+
+// UpdateOffer changes the price or quantity of an offer referenced by its number in MyOffers. If
+// only the quantity changes, the price per gram or unit is kept.
+func (m *Machine) UpdateOffer(user *User, intent *Intent) (string, error) {
+	offer, product, reply, err := m.offerByReference(user, intent.Reference)
+	if reply != "" || err != nil {
+		return reply, err
+	}
+
+	intent.Product = product.Name
+	newMass, newUnits, reply := m.quantity(intent)
+	if reply != "" {
+		return reply, nil
+	}
+
+	mass, units := offer.Mass, offer.Units
+	quantity := offer.Mass
+	if offer.Units > 0 {
+		quantity = float64(offer.Units)
+		if newMass > 0 {
+			return "This offer is sold by units. Please tell us the new number of units.", nil
+		} else if newUnits > 0 {
+			units = newUnits
+			quantity = float64(units)
+		}
+	} else {
+		if newUnits > 0 {
+			return "This offer is sold by mass. Please tell us the new mass, e.g. \"change offer 1 to 5kg\".", nil
+		} else if newMass > 0 {
+			mass = newMass
+			quantity = mass
+		}
+	}
+	if intent.Price.Amount == 0.0 && mass == offer.Mass && units == offer.Units {
+		return fmt.Sprintf("Please tell us the new price or quantity of your offer, e.g. \"change offer 1 to %s\".",
+			m.Currencies.Example(5)), nil
+	}
+
+	price, reply := m.price(intent)
+	if reply != "" {
+		return reply, nil
+	} else if price == 0.0 {
+		price = offer.NormalizedPrice * quantity
+	}
+	ok, err := m.Store.UpdateOffer(offer, price, mass, units)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "Your offer changed in the meantime. Please check your offers again.", nil
+	}
+
+	return fmt.Sprintf("We changed your offer. You are selling %s for %s.",
+		m.Units.Format(mass, units, product.Name), m.Currencies.Format(price)), nil
+}
+
+// WithdrawOffer asks the farmer to confirm the withdrawal of an offer referenced by its number in
+// MyOffers.
+func (m *Machine) WithdrawOffer(user *User, intent *Intent) (string, error) {
+	offer, product, reply, err := m.offerByReference(user, intent.Reference)
+	if reply != "" || err != nil {
+		return reply, err
+	}
+
+	err = m.Store.SetUserState(user, "confirm_withdrawal", []string{offer.ID.Hex()})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Do you want to withdraw your offer of %s? Please answer with your PIN to confirm or no to cancel.",
+		m.Units.Format(offer.Mass, offer.Units, product.Name)), nil
+}
+
+// ConfirmWithdrawal withdraws the offer the farmer was asked about if it confirms with its PIN.
+func (m *Machine) ConfirmWithdrawal(user *User, message string) (string, error) {
+	if confirmed, ok := parseAnswer(message); ok && !confirmed {
+		return "We did not withdraw your offer.", m.Store.ResetUserState(user)
+	}
+	reply, err := m.checkPIN(user, message)
+	if err != nil {
+		return "", err
+	} else if reply != "" && !m.locked(user) {
+		return reply, nil
+	}
+
+	err = m.Store.ResetUserState(user)
+	if err != nil || reply != "" {
+		return reply, err
+	}
+
+	offers, err := m.Store.SellerOffers(user.ID)
+	if err != nil {
+		return "", err
+	}
+	for index := range offers {
+		offer := &offers[index]
+		if len(user.Reqs) == 0 || offer.ID.Hex() != user.Reqs[0] {
+			continue
+		}
+		product, err := m.Store.ProductByID(offer.Product)
+		if err != nil {
+			return "", err
+		}
+		if product == nil {
+			return "", fmt.Errorf("Offer %s refers to unknown product", offer.ID.Hex())
+		}
+		ok, err := m.Store.WithdrawOffer(offer)
+		if err != nil {
+			return "", err
+		} else if !ok {
+			break
+		}
+		return fmt.Sprintf("We withdrew your offer of %s.", m.Units.Format(offer.Mass, offer.Units, product.Name)), nil
+	}
+	return "Your offer changed in the meantime. Please check your offers again.", nil
+}
+
+// offerByReference looks up an available offer of a farmer by its number in MyOffers. If there is
+// no such offer, a reply explaining the problem is returned instead.
+func (m *Machine) offerByReference(user *User, reference uint) (*Offer, *Product, string, error) {
+	if user.Kind == nil || *user.Kind != "farmer" {
+		return nil, nil, "Only farmers can sell products and manage offers.", nil
+	}
+	if reference == 0 {
+		return nil, nil, "Please tell us the number of your offer, e.g. \"withdraw offer 1\". Send \"my offers\" to list them.", nil
+	}
+
+	offers, err := m.Store.SellerOffers(user.ID)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if int(reference) > len(offers) {
+		return nil, nil, fmt.Sprintf("You do not have an offer number %d. Send \"my offers\" to list them.", reference), nil
+	}
+
+	offer := &offers[reference-1]
+	product, err := m.Store.ProductByID(offer.Product)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if product == nil {
+		return nil, nil, "", fmt.Errorf("Offer %s refers to unknown product", offer.ID.Hex())
+	}
+	return offer, product, "", nil
+}
+
+// offerExpiry returns the expiry date of a new offer, or zero if offers do not expire.
+func (m *Machine) offerExpiry() time.Time {
+	if m.OfferLifetime <= 0 {
+		return time.Time{}
+	}
+	return m.Now().Add(m.OfferLifetime).UTC()
+}
+
+// BuyProduct returns a workflow to buy a product from a farmer.
+func (m *Machine) BuyProduct(user *User, intent *Intent) (string, error) {
+	if intent.Product == "" || intent.Price.Amount == 0.0 || (intent.Mass == 0.0 && intent.Number == 0) {
+		return "It seems like you want to buy something. But we need to product, your price and a quantity to match your bid.", nil
+	}
+	product, reply, err := m.product(intent)
+	if err != nil || reply != "" {
+		return reply, err
+	}
+	mass, units, reply := m.quantity(intent)
+	if reply != "" {
+		return reply, nil
+	}
+	price, reply := m.price(intent)
+	if reply != "" {
+		return reply, nil
+	}
+
+	trade := &Trade{Buyer: user.ID, Product: product.ID, Price: price, Status: TradeProposed}
+	if mass > 0.0 {
+		trade.Mass = mass
+	} else if units > 0 {
+		trade.Units = units
+	} else {
+		return "Please rephrase your buy request by specifying a positive unit number or mass.", nil
+	}
+
+	parts, err := m.fillOrder(user, trade)
+	if err != nil {
+		return "", err
+	}
+	if len(parts) == 0 {
+		return m.standingOrder(user, trade, product)
+	}
+
+	ids := make([]string, len(parts))
+	for index, part := range parts {
+		ids[index] = part.Trade.ID.Hex()
+	}
+	err = m.Store.SetUserState(user, "confirm_trade", ids)
+	if err != nil {
+		return "", err
+	}
+
+	if len(parts) == 1 {
+		return fmt.Sprintf("%s (%d), %s away, sells you %s for %s. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.",
+			*parts[0].Seller.Name, parts[0].Seller.Phone, describeDistance(parts[0].Distance),
+			m.Units.Format(parts[0].Trade.Mass, parts[0].Trade.Units, product.Name), m.Currencies.Format(parts[0].Trade.Price)), nil
+	}
+
+	msg := fmt.Sprintf("We found %d sellers for %s:", len(parts), m.Units.Format(trade.Mass, trade.Units, product.Name))
+	total := 0.0
+	for index, part := range parts {
+		msg += fmt.Sprintf("\n%d. %s (%d), %s away, sells you %s for %s.", index+1, *part.Seller.Name,
+			part.Seller.Phone, describeDistance(part.Distance), m.Units.Format(part.Trade.Mass, part.Trade.Units, product.Name),
+			m.Currencies.Format(part.Trade.Price))
+		total += part.Trade.Price
+	}
+	return msg + fmt.Sprintf("\nDo you want to buy it for %s in total? Please answer with your PIN to confirm or no to cancel.", m.Currencies.Format(total)), nil
+}
+
+// standingOrder saves a bid which could not be filled as a standing order, which is matched with
+// new offers until it expires.
+func (m *Machine) standingOrder(user *User, trade *Trade, product *Product) (string, error) {
+	if user.Location == nil {
+		return "We are not able to fulfill your request. Please try again later.", nil
+	}
+	quantity := trade.Mass
+	if trade.Units > 0 {
+		quantity = float64(trade.Units)
+	}
+	order := &Order{Buyer: user.ID, Product: product.ID, Price: trade.Price, NormalizedPrice: trade.Price / quantity,
+		Mass: trade.Mass, Units: trade.Units, Expires: m.offerExpiry(),
+		Location: &GeoJSON{Type: "Point", Coords: []float64{user.Location.Coords[0], user.Location.Coords[1]}}}
+	err := m.Store.CreateOrder(order)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Nobody nearby sells %s for %s right now. We saved your request and will notify you as soon as a farmer offers it.",
+		m.Units.Format(trade.Mass, trade.Units, product.Name), m.Currencies.Format(trade.Price)), nil
+}
+
+// orderPart is the share of an order reserved from a single offer.
+type orderPart struct {
+	Trade    *Trade
+	Seller   *User
+	Distance float64
+}
+
+// fillOrder reserves the ordered quantity from the offers within MaxDistance of the buyer, best
+// ranked first. Each part is priced at the price of its offer, which is not above the bid. If the
+// order cannot be filled completely, all reservations are released and no parts are returned.
+func (m *Machine) fillOrder(user *User, order *Trade) ([]orderPart, error) {
+	if user.Location == nil {
+		return nil, nil
+	}
+
+	quantity := order.Mass
+	if order.Units > 0 {
+		quantity = float64(order.Units)
+	}
+	offers, err := m.Store.FindOffers(order.Product, order.Units > 0, order.Price/quantity,
+		user.Location.Coords[1], user.Location.Coords[0], m.MaxDistance)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(offers, func(i, j int) bool {
+		return m.rankOffer(&offers[i]) < m.rankOffer(&offers[j])
+	})
+
+	var parts []orderPart
+	remaining := quantity
+	for _, offer := range offers {
+		if remaining <= 0 {
+			break
+		}
+
+		trade := &Trade{Buyer: order.Buyer, Product: order.Product, Offer: offer.ID, Status: order.Status}
+		var part float64
+		if order.Units > 0 {
+			part = math.Min(float64(offer.Units), remaining)
+			trade.Units = uint64(part)
+		} else {
+			part = math.Min(offer.Mass, remaining)
+			trade.Mass = part
+		}
+		// The share of the bid limits the price, the reservation prices the part at the offer.
+		trade.Price = order.Price / quantity * part
+
+		// The offer might have been reduced in the meantime, so just continue with the next one.
+		reserved, merchant, err := m.Store.ReserveOffer(trade)
+		if err != nil {
+			m.releaseOrder(parts)
+			return nil, err
+		}
+		if reserved == nil {
+			continue
+		}
+
+		parts = append(parts, orderPart{Trade: trade, Seller: merchant, Distance: offer.Location.Distance})
+		remaining -= part
+	}
+
+	if remaining > 0 {
+		return nil, m.releaseOrder(parts)
+	}
+	return parts, nil
+}
+
+// rankOffer returns the normalized price of an offer with a surcharge of DistanceWeight at
+// MaxDistance, such that cheap offers nearby are preferred.
+func (m *Machine) rankOffer(offer *Offer) float64 {
+	if m.MaxDistance <= 0 {
+		return offer.NormalizedPrice
+	}
+	return offer.NormalizedPrice * (1 + m.DistanceWeight*offer.Location.Distance/m.MaxDistance)
+}
+
+// releaseOrder cancels the proposed trades of an order which could not be filled.
+func (m *Machine) releaseOrder(parts []orderPart) error {
+	for _, part := range parts {
+		_, err := m.cancelTrade(part.Trade, TradeProposed, TradeCancelled)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConfirmTrade executes or cancels the proposed trades of a buyer.
+func (m *Machine) ConfirmTrade(user *User, message string) (string, error) {
+	var trades []*Trade
+	for _, req := range user.Reqs {
+		id, err := primitive.ObjectIDFromHex(req)
+		if err != nil {
+			continue
+		}
+		trade, err := m.Store.TradeByID(id)
+		if err != nil {
+			return "", err
+		}
+		if trade != nil {
+			trades = append(trades, trade)
+		}
+	}
+
+	expired := len(trades) == 0
+	for _, trade := range trades {
+		if trade.Status != TradeProposed || m.Now().Sub(trade.Created) > m.ProposalTimeout {
+			expired = true
+		}
+	}
+	if expired {
+		for _, trade := range trades {
+			_, err := m.cancelTrade(trade, TradeProposed, TradeExpired)
+			if err != nil {
+				return "", err
+			}
+		}
+		err := m.Store.ResetUserState(user)
+		if err != nil {
+			return "", err
+		}
+		return "Your purchase proposal expired. Please send your buy request again.", nil
+	}
+
+	confirmed, ok := parseAnswer(message)
+	reply := ""
+	if !ok || confirmed {
+		var err error
+		reply, err = m.checkPIN(user, message)
+		if err != nil {
+			return "", err
+		} else if reply != "" && !m.locked(user) {
+			return reply, nil
+		}
+	}
+
+	err := m.Store.ResetUserState(user)
+	if err != nil {
+		return "", err
+	}
+
+	if ok && !confirmed || reply != "" {
+		for _, trade := range trades {
+			_, err = m.cancelTrade(trade, TradeProposed, TradeCancelled)
+			if err != nil {
+				return "", err
+			}
+		}
+		if reply != "" {
+			return reply + " We cancelled your purchase.", nil
+		}
+		return "We cancelled your purchase.", nil
+	}
+
+	status := TradeCompleted
+	if m.SellerAcceptance {
+		status = TradeRequested
+	}
+
+	var lines []string
+	for _, trade := range trades {
+		ok, err = m.Store.SetTradeStatus(trade, TradeProposed, status)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			continue
+		}
+
+		quantity, merchant, err := m.describeTrade(trade, trade.Seller)
+		if err != nil {
+			return "", err
+		}
+
+		if m.SellerAcceptance {
+			err = m.SendMessage(merchant.Phone, fmt.Sprintf("%s (%d) wants to buy %s for %s from you. Do you accept? Please answer yes or no.", *user.Name, user.Phone, quantity, m.Currencies.Format(trade.Price)))
+			if len(trades) == 1 {
+				lines = append(lines, fmt.Sprintf("We sent your request to %s (%d). We will notify you as soon as the seller answers.", *merchant.Name, merchant.Phone))
+			} else {
+				lines = append(lines, fmt.Sprintf("%s (%d) for %s", *merchant.Name, merchant.Phone, quantity))
+			}
+		} else {
+			err = m.SendMessage(merchant.Phone, fmt.Sprintf("%s (%d) bought %s for %s from you.", *user.Name, user.Phone, quantity, m.Currencies.Format(trade.Price)))
+			if len(trades) == 1 {
+				lines = append(lines, fmt.Sprintf("You bought %s from %s (%d) for %s.", quantity, *merchant.Name, merchant.Phone, m.Currencies.Format(trade.Price)))
+			} else {
+				lines = append(lines, fmt.Sprintf("%s from %s (%d) for %s", quantity, *merchant.Name, merchant.Phone, m.Currencies.Format(trade.Price)))
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if len(lines) == 0 {
+		return "Your purchase proposal expired. Please send your buy request again.", nil
+	} else if len(trades) == 1 {
+		return lines[0], nil
+	}
+
+	msg := "You bought:"
+	if m.SellerAcceptance {
+		msg = "We sent your requests to:"
+	}
+	for index, line := range lines {
+		msg += fmt.Sprintf("\n%d. %s", index+1, line)
+	}
+	if m.SellerAcceptance {
+		msg += "\nWe will notify you as soon as the sellers answer."
+	}
+	return msg, nil
+}
+
+// AnswerRequest accepts or declines the oldest purchase request of a seller. It returns an empty
+// reply if there is no pending request.
+func (m *Machine) AnswerRequest(user *User, accepted bool) (string, error) {
+	trades, err := m.Store.SellerTrades(user.ID, TradeRequested)
+	if err != nil || len(trades) == 0 {
+		return "", err
+	}
+
+	trade := &trades[0]
+	quantity, buyer, err := m.describeTrade(trade, trade.Buyer)
+	if err != nil {
+		return "", err
+	}
+
+	if m.Now().Sub(trade.Created) > m.RequestTimeout {
+		return "This purchase request expired already.", m.expireRequest(trade)
+	} else if !accepted {
+		ok, err := m.cancelTrade(trade, TradeRequested, TradeDeclined)
+		if err != nil || !ok {
+			return "This purchase request expired already.", err
+		}
+		err = m.SendMessage(buyer.Phone, fmt.Sprintf("%s (%d) declined your request to buy %s.", *user.Name, user.Phone, quantity))
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("You declined the request of %s (%d).", *buyer.Name, buyer.Phone), nil
+	}
+
+	ok, err := m.Store.SetTradeStatus(trade, TradeRequested, TradeCompleted)
+	if err != nil || !ok {
+		return "This purchase request expired already.", err
+	}
+	err = m.SendMessage(buyer.Phone, fmt.Sprintf("%s (%d) accepted your request. You bought %s for %s.", *user.Name, user.Phone, quantity, m.Currencies.Format(trade.Price)))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("You sold %s to %s (%d) for %s.", quantity, *buyer.Name, buyer.Phone, m.Currencies.Format(trade.Price)), nil
+}
+
+// expireRequest cancels a purchase request which the seller did not answer in time and notifies
+// the buyer.
+func (m *Machine) expireRequest(trade *Trade) error {
+	ok, err := m.cancelTrade(trade, TradeRequested, TradeExpired)
+	if err != nil || !ok {
+		return err
+	}
+
+	quantity, merchant, err := m.describeTrade(trade, trade.Seller)
+	if err != nil {
+		return err
+	}
+	buyer, err := m.Store.UserByID(trade.Buyer)
+	if err != nil || buyer == nil {
+		return err
+	}
+	return m.SendMessage(buyer.Phone, fmt.Sprintf("%s (%d) did not answer your request to buy %s in time.", *merchant.Name, merchant.Phone, quantity))
+}
+
+// ExpireProposals cancels all proposed trades which were not confirmed in time and all purchase
+// requests which were not answered in time.
+func (m *Machine) ExpireProposals() error {
+	requests, err := m.Store.StaleTrades(TradeRequested, m.Now().Add(-m.RequestTimeout))
+	if err != nil {
+		return err
+	}
+	for index := range requests {
+		err = m.expireRequest(&requests[index])
+		if err != nil {
+			return err
+		}
+	}
+
+	trades, err := m.Store.StaleTrades(TradeProposed, m.Now().Add(-m.ProposalTimeout))
+	if err != nil {
+		return err
+	}
+
+	for index := range trades {
+		trade := &trades[index]
+		ok, err := m.cancelTrade(trade, TradeProposed, TradeExpired)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		buyer, err := m.Store.UserByID(trade.Buyer)
+		if err != nil {
+			return err
+		}
+		if buyer == nil || buyer.Action != "confirm_trade" || !contains(buyer.Reqs, trade.ID.Hex()) {
+			continue
+		}
+		err = m.Store.ResetUserState(buyer)
+		if err != nil {
+			return err
+		}
+		err = m.SendMessage(buyer.Phone, "Your purchase proposal expired. Please send your buy request again.")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SweepOffers expires all offers whose expiry date passed, notifies their sellers, releases
+// reservations of trades which failed to be recorded and archives offers which were closed for
+// longer than ArchiveDelay.
+func (m *Machine) SweepOffers() error {
+	offers, err := m.Store.ExpireOffers(m.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, offer := range offers {
+		product, err := m.Store.ProductByID(offer.Product)
+		if err != nil {
+			return err
+		}
+		seller, err := m.Store.UserByID(offer.Seller)
+		if err != nil {
+			return err
+		}
+		if product == nil || seller == nil {
+			continue
+		}
+		err = m.SendMessage(seller.Phone, fmt.Sprintf("Your offer of %s expired. Please create a new offer if you still want to sell it.",
+			m.Units.Format(offer.Mass, offer.Units, product.Name)))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = m.Store.RecoverReservations(m.Now().Add(-time.Minute))
+	if err != nil {
+		return err
+	}
+
+	archived, err := m.Store.ArchiveOffers(m.Now().Add(-m.ArchiveDelay))
+	if err != nil {
+		return err
+	}
+	if archived > 0 {
+		log.Printf("Archived %d closed offers.", archived)
+	}
+	return nil
+}
+
+// cancelTrade cancels a pending trade and releases its reservation. It returns false if the
+// trade did not have the expected status anymore.
+func (m *Machine) cancelTrade(trade *Trade, from string, to string) (bool, error) {
+	ok, err := m.Store.SetTradeStatus(trade, from, to)
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, m.Store.ReleaseOffer(trade)
+}
+
+// describeTrade returns the traded quantity of a trade in a human readable form together with
+// the given trading partner.
+func (m *Machine) describeTrade(trade *Trade, partnerID primitive.ObjectID) (string, *User, error) {
+	product, err := m.Store.ProductByID(trade.Product)
+	if err != nil {
+		return "", nil, err
+	}
+	partner, err := m.Store.UserByID(partnerID)
+	if err != nil {
+		return "", nil, err
+	}
+	if product == nil || partner == nil || partner.Name == nil {
+		return "", nil, fmt.Errorf("Trade %s refers to unknown product or user", trade.ID.Hex())
+	}
+
+	return m.Units.Format(trade.Mass, trade.Units, product.Name), partner, nil
+}
+
+// contains returns whether a list of strings contains a value.
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
+
+// describeDistance returns a distance in meters in a human readable form.
+func describeDistance(distance float64) string {
+	if distance < 1000 {
+		return fmt.Sprintf("%.0f m", distance)
+	}
+	return fmt.Sprintf("%.1f km", distance/1000)
+}
+
+// priceMeasure returns the measure in which normalized prices per gram or per piece are quoted
+// and the factor to convert them.
+func priceMeasure(units bool) (string, float64) {
+	if units {
+		return "piece", 1
+	}
+	return "kg", 1000
+}
+
+// describeList joins words to an enumeration, e.g. "cocoa, coffee or cocoyams".
+func describeList(words []string) string {
+	if len(words) < 2 {
+		return strings.Join(words, "")
+	}
+	return strings.Join(words[:len(words)-1], ", ") + " or " + words[len(words)-1]
+}
+
+// describeTrend returns the relative change between two prices, e.g. "up 12%". Without a positive
+// base price there is no relative change.
+func describeTrend(from float64, to float64) string {
+	if from <= 0 {
+		return "no trend"
+	}
+	change := (to - from) / from * 100
+	if math.Abs(change) < 1 {
+		return "stable"
+	} else if change > 0 {
+		return fmt.Sprintf("up %.0f%%", change)
+	}
+	return fmt.Sprintf("down %.0f%%", -change)
+}
+
+// requiresPIN returns whether an intent starts an action which has to be confirmed with a PIN.
+func requiresPIN(slug string) bool {
+	switch slug {
+	case "buy", "get_type_buyer", "withdraw_offer", "change_name", "change_location", "become_farmer",
+		"become_consumer", "delete_account":
+		return true
+	}
+	return false
+}
+
+// parsePIN parses a message consisting of a PIN of 4 to 6 digits.
+func parsePIN(message string) (string, bool) {
+	pin := strings.Join(strings.Fields(message), "")
+	if len(pin) < 4 || len(pin) > 6 {
+		return "", false
+	}
+	for _, digit := range pin {
+		if digit < '0' || digit > '9' {
+			return "", false
+		}
+	}
+	return pin, true
+}
+
+// parseAnswer parses a yes or no answer. The second return value is false if the message is
+// neither.
+func parseAnswer(message string) (bool, bool) {
+	words := strings.FieldsFunc(strings.ToLower(message), isSeparator)
+	if len(words) == 0 {
+		return false, false
+	}
+
+	switch words[0] {
+	case "yes", "y", "yeah", "yep", "ok", "okay", "sure", "confirm", "oui":
+		return true, true
+	case "no", "n", "nope", "cancel", "non":
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+// MarketPrices returns the median, minimum and maximum prices per kg and per piece of a product
+// near the user within the price window. Completed trades are preferred over offers.
+func (m *Machine) MarketPrices(user *User, intent *Intent) (string, error) {
+	if intent.Product == "" {
+		return "Please rephrase your request and indicate which product you are looking for.", nil
+	}
+
+	product, reply, err := m.product(intent)
+	if err != nil || reply != "" {
+		return reply, err
+	}
+
+	query := PriceQuery{Product: product.ID, Since: m.Now().Add(-m.PriceWindow)}
+	if user.Location != nil {
+		query.Lat, query.Lng, query.Radius = user.Location.Coords[1], user.Location.Coords[0], m.PriceRadius
+	}
+	days := int(m.PriceWindow.Hours() / 24)
+	msg := ""
+	for _, units := range []bool{false, true} {
+		query.Units = units
+		stats, source, err := m.priceStats(query)
+		if err != nil {
+			return "", err
+		}
+		if stats == nil {
+			continue
+		}
+		measure, scale := priceMeasure(units)
+		if stats.Count != 1 {
+			source += "s"
+		}
+		msg += fmt.Sprintf("\n- per %s: median %s, min %s, max %s from %d %s", measure,
+			m.Currencies.Format(stats.Median*scale), m.Currencies.Format(stats.Min*scale),
+			m.Currencies.Format(stats.Max*scale), stats.Count, source)
+	}
+	if msg == "" {
+		return fmt.Sprintf("There were no trades or offers of %s within %s in the last %d days.",
+			product.Name, describeDistance(m.PriceRadius), days), nil
+	}
+
+	return fmt.Sprintf("Prices of %s within %s in the last %d days:", product.Name,
+		describeDistance(m.PriceRadius), days) + msg, nil
+}
+
+// PriceTrend returns the latest median prices of a product from the price history and their
+// change over the last week and month.
+func (m *Machine) PriceTrend(intent *Intent) (string, error) {
+	if intent.Product == "" {
+		return "Please rephrase your request and indicate which product you are looking for.", nil
+	}
+
+	product, reply, err := m.product(intent)
+	if err != nil || reply != "" {
+		return reply, err
+	}
+
+	today := m.Now().UTC().Truncate(24 * time.Hour)
+	msg := ""
+	for _, units := range []bool{false, true} {
+		history, err := m.Store.PriceHistory(product.ID, units, today.AddDate(0, 0, -30))
+		if err != nil {
+			return "", err
+		}
+		if len(history) < 2 {
+			continue
+		}
+
+		latest := history[len(history)-1]
+		var changes []string
+		for _, period := range []struct {
+			Name string
+			Days int
+		}{{"week", 7}, {"month", 30}} {
+			// Compare with the oldest snapshot within the period.
+			since := latest.Day.AddDate(0, 0, -period.Days)
+			for _, snapshot := range history {
+				if snapshot.Day.Before(since) {
+					continue
+				}
+				if snapshot.Day.Before(latest.Day) {
+					changes = append(changes, describeTrend(snapshot.Median, latest.Median)+" over the last "+period.Name)
+				}
+				break
+			}
+		}
+		measure, scale := priceMeasure(units)
+		msg += fmt.Sprintf("\n- per %s: %s, %s", measure, m.Currencies.Format(latest.Median*scale),
+			strings.Join(changes, " and "))
+	}
+	if msg == "" {
+		return fmt.Sprintf("We do not have enough price history of %s yet. Please ask again in a few days.", product.Name), nil
+	}
+
+	return fmt.Sprintf("Price trend of %s:", product.Name) + msg, nil
+}
+
+// SnapshotPrices records the market prices of all products in the price history once per day.
+// The prices are taken from the completed trades of the last 24 hours, or from the available
+// offers if there were no trades.
+func (m *Machine) SnapshotPrices() error {
+	day := m.Now().UTC().Truncate(24 * time.Hour)
+	if !day.After(m.snapshotDay) {
+		return nil
+	}
+
+	products, err := m.Store.Products()
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, product := range products {
+		for _, units := range []bool{false, true} {
+			query := PriceQuery{Product: product.ID, Units: units, Since: m.Now().Add(-24 * time.Hour)}
+			source := "trades"
+			prices, err := m.Store.TradePrices(query)
+			if err == nil && len(prices) == 0 {
+				query.Since = time.Time{}
+				source = "offers"
+				prices, err = m.Store.OfferPrices(query)
+			}
+			if err != nil {
+				return err
+			}
+			stats := NewPriceStats(prices)
+			if stats == nil {
+				continue
+			}
+			err = m.Store.SavePriceSnapshot(&PriceSnapshot{Product: product.ID, Day: day, Units: units,
+				Source: source, PriceStats: *stats})
+			if err != nil {
+				return err
+			}
+			count++
+		}
+	}
+
+	m.snapshotDay = day
+	log.Printf("Recorded %d prices in the price history.", count)
+	return nil
+}
+
+// priceStats returns the price statistics of the completed trades matching a query, or of the
+// offers if there were no trades. It also returns the source of the prices.
+func (m *Machine) priceStats(query PriceQuery) (*PriceStats, string, error) {
+	prices, err := m.Store.TradePrices(query)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(prices) > 0 {
+		return NewPriceStats(prices), "trade", nil
+	}
+	prices, err = m.Store.OfferPrices(query)
+	if err != nil {
+		return nil, "", err
+	}
+	return NewPriceStats(prices), "offer", nil
+}
+
+// TradeHistory returns the latest trades of the user.
+func (m *Machine) TradeHistory(user *User) (string, error) {
+	trades, err := m.Store.TradesByUser(user.ID, TradeCompleted, 10)
+	if err != nil {
+		return "", err
+	}
+	msg := "Your latest trades:\n"
+	count := 0
+	for _, trade := range trades {
+		product, err := m.Store.ProductByID(trade.Product)
+		if err != nil {
+			return "", err
+		}
+		action, preposition, partnerID := "bought", "from", trade.Seller
+		if trade.Seller == user.ID {
+			action, preposition, partnerID = "sold", "to", trade.Buyer
+		}
+		partner, err := m.Store.UserByID(partnerID)
+		if err != nil {
+			return "", err
+		}
+		if product == nil || partner == nil || partner.Name == nil {
+			continue
+		}
+
+		count++
+		msg += fmt.Sprintf("%d. %s: %s %s %s %s (%d) for %s\n", count,
+			trade.Created.Format("2006-01-02"), action, m.Units.Format(trade.Mass, trade.Units, product.Name),
+			preposition, *partner.Name, partner.Phone, m.Currencies.Format(trade.Price))
+	}
+
+	if count == 0 {
+		return "You did not buy or sell anything yet.", nil
+	}
+
+	return msg, nil
 }
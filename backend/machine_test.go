@@ -0,0 +1,867 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sent is a message which the Machine pushed to a user.
+type sent struct {
+	To   int64
+	Text string
+}
+
+// step is a single inbound message of a scripted dialogue together with the stubbed intent of
+// the message, the expected reply and the messages expected to be pushed to other users. Steps
+// without a phone advance the clock of the Machine by the duration in Text instead.
+type step struct {
+	Phone  int64
+	Text   string
+	Intent *Intent
+	Reply  string
+	Sent   []sent
+}
+
+// wait returns a step advancing the clock of the Machine.
+func wait(duration time.Duration) step {
+	return step{Text: duration.String()}
+}
+
+// scriptedClassifier returns the stubbed intent of the current step.
+type scriptedClassifier struct {
+	next *Intent
+}
+
+// Intent returns the stubbed intent.
+func (sc *scriptedClassifier) Intent(message string) (*Intent, error) {
+	if sc.next == nil {
+		return nil, errors.New("No intent")
+	}
+	intent := *sc.next
+	return &intent, nil
+}
+
+// runDialogue plays a scripted dialogue against a Machine with an in-memory store. The options
+// configure the Machine before the dialogue starts.
+func runDialogue(t *testing.T, steps []step, options ...func(m *Machine)) {
+	t.Helper()
+	nlp := &scriptedClassifier{}
+	machine := NewMachine(NewMemoryStore(), nlp)
+	machine.PINCost = bcrypt.MinCost
+	// Most dialogues quote their prices in dollars.
+	machine.Currencies = NewCurrencies("USD")
+	catalog, err := LoadCatalog("products.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine.Catalog = catalog
+	for _, option := range options {
+		option(machine)
+	}
+	now := time.Now()
+	machine.Now = func() time.Time { return now }
+	var outbox []sent
+	machine.SendMessage = func(id int64, message string) error {
+		outbox = append(outbox, sent{To: id, Text: message})
+		return nil
+	}
+
+	for index, step := range steps {
+		if step.Phone == 0 {
+			duration, err := time.ParseDuration(step.Text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			now = now.Add(duration)
+			continue
+		}
+
+		nlp.next = step.Intent
+		outbox = nil
+		reply, err := machine.Generate(step.Phone, step.Text)
+		if err != nil {
+			t.Fatalf("step %d (%d: %q): unexpected error %s", index+1, step.Phone, step.Text, err)
+		}
+		if reply != step.Reply {
+			t.Fatalf("step %d (%d: %q): expected reply\n\t%q\ngot\n\t%q", index+1, step.Phone,
+				step.Text, step.Reply, reply)
+		}
+		if fmt.Sprint(outbox) != fmt.Sprint(step.Sent) {
+			t.Fatalf("step %d (%d: %q): expected sent messages\n\t%v\ngot\n\t%v", index+1,
+				step.Phone, step.Text, step.Sent, outbox)
+		}
+	}
+}
+
+// onboard returns the steps of a successful onboarding.
+func onboard(phone int64, name string, lat float64, lng float64, kind string) []step {
+	welcome := "Welcome to the market. You can now sell and buy products or learn about the current market prices for your goods."
+	if kind == "get_type_buyer" {
+		welcome = "Welcome to the market. You can now look for organic food or find a local farmer."
+	}
+	return []step{
+		{phone, "Hello", nil, "Hi, here is your Chat4Bread market platform. Who are you?", nil},
+		{phone, "I am " + name, &Intent{Slug: "get_name", FullName: name},
+			fmt.Sprintf("Hi %s, where do you live?", name), nil},
+		{phone, "I live here", &Intent{Slug: "get_location", Lat: lat, Lng: lng}, choosePIN, nil},
+		{phone, "1234", nil, "Thank you, please keep your PIN secret. Are you a farmer or a consumer?", nil},
+		{phone, kind, &Intent{Slug: kind}, welcome, nil},
+	}
+}
+
+// alerted returns the steps of an onboarding which pushes messages to other users.
+func alerted(steps []step, messages ...sent) []step {
+	steps[len(steps)-1].Sent = messages
+	return steps
+}
+
+// dialogue concatenates the steps of several dialogue parts.
+func dialogue(parts ...[]step) []step {
+	var steps []step
+	for _, part := range parts {
+		steps = append(steps, part...)
+	}
+	return steps
+}
+
+var (
+	today    = time.Now().UTC().Format("2006-01-02")
+	nextWeek = time.Now().UTC().Add(7 * 24 * time.Hour).Format("2006-01-02")
+)
+
+const choosePIN = "Great to have you here. Please choose a PIN of 4 to 6 digits. You will need it to" +
+	" confirm purchases and account changes."
+
+const (
+	farmer   = 237600000001
+	neighbor = 237600000002
+	consumer = 237600000003
+	remote   = 237600000004
+)
+
+var dialogues = map[string][]step{
+	"Onboarding": {
+		{consumer, "Hi", nil, "Hi, here is your Chat4Bread market platform. Who are you?", nil},
+		{consumer, "Hello", &Intent{Slug: "greetings"}, "We didn't understand you. What is your name?", nil},
+		{consumer, "Paul", &Intent{Slug: "get_name", FullName: "Paul"}, "Hi Paul, where do you live?", nil},
+		{consumer, "Somewhere", &Intent{Slug: "get_location"}, "We didn't understand you. What is your address?", nil},
+		{consumer, "Yaoundé", &Intent{Slug: "get_location", Lat: 3.848, Lng: 11.5021}, choosePIN, nil},
+		{consumer, "12", nil, "Please choose a PIN of 4 to 6 digits, e.g. 4821.", nil},
+		{consumer, "1234", nil, "Thank you, please keep your PIN secret. Are you a farmer or a consumer?", nil},
+		{consumer, "Dunno", &Intent{Slug: "greetings"}, "We didn't understand you. Are you a farmer or a customer?", nil},
+		{consumer, "Consumer", &Intent{Slug: "get_type_buyer"},
+			"Welcome to the market. You can now look for organic food or find a local farmer.", nil},
+		{consumer, "Hi", &Intent{Slug: "greetings"},
+			"Hi, this is your Chat4Bread market platform. You can buy goods, lookup prices and find farmers.", nil},
+	},
+	"Sell": dialogue(onboard(farmer, "Amina", 3.848, 11.5021, "get_type_farmer"), []step{
+		{farmer, "Hi", &Intent{Slug: "greetings"},
+			"Hi, this is your Chat4Bread market platform. You can buy/sell goods, lookup prices and find other farmers.", nil},
+		{farmer, "sell cassava", &Intent{Slug: "sell", Product: "cassava"},
+			"It seems like you want to sell something, but we either didn't get the product, price or the amount you want to sell. Please retry with all required information.", nil},
+		{farmer, "sell 5kg cassava for 3$", &Intent{Slug: "sell", Product: "cassava", Mass: 5000, Price: Money{3, "USD"}},
+			"We created a new offer. You are selling 5 kg of cassava for 3.00$.", nil},
+		{farmer, "sell 10 plantains for 4$", &Intent{Slug: "sell", Product: "plantains", Number: 10, Price: Money{4, "USD"}},
+			"We created a new offer. You are selling 10 plantains for 4.00$.", nil},
+	}),
+	"SellAsConsumer": dialogue(onboard(consumer, "Paul", 3.848, 11.5021, "get_type_buyer"), []step{
+		{consumer, "sell 5kg cassava for 3$", &Intent{Slug: "sell", Product: "cassava", Mass: 5000, Price: Money{3, "USD"}},
+			"You registered as a consumer. Send \"I want to become a farmer\" to sell products.", nil},
+	}),
+	"Buy": dialogue(onboard(farmer, "Amina", 3.848, 11.5021, "get_type_farmer"),
+		onboard(consumer, "Paul", 3.848, 11.5021, "get_type_buyer"), []step{
+			{farmer, "sell 5kg cassava for 3$", &Intent{Slug: "sell", Product: "cassava", Mass: 5000, Price: Money{3, "USD"}},
+				"We created a new offer. You are selling 5 kg of cassava for 3.00$.", nil},
+			{farmer, "sell 10 plantains for 4$", &Intent{Slug: "sell", Product: "plantains", Number: 10, Price: Money{4, "USD"}},
+				"We created a new offer. You are selling 10 plantains for 4.00$.", nil},
+			{consumer, "buy cassava", &Intent{Slug: "buy", Product: "cassava"},
+				"It seems like you want to buy something. But we need to product, your price and a quantity to match your bid.", nil},
+			{consumer, "buy 2kg cassava for 1$", &Intent{Slug: "buy", Product: "cassava", Mass: 2000, Price: Money{1, "USD"}},
+				"Nobody nearby sells 2 kg of cassava for 1.00$ right now. We saved your request and will notify you as soon as a farmer offers it.", nil},
+			{consumer, "buy 2kg cassava for 2$", &Intent{Slug: "buy", Product: "cassava", Mass: 2000, Price: Money{2, "USD"}},
+				"Amina (237600000001), 0 m away, sells you 2 kg of cassava for 1.20$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "maybe", nil, "Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "Yes!", nil, "Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "1234", nil, "You bought 2 kg of cassava from Amina (237600000001) for 1.20$.",
+				[]sent{{farmer, "Paul (237600000003) bought 2 kg of cassava for 1.20$ from you."}}},
+			{consumer, "buy 4kg cassava for 10$", &Intent{Slug: "buy", Product: "cassava", Mass: 4000, Price: Money{10, "USD"}},
+				"Nobody nearby sells 4 kg of cassava for 10.00$ right now. We saved your request and will notify you as soon as a farmer offers it.", nil},
+			{consumer, "buy 4 plantains for 2$", &Intent{Slug: "buy", Product: "plantains", Number: 4, Price: Money{2, "USD"}},
+				"Amina (237600000001), 0 m away, sells you 4 plantains for 1.60$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "12 34", nil, "You bought 4 plantains from Amina (237600000001) for 1.60$.",
+				[]sent{{farmer, "Paul (237600000003) bought 4 plantains for 1.60$ from you."}}},
+			{consumer, "buy 8 plantains for 8$", &Intent{Slug: "buy", Product: "plantains", Number: 8, Price: Money{8, "USD"}},
+				"Nobody nearby sells 8 plantains for 8.00$ right now. We saved your request and will notify you as soon as a farmer offers it.", nil},
+			{consumer, "buy 6 plantains for 6$", &Intent{Slug: "buy", Product: "plantains", Number: 6, Price: Money{6, "USD"}},
+				"Amina (237600000001), 0 m away, sells you 6 plantains for 2.40$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "buy 1 plantain for 1$", &Intent{Slug: "buy", Product: "plantains", Number: 1, Price: Money{1, "USD"}},
+				"Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "No", nil, "We cancelled your purchase.", nil},
+			{consumer, "buy 6 plantains for 6$", &Intent{Slug: "buy", Product: "plantains", Number: 6, Price: Money{6, "USD"}},
+				"Amina (237600000001), 0 m away, sells you 6 plantains for 2.40$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+			wait(11 * time.Minute),
+			{consumer, "1234", nil, "Your purchase proposal expired. Please send your buy request again.", nil},
+			{consumer, "buy 6 plantains for 6$", &Intent{Slug: "buy", Product: "plantains", Number: 6, Price: Money{6, "USD"}},
+				"Amina (237600000001), 0 m away, sells you 6 plantains for 2.40$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+		}),
+	"MultiVendorBuy": dialogue(onboard(farmer, "Amina", 3.848, 11.5021, "get_type_farmer"),
+		onboard(neighbor, "Jean", 3.857, 11.5021, "get_type_farmer"),
+		onboard(remote, "Ngozi", 4.0511, 9.7679, "get_type_farmer"),
+		onboard(consumer, "Paul", 3.848, 11.5021, "get_type_buyer"), []step{
+			{farmer, "sell 5kg cassava for 5$", &Intent{Slug: "sell", Product: "cassava", Mass: 5000, Price: Money{5, "USD"}},
+				"We created a new offer. You are selling 5 kg of cassava for 5.00$.", nil},
+			{neighbor, "sell 5kg cassava for 3$", &Intent{Slug: "sell", Product: "cassava", Mass: 5000, Price: Money{3, "USD"}},
+				"We created a new offer. You are selling 5 kg of cassava for 3.00$.", nil},
+			{remote, "sell 10kg cassava for 1$", &Intent{Slug: "sell", Product: "cassava", Mass: 10000, Price: Money{1, "USD"}},
+				"We created a new offer. You are selling 10 kg of cassava for 1.00$.", nil},
+			{consumer, "buy 11kg cassava for 11$", &Intent{Slug: "buy", Product: "cassava", Mass: 11000, Price: Money{11, "USD"}},
+				"Nobody nearby sells 11 kg of cassava for 11.00$ right now. We saved your request and will notify you as soon as a farmer offers it.", nil},
+			{consumer, "buy 8kg cassava for 8$", &Intent{Slug: "buy", Product: "cassava", Mass: 8000, Price: Money{8, "USD"}},
+				"We found 2 sellers for 8 kg of cassava:\n" +
+					"1. Jean (237600000002), 1.0 km away, sells you 5 kg of cassava for 3.00$.\n" +
+					"2. Amina (237600000001), 0 m away, sells you 3 kg of cassava for 3.00$.\n" +
+					"Do you want to buy it for 6.00$ in total? Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "1234", nil, "You bought:\n" +
+				"1. 5 kg of cassava from Jean (237600000002) for 3.00$\n" +
+				"2. 3 kg of cassava from Amina (237600000001) for 3.00$", []sent{
+				{neighbor, "Paul (237600000003) bought 5 kg of cassava for 3.00$ from you."},
+				{farmer, "Paul (237600000003) bought 3 kg of cassava for 3.00$ from you."}}},
+			{consumer, "buy 3kg cassava for 3$", &Intent{Slug: "buy", Product: "cassava", Mass: 3000, Price: Money{3, "USD"}},
+				"Nobody nearby sells 3 kg of cassava for 3.00$ right now. We saved your request and will notify you as soon as a farmer offers it.", nil},
+			{consumer, "buy 2kg cassava for 2$", &Intent{Slug: "buy", Product: "cassava", Mass: 2000, Price: Money{2, "USD"}},
+				"Amina (237600000001), 0 m away, sells you 2 kg of cassava for 2.00$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+		}),
+	"NearbyOffersFirst": dialogue(onboard(farmer, "Amina", 3.848, 11.5021, "get_type_farmer"),
+		onboard(neighbor, "Jean", 4.208, 11.5021, "get_type_farmer"),
+		onboard(consumer, "Paul", 3.848, 11.5021, "get_type_buyer"), []step{
+			{neighbor, "sell 5kg cassava for 4.75$", &Intent{Slug: "sell", Product: "cassava", Mass: 5000, Price: Money{4.75, "USD"}},
+				"We created a new offer. You are selling 5 kg of cassava for 4.75$.", nil},
+			{farmer, "sell 5kg cassava for 5$", &Intent{Slug: "sell", Product: "cassava", Mass: 5000, Price: Money{5, "USD"}},
+				"We created a new offer. You are selling 5 kg of cassava for 5.00$.", nil},
+			{consumer, "buy 5kg cassava for 5$", &Intent{Slug: "buy", Product: "cassava", Mass: 5000, Price: Money{5, "USD"}},
+				"Amina (237600000001), 0 m away, sells you 5 kg of cassava for 5.00$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "1234", nil, "You bought 5 kg of cassava from Amina (237600000001) for 5.00$.",
+				[]sent{{farmer, "Paul (237600000003) bought 5 kg of cassava for 5.00$ from you."}}},
+			{consumer, "buy 5kg cassava for 5$", &Intent{Slug: "buy", Product: "cassava", Mass: 5000, Price: Money{5, "USD"}},
+				"Jean (237600000002), 40.1 km away, sells you 5 kg of cassava for 4.75$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+		}),
+	"ManageOffers": dialogue(onboard(farmer, "Amina", 3.848, 11.5021, "get_type_farmer"),
+		onboard(consumer, "Paul", 3.848, 11.5021, "get_type_buyer"), []step{
+			{farmer, "my offers", &Intent{Slug: "my_offers"}, "You do not have any open offers.", nil},
+			{farmer, "sell 5kg cassava for 3$", &Intent{Slug: "sell", Product: "cassava", Mass: 5000, Price: Money{3, "USD"}},
+				"We created a new offer. You are selling 5 kg of cassava for 3.00$.", nil},
+			{farmer, "sell 10 plantains for 4$", &Intent{Slug: "sell", Product: "plantains", Number: 10, Price: Money{4, "USD"}},
+				"We created a new offer. You are selling 10 plantains for 4.00$.", nil},
+			{consumer, "buy 2kg cassava for 2$", &Intent{Slug: "buy", Product: "cassava", Mass: 2000, Price: Money{2, "USD"}},
+				"Amina (237600000001), 0 m away, sells you 2 kg of cassava for 1.20$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "1234", nil, "You bought 2 kg of cassava from Amina (237600000001) for 1.20$.",
+				[]sent{{farmer, "Paul (237600000003) bought 2 kg of cassava for 1.20$ from you."}}},
+			{farmer, "show my offers", &Intent{Slug: "my_offers"}, "Your open offers:\n" +
+				"1. 3 kg of cassava for 1.80$ until " + nextWeek + "\n" +
+				"2. 10 plantains for 4.00$ until " + nextWeek + "\n" +
+				"Send e.g. \"change offer 1 to 5$\" or \"withdraw offer 1\" to manage them.", nil},
+			{farmer, "change offer", &Intent{Slug: "update_offer"},
+				"Please tell us the number of your offer, e.g. \"withdraw offer 1\". Send \"my offers\" to list them.", nil},
+			{farmer, "change offer 3 to 5$", &Intent{Slug: "update_offer", Reference: 3, Price: Money{5, "USD"}},
+				"You do not have an offer number 3. Send \"my offers\" to list them.", nil},
+			{farmer, "change offer 1", &Intent{Slug: "update_offer", Reference: 1},
+				"Please tell us the new price or quantity of your offer, e.g. \"change offer 1 to 5$\".", nil},
+			{farmer, "change offer 1 to 4$", &Intent{Slug: "update_offer", Reference: 1, Price: Money{4, "USD"}},
+				"We changed your offer. You are selling 3 kg of cassava for 4.00$.", nil},
+			{farmer, "change offer 1 to 6 pieces", &Intent{Slug: "update_offer", Reference: 1, Number: 6},
+				"This offer is sold by mass. Please tell us the new mass, e.g. \"change offer 1 to 5kg\".", nil},
+			{farmer, "change offer 2 to 20 plantains", &Intent{Slug: "update_offer", Reference: 2, Number: 20},
+				"We changed your offer. You are selling 20 plantains for 8.00$.", nil},
+			{farmer, "withdraw offer 1", &Intent{Slug: "withdraw_offer", Reference: 1},
+				"Do you want to withdraw your offer of 3 kg of cassava? Please answer with your PIN to confirm or no to cancel.", nil},
+			{farmer, "no", nil, "We did not withdraw your offer.", nil},
+			{farmer, "withdraw offer 1", &Intent{Slug: "withdraw_offer", Reference: 1},
+				"Do you want to withdraw your offer of 3 kg of cassava? Please answer with your PIN to confirm or no to cancel.", nil},
+			{farmer, "1234", nil, "We withdrew your offer of 3 kg of cassava.", nil},
+			{consumer, "buy 2kg cassava for 2$", &Intent{Slug: "buy", Product: "cassava", Mass: 2000, Price: Money{2, "USD"}},
+				"Nobody nearby sells 2 kg of cassava for 2.00$ right now. We saved your request and will notify you as soon as a farmer offers it.", nil},
+			{farmer, "my offers", &Intent{Slug: "my_offers"}, "Your open offers:\n" +
+				"1. 20 plantains for 8.00$ until " + nextWeek + "\n" +
+				"Send e.g. \"change offer 1 to 5$\" or \"withdraw offer 1\" to manage them.", nil},
+			{consumer, "my offers", &Intent{Slug: "my_offers"}, "Only farmers can sell products and manage offers.", nil},
+		}),
+	"ChangeProfile": dialogue(onboard(farmer, "Amina", 3.848, 11.5021, "get_type_farmer"),
+		onboard(consumer, "Paul", 3.848, 11.5021, "get_type_buyer"), []step{
+			{farmer, "change my name", &Intent{Slug: "change_name"},
+				"Please tell us your new name, e.g. \"change my name to Amina Bello\".", nil},
+			{farmer, "change my name to Amina Bello", &Intent{Slug: "change_name", FullName: "Amina Bello"},
+				"Do you want to change your name from Amina to Amina Bello? Please answer with your PIN to confirm or no to cancel.", nil},
+			{farmer, "maybe", nil, "Please answer with your PIN to confirm or no to cancel.", nil},
+			{farmer, "1234", nil, "We changed your name to Amina Bello.", nil},
+			{farmer, "sell 5kg cassava for 3$", &Intent{Slug: "sell", Product: "cassava", Mass: 5000, Price: Money{3, "USD"}},
+				"We created a new offer. You are selling 5 kg of cassava for 3.00$.", nil},
+			{farmer, "I moved to Douala", &Intent{Slug: "change_location", Lat: 4.0511, Lng: 9.7679, Address: "Douala"},
+				"Do you want to change your location to Douala? Your open offers will move with you. Please answer with your PIN to confirm or no to cancel.", nil},
+			{farmer, "no", nil, "We did not change your account.", nil},
+			{consumer, "buy 1kg cassava for 1$", &Intent{Slug: "buy", Product: "cassava", Mass: 1000, Price: Money{1, "USD"}},
+				"Amina Bello (237600000001), 0 m away, sells you 1 kg of cassava for 0.60$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "no", nil, "We cancelled your purchase.", nil},
+			{farmer, "I moved to 3.857, 11.5021", &Intent{Slug: "change_location", Lat: 3.857, Lng: 11.5021},
+				"Do you want to change your location to 3.8570, 11.5021? Your open offers will move with you. Please answer with your PIN to confirm or no to cancel.", nil},
+			{farmer, "1234", nil, "We changed your location to 3.8570, 11.5021.", nil},
+			{consumer, "buy 1kg cassava for 1$", &Intent{Slug: "buy", Product: "cassava", Mass: 1000, Price: Money{1, "USD"}},
+				"Amina Bello (237600000001), 1.0 km away, sells you 1 kg of cassava for 0.60$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "no", nil, "We cancelled your purchase.", nil},
+			{farmer, "I want to become a farmer", &Intent{Slug: "become_farmer"}, "You are already registered as a farmer.", nil},
+			{farmer, "switch to consumer", &Intent{Slug: "become_consumer"},
+				"Do you want to switch your account to consumer? Your open offers will be withdrawn and your pending sales declined. Please answer with your PIN to confirm or no to cancel.", nil},
+			{farmer, "1234", nil, "You are now registered as a consumer.", nil},
+			{consumer, "buy 1kg cassava for 1$", &Intent{Slug: "buy", Product: "cassava", Mass: 1000, Price: Money{1, "USD"}},
+				"Nobody nearby sells 1 kg of cassava for 1.00$ right now. We saved your request and will notify you as soon as a farmer offers it.", nil},
+			{consumer, "I want to become a farmer", &Intent{Slug: "become_farmer"},
+				"Do you want to switch your account to farmer? Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "1234", nil, "You are now registered as a farmer. You can now sell products, e.g. \"sell 5kg cassava for 3$\".", nil},
+			{consumer, "sell 1kg cassava for 1$", &Intent{Slug: "sell", Product: "cassava", Mass: 1000, Price: Money{1, "USD"}},
+				"We created a new offer. You are selling 1 kg of cassava for 1.00$.", nil},
+		}),
+	"Measures": dialogue(onboard(farmer, "Amina", 3.848, 11.5021, "get_type_farmer"),
+		onboard(consumer, "Paul", 3.848, 11.5021, "get_type_buyer"), []step{
+			{farmer, "sell 2 bags of cassava for 40$", &Intent{Slug: "sell", Product: "cassava", Number: 2, Measure: "bag", Price: Money{40, "USD"}},
+				"We created a new offer. You are selling 100 kg of cassava (2 bags) for 40.00$.", nil},
+			{farmer, "sell a bag of yams for 20$", &Intent{Slug: "sell", Product: "yams", Number: 1, Measure: "bag", Price: Money{20, "USD"}},
+				"We do not know how much a bag of yams is. Please tell us the quantity in kg or pieces, e.g. \"5kg\" or \"10 yams\".", nil},
+			{farmer, "sell 2 bunches of plantains for 12$", &Intent{Slug: "sell", Product: "plantains", Number: 2, Measure: "bunch", Price: Money{12, "USD"}},
+				"We created a new offer. You are selling 30 plantains (2 bunches) for 12.00$.", nil},
+			{consumer, "buy a basin of cassava for 8$", &Intent{Slug: "buy", Product: "cassava", Number: 1, Measure: "basin", Price: Money{8, "USD"}},
+				"Amina (237600000001), 0 m away, sells you 20 kg of cassava (1 basin) for 8.00$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "no", nil, "We cancelled your purchase.", nil},
+			{farmer, "change offer 2 to a bunch", &Intent{Slug: "update_offer", Reference: 2, Number: 1, Measure: "bunch"},
+				"We changed your offer. You are selling 15 plantains (1 bunch) for 6.00$.", nil},
+			{farmer, "change offer 1 to 3 bunches", &Intent{Slug: "update_offer", Reference: 1, Number: 3, Measure: "bunch"},
+				"We do not know how much a bunch of cassava is. Please tell us the quantity in kg or pieces, e.g. \"5kg\" or \"10 cassava\".", nil},
+			{farmer, "change offer 1 to 3 bags", &Intent{Slug: "update_offer", Reference: 1, Number: 3, Measure: "bag"},
+				"We changed your offer. You are selling 150 kg of cassava (3 bags) for 60.00$.", nil},
+		}),
+	"ProductCatalog": dialogue(onboard(farmer, "Amina", 3.848, 11.5021, "get_type_farmer"),
+		onboard(consumer, "Paul", 3.848, 11.5021, "get_type_buyer"), []step{
+			{farmer, "sell 5kg manioc for 3$", &Intent{Slug: "sell", Product: "manioc", Mass: 5000, Price: Money{3, "USD"}},
+				"We created a new offer. You are selling 5 kg of cassava for 3.00$.", nil},
+			{farmer, "sell 1kg kasava for 1$", &Intent{Slug: "sell", Product: "kasava", Mass: 1000, Price: Money{1, "USD"}},
+				"We created a new offer. You are selling 1 kg of cassava for 1.00$.", nil},
+			{farmer, "sell 2 plantain for 1$", &Intent{Slug: "sell", Product: "plantain", Number: 2, Price: Money{1, "USD"}},
+				"We created a new offer. You are selling 2 plantains for 1.00$.", nil},
+			{farmer, "sell 2 régimes of plantin for 10$", &Intent{Slug: "sell", Product: "plantin", Number: 2, Measure: "bunch", Price: Money{10, "USD"}},
+				"We created a new offer. You are selling 30 plantains (2 bunches) for 10.00$.", nil},
+			{consumer, "buy 2kg rize for 2$", &Intent{Slug: "buy", Product: "rize", Mass: 2000, Price: Money{2, "USD"}},
+				"We do not know the product \"rize\". Did you mean rice?", nil},
+			{consumer, "buy 2kg fufu for 2$", &Intent{Slug: "buy", Product: "fufu", Mass: 2000, Price: Money{2, "USD"}},
+				"We do not know the product \"fufu\". Please check the spelling.", nil},
+			{consumer, "buy 2kg casava for 2$", &Intent{Slug: "buy", Product: "casava", Mass: 2000, Price: Money{2, "USD"}},
+				"Amina (237600000001), 0 m away, sells you 2 kg of cassava for 1.20$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "no", nil, "We cancelled your purchase.", nil},
+			{farmer, "price of maïs", &Intent{Slug: "price-question", Product: "maïs"},
+				"There were no trades or offers of maize within 50.0 km in the last 30 days.", nil},
+		}),
+	"StandingOrders": dialogue(onboard(farmer, "Amina", 3.848, 11.5021, "get_type_farmer"),
+		onboard(neighbor, "Jean", 3.948, 11.5021, "get_type_farmer"),
+		onboard(consumer, "Paul", 3.848, 11.5021, "get_type_buyer"), []step{
+			{consumer, "buy 2kg cassava for 2$", &Intent{Slug: "buy", Product: "cassava", Mass: 2000, Price: Money{2, "USD"}},
+				"Nobody nearby sells 2 kg of cassava for 2.00$ right now. We saved your request and will notify you as soon as a farmer offers it.", nil},
+			{consumer, "buy 10 plantains for 5$", &Intent{Slug: "buy", Product: "plantains", Number: 10, Price: Money{5, "USD"}},
+				"Nobody nearby sells 10 plantains for 5.00$ right now. We saved your request and will notify you as soon as a farmer offers it.", nil},
+			{farmer, "sell 1kg cassava for 1$", &Intent{Slug: "sell", Product: "cassava", Mass: 1000, Price: Money{1, "USD"}},
+				"We created a new offer. You are selling 1 kg of cassava for 1.00$.", nil},
+			{farmer, "sell 5kg cassava for 10$", &Intent{Slug: "sell", Product: "cassava", Mass: 5000, Price: Money{10, "USD"}},
+				"We created a new offer. You are selling 5 kg of cassava for 10.00$.", nil},
+			{neighbor, "sell 5kg cassava for 4$", &Intent{Slug: "sell", Product: "cassava", Mass: 5000, Price: Money{4, "USD"}},
+				"We created a new offer. You are selling 5 kg of cassava for 4.00$.", []sent{
+					{consumer, "Good news: Jean (237600000002), 11.1 km away, now sells you 2 kg of cassava for 1.60$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel."},
+					{neighbor, "Paul (237600000003) was looking for 2 kg of cassava. We proposed your new offer for 1.60$ and will notify you when the purchase is confirmed."}}},
+			{farmer, "sell 20 plantains for 8$", &Intent{Slug: "sell", Product: "plantains", Number: 20, Price: Money{8, "USD"}},
+				"We created a new offer. You are selling 20 plantains for 8.00$.", nil},
+			{consumer, "1234", nil, "You bought 2 kg of cassava from Jean (237600000002) for 1.60$.",
+				[]sent{{neighbor, "Paul (237600000003) bought 2 kg of cassava for 1.60$ from you."}}},
+			{neighbor, "sell 5kg cassava for 4$", &Intent{Slug: "sell", Product: "cassava", Mass: 5000, Price: Money{4, "USD"}},
+				"We created a new offer. You are selling 5 kg of cassava for 4.00$.", nil},
+			{farmer, "sell 20 plantains for 8$", &Intent{Slug: "sell", Product: "plantains", Number: 20, Price: Money{8, "USD"}},
+				"We created a new offer. You are selling 20 plantains for 8.00$.", []sent{
+					{consumer, "Good news: Amina (237600000001), 0 m away, now sells you 10 plantains for 4.00$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel."},
+					{farmer, "Paul (237600000003) was looking for 10 plantains. We proposed your new offer for 4.00$ and will notify you when the purchase is confirmed."}}},
+			{consumer, "no", nil, "We cancelled your purchase.", nil},
+			{farmer, "sell 20 plantains for 8$", &Intent{Slug: "sell", Product: "plantains", Number: 20, Price: Money{8, "USD"}},
+				"We created a new offer. You are selling 20 plantains for 8.00$.", nil},
+		}),
+	"TradeHistory": dialogue(onboard(farmer, "Amina", 3.848, 11.5021, "get_type_farmer"),
+		onboard(consumer, "Paul", 3.848, 11.5021, "get_type_buyer"), []step{
+			{consumer, "my trades", &Intent{Slug: "history"}, "You did not buy or sell anything yet.", nil},
+			{farmer, "sell 5kg cassava for 3$", &Intent{Slug: "sell", Product: "cassava", Mass: 5000, Price: Money{3, "USD"}},
+				"We created a new offer. You are selling 5 kg of cassava for 3.00$.", nil},
+			{farmer, "sell 10 plantains for 4$", &Intent{Slug: "sell", Product: "plantains", Number: 10, Price: Money{4, "USD"}},
+				"We created a new offer. You are selling 10 plantains for 4.00$.", nil},
+			{consumer, "buy 2kg cassava for 2$", &Intent{Slug: "buy", Product: "cassava", Mass: 2000, Price: Money{2, "USD"}},
+				"Amina (237600000001), 0 m away, sells you 2 kg of cassava for 1.20$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "1234", nil, "You bought 2 kg of cassava from Amina (237600000001) for 1.20$.",
+				[]sent{{farmer, "Paul (237600000003) bought 2 kg of cassava for 1.20$ from you."}}},
+			{consumer, "buy 4 plantains for 2$", &Intent{Slug: "buy", Product: "plantains", Number: 4, Price: Money{2, "USD"}},
+				"Amina (237600000001), 0 m away, sells you 4 plantains for 1.60$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "1234", nil, "You bought 4 plantains from Amina (237600000001) for 1.60$.",
+				[]sent{{farmer, "Paul (237600000003) bought 4 plantains for 1.60$ from you."}}},
+			{consumer, "buy 2 plantains for 2$", &Intent{Slug: "buy", Product: "plantains", Number: 2, Price: Money{2, "USD"}},
+				"Amina (237600000001), 0 m away, sells you 2 plantains for 0.80$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "no", nil, "We cancelled your purchase.", nil},
+			{consumer, "my trades", &Intent{Slug: "history"}, "Your latest trades:\n" +
+				"1. " + today + ": bought 4 plantains from Amina (237600000001) for 1.60$\n" +
+				"2. " + today + ": bought 2 kg of cassava from Amina (237600000001) for 1.20$\n", nil},
+			{farmer, "my sales", &Intent{Slug: "history"}, "Your latest trades:\n" +
+				"1. " + today + ": sold 4 plantains to Paul (237600000003) for 1.60$\n" +
+				"2. " + today + ": sold 2 kg of cassava to Paul (237600000003) for 1.20$\n", nil},
+		}),
+	"FarmersNearby": dialogue(onboard(consumer, "Paul", 3.848, 11.5021, "get_type_buyer"), []step{
+		{consumer, "farmers near me", &Intent{Slug: "pos_list"},
+			"We could not find any farmers nearby. Send \"notify me about new farmers\" to get a message when a farmer nearby joins.", nil},
+	}, onboard(farmer, "Amina", 3.857, 11.5021, "get_type_farmer"),
+		onboard(neighbor, "Jean", 3.948, 11.5021, "get_type_farmer"), []step{
+			{consumer, "farmers near me", &Intent{Slug: "pos_list"},
+				"We found the following farmers nearby:\n1. Amina (1001.87 m)\n", nil},
+		}),
+	"SellersNearby": dialogue(onboard(farmer, "Amina", 3.857, 11.5021, "get_type_farmer"),
+		onboard(neighbor, "Jean", 3.948, 11.5021, "get_type_farmer"),
+		onboard(consumer, "Paul", 3.848, 11.5021, "get_type_buyer"), []step{
+			{consumer, "who sells tomatoes near me", &Intent{Slug: "pos_list", Product: "tomatoes"},
+				"We could not find any farmers selling tomatoes within 10.0 km. Send e.g. \"buy 5kg tomatoes for 3$\" and we will notify you as soon as a farmer offers it.", nil},
+			{consumer, "who sells fufu near me", &Intent{Slug: "pos_list", Product: "fufu"},
+				"We do not know the product \"fufu\". Please check the spelling.", nil},
+			{farmer, "sell 5kg tomatoes for 3$", &Intent{Slug: "sell", Product: "tomatoes", Mass: 5000, Price: Money{3, "USD"}},
+				"We created a new offer. You are selling 5 kg of tomatoes (5 heaps) for 3.00$.", nil},
+			{farmer, "sell 10 tomatoes for 2$", &Intent{Slug: "sell", Product: "tomatoes", Number: 10, Price: Money{2, "USD"}},
+				"We created a new offer. You are selling 10 tomatoes for 2.00$.", nil},
+			{farmer, "sell 2kg cassava for 1$", &Intent{Slug: "sell", Product: "cassava", Mass: 2000, Price: Money{1, "USD"}},
+				"We created a new offer. You are selling 2 kg of cassava for 1.00$.", nil},
+			{neighbor, "sell 1kg tomates for 1$", &Intent{Slug: "sell", Product: "tomates", Mass: 1000, Price: Money{1, "USD"}},
+				"We created a new offer. You are selling 1 kg of tomatoes (1 heap) for 1.00$.", nil},
+			{consumer, "buy 2kg tomatoes for 2$", &Intent{Slug: "buy", Product: "tomatoes", Mass: 2000, Price: Money{2, "USD"}},
+				"Amina (237600000001), 1.0 km away, sells you 2 kg of tomatoes (2 heaps) for 1.20$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "1234", nil, "You bought 2 kg of tomatoes (2 heaps) from Amina (237600000001) for 1.20$.",
+				[]sent{{farmer, "Paul (237600000003) bought 2 kg of tomatoes (2 heaps) for 1.20$ from you."}}},
+			{consumer, "who sells tomates near me", &Intent{Slug: "pos_list", Product: "tomates"},
+				"Farmers selling tomatoes within 10.0 km:\n" +
+					"1. Amina (237600000001), 1.0 km away: 3 kg of tomatoes (3 heaps) for 1.80$, 10 tomatoes for 2.00$\n", nil},
+			{consumer, "farmers near me", &Intent{Slug: "pos_list"},
+				"We found the following farmers nearby:\n1. Amina (1001.87 m)\n", nil},
+			{neighbor, "who sells tomatoes near me", &Intent{Slug: "pos_list", Product: "tomatoes"},
+				"We could not find any farmers selling tomatoes within 10.0 km. Send e.g. \"buy 5kg tomatoes for 3$\" and we will notify you as soon as a farmer offers it.", nil},
+		}),
+	"FarmerAlerts": dialogue(onboard(consumer, "Paul", 3.848, 11.5021, "get_type_buyer"), []step{
+		{consumer, "notify me about new farmers", &Intent{Slug: "subscribe_farmers"},
+			"We will notify you when a new farmer joins within 10.0 km. Send \"stop farmer alerts\" to unsubscribe.", nil},
+	}, alerted(onboard(farmer, "Amina", 3.857, 11.5021, "get_type_farmer"),
+		sent{consumer, "Amina, a farmer 1.0 km away, just joined the market. Send \"farmers near me\" to see all farmers nearby or \"stop farmer alerts\" to unsubscribe."}),
+		onboard(neighbor, "Jean", 3.858, 11.5021, "get_type_farmer"),
+		onboard(remote, "Bello", 4.0511, 9.7679, "get_type_farmer"), []step{
+			wait(24 * time.Hour),
+			{neighbor, "delete my account", &Intent{Slug: "delete_account"},
+				"Do you really want to delete your account? Your open offers will be withdrawn and your pending purchase requests cancelled. Please answer with your PIN to confirm or no to cancel.", nil},
+			{neighbor, "1234", nil, "We deleted your account. Goodbye!", nil},
+		}, alerted(onboard(neighbor, "Jean", 3.858, 11.5021, "get_type_farmer"),
+			sent{consumer, "Jean, a farmer 1.1 km away, just joined the market. Send \"farmers near me\" to see all farmers nearby or \"stop farmer alerts\" to unsubscribe."}),
+		[]step{
+			{consumer, "stop farmer alerts", &Intent{Slug: "unsubscribe_farmers"},
+				"We will no longer notify you about new farmers nearby.", nil},
+			wait(24 * time.Hour),
+			{neighbor, "delete my account", &Intent{Slug: "delete_account"},
+				"Do you really want to delete your account? Your open offers will be withdrawn and your pending purchase requests cancelled. Please answer with your PIN to confirm or no to cancel.", nil},
+			{neighbor, "1234", nil, "We deleted your account. Goodbye!", nil},
+		}, onboard(neighbor, "Jean", 3.858, 11.5021, "get_type_farmer")),
+	"MarketPrices": dialogue(onboard(farmer, "Amina", 3.848, 11.5021, "get_type_farmer"),
+		onboard(neighbor, "Jean", 3.948, 11.5021, "get_type_farmer"),
+		onboard(consumer, "Paul", 3.848, 11.5021, "get_type_buyer"), []step{
+			{farmer, "price?", &Intent{Slug: "price-question"},
+				"Please rephrase your request and indicate which product you are looking for.", nil},
+			{farmer, "price of cassava", &Intent{Slug: "price-question", Product: "cassava"},
+				"There were no trades or offers of cassava within 50.0 km in the last 30 days.", nil},
+			{farmer, "sell 1kg cassava for 2$", &Intent{Slug: "sell", Product: "cassava", Mass: 1000, Price: Money{2, "USD"}},
+				"We created a new offer. You are selling 1 kg of cassava for 2.00$.", nil},
+			{farmer, "sell 2 cassava for 4$", &Intent{Slug: "sell", Product: "cassava", Number: 2, Price: Money{4, "USD"}},
+				"We created a new offer. You are selling 2 cassava for 4.00$.", nil},
+			{neighbor, "sell 500g cassava for 2$", &Intent{Slug: "sell", Product: "cassava", Mass: 500, Price: Money{2, "USD"}},
+				"We created a new offer. You are selling 500 g of cassava for 2.00$.", nil},
+			{farmer, "price of cassava", &Intent{Slug: "price-question", Product: "cassava"},
+				"Prices of cassava within 50.0 km in the last 30 days:\n" +
+					"- per kg: median 3.00$, min 2.00$, max 4.00$ from 2 offers\n" +
+					"- per piece: median 2.00$, min 2.00$, max 2.00$ from 1 offer", nil},
+			{consumer, "buy 500g cassava for 1$", &Intent{Slug: "buy", Product: "cassava", Mass: 500, Price: Money{1, "USD"}},
+				"Amina (237600000001), 0 m away, sells you 500 g of cassava for 1.00$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "1234", nil, "You bought 500 g of cassava from Amina (237600000001) for 1.00$.",
+				[]sent{{farmer, "Paul (237600000003) bought 500 g of cassava for 1.00$ from you."}}},
+			{neighbor, "price of cassava", &Intent{Slug: "price-question", Product: "cassava"},
+				"Prices of cassava within 50.0 km in the last 30 days:\n" +
+					"- per kg: median 2.00$, min 2.00$, max 2.00$ from 1 trade\n" +
+					"- per piece: median 2.00$, min 2.00$, max 2.00$ from 1 offer", nil},
+			wait(31 * 24 * time.Hour),
+			{farmer, "price of cassava", &Intent{Slug: "price-question", Product: "cassava"},
+				"There were no trades or offers of cassava within 50.0 km in the last 30 days.", nil},
+		}),
+}
+
+func TestDialogues(t *testing.T) {
+	for name, steps := range dialogues {
+		steps := steps
+		t.Run(name, func(t *testing.T) { runDialogue(t, steps) })
+	}
+}
+
+func TestSellerAcceptance(t *testing.T) {
+	proposal := func(quantity string, price string) string {
+		return "Amina (237600000001), 0 m away, sells you " + quantity + " for " + price + ". Do you want to buy it? Please answer with your PIN to confirm or no to cancel."
+	}
+	request := func(quantity string, price string) []sent {
+		return []sent{{farmer, "Paul (237600000003) wants to buy " + quantity + " for " + price + " from you. Do you accept? Please answer yes or no."}}
+	}
+	sentRequest := "We sent your request to Amina (237600000001). We will notify you as soon as the seller answers."
+
+	runDialogue(t, dialogue(onboard(farmer, "Amina", 3.848, 11.5021, "get_type_farmer"),
+		onboard(consumer, "Paul", 3.848, 11.5021, "get_type_buyer"), []step{
+			{farmer, "sell 10 plantains for 10$", &Intent{Slug: "sell", Product: "plantains", Number: 10, Price: Money{10, "USD"}},
+				"We created a new offer. You are selling 10 plantains for 10.00$.", nil},
+			{consumer, "buy 6 plantains for 6$", &Intent{Slug: "buy", Product: "plantains", Number: 6, Price: Money{6, "USD"}},
+				proposal("6 plantains", "6.00$"), nil},
+			{consumer, "1234", nil, sentRequest, request("6 plantains", "6.00$")},
+			{consumer, "buy 6 plantains for 6$", &Intent{Slug: "buy", Product: "plantains", Number: 6, Price: Money{6, "USD"}},
+				"Nobody nearby sells 6 plantains for 6.00$ right now. We saved your request and will notify you as soon as a farmer offers it.", nil},
+			{farmer, "no", nil, "You declined the request of Paul (237600000003).",
+				[]sent{{consumer, "Amina (237600000001) declined your request to buy 6 plantains."}}},
+			{consumer, "buy 6 plantains for 6$", &Intent{Slug: "buy", Product: "plantains", Number: 6, Price: Money{6, "USD"}},
+				proposal("6 plantains", "6.00$"), nil},
+			{consumer, "1234", nil, sentRequest, request("6 plantains", "6.00$")},
+			{consumer, "buy 4 plantains for 4$", &Intent{Slug: "buy", Product: "plantains", Number: 4, Price: Money{4, "USD"}},
+				proposal("4 plantains", "4.00$"), nil},
+			{consumer, "1234", nil, sentRequest, request("4 plantains", "4.00$")},
+			{farmer, "yes", nil, "You sold 6 plantains to Paul (237600000003) for 6.00$.",
+				[]sent{{consumer, "Amina (237600000001) accepted your request. You bought 6 plantains for 6.00$."}}},
+			wait(2 * time.Hour),
+			{farmer, "yes", nil, "This purchase request expired already.",
+				[]sent{{consumer, "Amina (237600000001) did not answer your request to buy 4 plantains in time."}}},
+			{farmer, "hello", &Intent{Slug: "greetings"},
+				"Hi, this is your Chat4Bread market platform. You can buy/sell goods, lookup prices and find other farmers.", nil},
+			{consumer, "buy 4 plantains for 4$", &Intent{Slug: "buy", Product: "plantains", Number: 4, Price: Money{4, "USD"}},
+				proposal("4 plantains", "4.00$"), nil},
+		}), func(m *Machine) { m.SellerAcceptance = true })
+}
+
+func TestDeleteAccount(t *testing.T) {
+	runDialogue(t, dialogue(onboard(farmer, "Amina", 3.848, 11.5021, "get_type_farmer"),
+		onboard(neighbor, "Jean", 3.848, 11.5021, "get_type_farmer"),
+		onboard(consumer, "Paul", 3.848, 11.5021, "get_type_buyer"), []step{
+			{farmer, "sell 10 plantains for 10$", &Intent{Slug: "sell", Product: "plantains", Number: 10, Price: Money{10, "USD"}},
+				"We created a new offer. You are selling 10 plantains for 10.00$.", nil},
+			{neighbor, "sell 10 plantains for 20$", &Intent{Slug: "sell", Product: "plantains", Number: 10, Price: Money{20, "USD"}},
+				"We created a new offer. You are selling 10 plantains for 20.00$.", nil},
+			{consumer, "buy 4 plantains for 4$", &Intent{Slug: "buy", Product: "plantains", Number: 4, Price: Money{4, "USD"}},
+				"Amina (237600000001), 0 m away, sells you 4 plantains for 4.00$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "1234", nil, "We sent your request to Amina (237600000001). We will notify you as soon as the seller answers.",
+				[]sent{{farmer, "Paul (237600000003) wants to buy 4 plantains for 4.00$ from you. Do you accept? Please answer yes or no."}}},
+			{consumer, "buy 2 plantains for 4$", &Intent{Slug: "buy", Product: "plantains", Number: 2, Price: Money{4, "USD"}},
+				"Amina (237600000001), 0 m away, sells you 2 plantains for 2.00$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "1234", nil, "We sent your request to Amina (237600000001). We will notify you as soon as the seller answers.",
+				[]sent{{farmer, "Paul (237600000003) wants to buy 2 plantains for 2.00$ from you. Do you accept? Please answer yes or no."}}},
+			{farmer, "delete my account", &Intent{Slug: "delete_account"},
+				"Do you really want to delete your account? Your open offers will be withdrawn and your pending purchase requests cancelled. Please answer with your PIN to confirm or no to cancel.", nil},
+			{farmer, "no", nil, "We did not change your account.", nil},
+			{farmer, "delete my account", &Intent{Slug: "delete_account"},
+				"Do you really want to delete your account? Your open offers will be withdrawn and your pending purchase requests cancelled. Please answer with your PIN to confirm or no to cancel.", nil},
+			{farmer, "1234", nil, "We deleted your account. Goodbye!", []sent{
+				{consumer, "Amina (237600000001) closed the account, so your request to buy 4 plantains was declined."},
+				{consumer, "Amina (237600000001) closed the account, so your request to buy 2 plantains was declined."}}},
+			{consumer, "buy 4 plantains for 8$", &Intent{Slug: "buy", Product: "plantains", Number: 4, Price: Money{8, "USD"}},
+				"Jean (237600000002), 0 m away, sells you 4 plantains for 8.00$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "1234", nil, "We sent your request to Jean (237600000002). We will notify you as soon as the seller answers.",
+				[]sent{{neighbor, "Paul (237600000003) wants to buy 4 plantains for 8.00$ from you. Do you accept? Please answer yes or no."}}},
+			{consumer, "delete my account", &Intent{Slug: "delete_account"},
+				"Do you really want to delete your account? Your open offers will be withdrawn and your pending purchase requests cancelled. Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "1234", nil, "We deleted your account. Goodbye!",
+				[]sent{{neighbor, "Paul (237600000003) closed the account and cancelled the request to buy 4 plantains."}}},
+			{farmer, "Hi", nil, "Hi, here is your Chat4Bread market platform. Who are you?", nil},
+		}), func(m *Machine) { m.SellerAcceptance = true })
+}
+
+func TestBecomeConsumer(t *testing.T) {
+	runDialogue(t, dialogue(onboard(farmer, "Amina", 3.848, 11.5021, "get_type_farmer"),
+		onboard(consumer, "Paul", 3.848, 11.5021, "get_type_buyer"), []step{
+			{farmer, "sell 10 plantains for 10$", &Intent{Slug: "sell", Product: "plantains", Number: 10, Price: Money{10, "USD"}},
+				"We created a new offer. You are selling 10 plantains for 10.00$.", nil},
+			{consumer, "buy 4 plantains for 4$", &Intent{Slug: "buy", Product: "plantains", Number: 4, Price: Money{4, "USD"}},
+				"Amina (237600000001), 0 m away, sells you 4 plantains for 4.00$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "1234", nil, "We sent your request to Amina (237600000001). We will notify you as soon as the seller answers.",
+				[]sent{{farmer, "Paul (237600000003) wants to buy 4 plantains for 4.00$ from you. Do you accept? Please answer yes or no."}}},
+			{farmer, "switch to consumer", &Intent{Slug: "become_consumer"},
+				"Do you want to switch your account to consumer? Your open offers will be withdrawn and your pending sales declined. Please answer with your PIN to confirm or no to cancel.", nil},
+			{farmer, "1234", nil, "You are now registered as a consumer.",
+				[]sent{{consumer, "Amina (237600000001) stopped selling, so your request to buy 4 plantains was declined."}}},
+			{farmer, "yes", &Intent{Slug: "greetings"},
+				"Hi, this is your Chat4Bread market platform. You can buy goods, lookup prices and find farmers.", nil},
+		}), func(m *Machine) { m.SellerAcceptance = true })
+}
+
+func TestDeleteAccountWithOrder(t *testing.T) {
+	var store Store
+	runDialogue(t, dialogue(onboard(consumer, "Paul", 3.848, 11.5021, "get_type_buyer"), []step{
+		{consumer, "buy 4 plantains for 4$", &Intent{Slug: "buy", Product: "plantains", Number: 4, Price: Money{4, "USD"}},
+			"Nobody nearby sells 4 plantains for 4.00$ right now. We saved your request and will notify you as soon as a farmer offers it.", nil},
+		{consumer, "delete my account", &Intent{Slug: "delete_account"},
+			"Do you really want to delete your account? Your open offers will be withdrawn and your pending purchase requests cancelled. Please answer with your PIN to confirm or no to cancel.", nil},
+		{consumer, "1234", nil, "We deleted your account. Goodbye!", nil},
+	}), func(m *Machine) { store = m.Store })
+
+	product, err := store.FindOrCreateProduct("plantains")
+	mustNil(t, err)
+	orders, err := store.FindOrders(product.ID, true, 0, 3.848, 11.5021, 1000)
+	if err != nil || len(orders) != 0 {
+		t.Fatalf("expected no open orders, got %+v, %v", orders, err)
+	}
+}
+
+func TestDeleteAccountWithProposal(t *testing.T) {
+	runDialogue(t, dialogue(onboard(farmer, "Amina", 3.848, 11.5021, "get_type_farmer"),
+		onboard(consumer, "Paul", 3.848, 11.5021, "get_type_buyer"), []step{
+			{farmer, "sell 10 plantains for 10$", &Intent{Slug: "sell", Product: "plantains", Number: 10, Price: Money{10, "USD"}},
+				"We created a new offer. You are selling 10 plantains for 10.00$.", nil},
+			{consumer, "buy 4 plantains for 4$", &Intent{Slug: "buy", Product: "plantains", Number: 4, Price: Money{4, "USD"}},
+				"Amina (237600000001), 0 m away, sells you 4 plantains for 4.00$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+			{farmer, "delete my account", &Intent{Slug: "delete_account"},
+				"Do you really want to delete your account? Your open offers will be withdrawn and your pending purchase requests cancelled. Please answer with your PIN to confirm or no to cancel.", nil},
+			{farmer, "1234", nil, "We deleted your account. Goodbye!",
+				[]sent{{consumer, "Amina (237600000001) closed the account, so your purchase of 4 plantains was cancelled."}}},
+			{consumer, "1234", nil, "Your purchase proposal expired. Please send your buy request again.", nil},
+			{consumer, "buy 4 plantains for 4$", &Intent{Slug: "buy", Product: "plantains", Number: 4, Price: Money{4, "USD"}},
+				"Nobody nearby sells 4 plantains for 4.00$ right now. We saved your request and will notify you as soon as a farmer offers it.", nil},
+		}))
+}
+
+func TestPINLockout(t *testing.T) {
+	locked := "Your account is locked because of too many wrong PINs. Please try again in %d minutes."
+	runDialogue(t, dialogue(onboard(farmer, "Amina", 3.848, 11.5021, "get_type_farmer"),
+		onboard(consumer, "Paul", 3.848, 11.5021, "get_type_buyer"), []step{
+			{farmer, "sell 10 plantains for 10$", &Intent{Slug: "sell", Product: "plantains", Number: 10, Price: Money{10, "USD"}},
+				"We created a new offer. You are selling 10 plantains for 10.00$.", nil},
+			{consumer, "buy 4 plantains for 4$", &Intent{Slug: "buy", Product: "plantains", Number: 4, Price: Money{4, "USD"}},
+				"Amina (237600000001), 0 m away, sells you 4 plantains for 4.00$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "4321", nil, "Wrong PIN. You have 2 more attempts.", nil},
+			{consumer, "1234", nil, "You bought 4 plantains from Amina (237600000001) for 4.00$.",
+				[]sent{{farmer, "Paul (237600000003) bought 4 plantains for 4.00$ from you."}}},
+			{consumer, "buy 4 plantains for 4$", &Intent{Slug: "buy", Product: "plantains", Number: 4, Price: Money{4, "USD"}},
+				"Amina (237600000001), 0 m away, sells you 4 plantains for 4.00$. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "4321", nil, "Wrong PIN. You have 2 more attempts.", nil},
+			{consumer, "5678", nil, "Wrong PIN. You have 1 more attempt.", nil},
+			{consumer, "8765", nil, fmt.Sprintf(locked, 15) + " We cancelled your purchase.", nil},
+			wait(5 * time.Minute),
+			{consumer, "buy 4 plantains for 4$", &Intent{Slug: "buy", Product: "plantains", Number: 4, Price: Money{4, "USD"}},
+				fmt.Sprintf(locked, 10), nil},
+			{consumer, "delete my account", &Intent{Slug: "delete_account"}, fmt.Sprintf(locked, 10), nil},
+			wait(10 * time.Minute),
+			{consumer, "delete my account", &Intent{Slug: "delete_account"},
+				"Do you really want to delete your account? Your open offers will be withdrawn and your pending purchase requests cancelled. Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "no", nil, "We did not change your account.", nil},
+		}))
+}
+
+func TestRequestPIN(t *testing.T) {
+	register := func(m *Machine) {
+		mustNil(t, m.Store.NewUser(consumer))
+		user := mustUser(t, m.Store, consumer)
+		mustNil(t, m.Store.SetUserName(user, "Paul"))
+		mustNil(t, m.Store.SetUserLocation(user, 3.848, 11.5021))
+		mustNil(t, m.Store.SetUserKind(user, "consumer"))
+		mustNil(t, m.Store.ResetUserState(user))
+	}
+	runDialogue(t, []step{
+		{consumer, "which farmers are near me?", &Intent{Slug: "pos_list"}, "We could not find any farmers nearby. Send \"notify me about new farmers\" to get a message when a farmer nearby joins.", nil},
+		{consumer, "buy 4 plantains for 4$", &Intent{Slug: "buy", Product: "plantains", Number: 4, Price: Money{4, "USD"}},
+			"Please choose a PIN of 4 to 6 digits first. You will need it to confirm purchases and account changes.", nil},
+		{consumer, "PIN", nil, "Please choose a PIN of 4 to 6 digits, e.g. 4821.", nil},
+		{consumer, "1234", nil, "Thank you, please keep your PIN secret. You can now send your request again.", nil},
+		{consumer, "buy 4 plantains for 4$", &Intent{Slug: "buy", Product: "plantains", Number: 4, Price: Money{4, "USD"}},
+			"Nobody nearby sells 4 plantains for 4.00$ right now. We saved your request and will notify you as soon as a farmer offers it.", nil},
+	}, register)
+}
+
+func TestOnboardingWithoutPIN(t *testing.T) {
+	register := func(m *Machine) {
+		mustNil(t, m.Store.NewUser(consumer))
+		user := mustUser(t, m.Store, consumer)
+		mustNil(t, m.Store.SetUserState(user, "onboarding", []string{"name", "location", "type"}))
+	}
+	runDialogue(t, []step{
+		{consumer, "I am Paul", &Intent{Slug: "get_name", FullName: "Paul"}, "Hi Paul, where do you live?", nil},
+		{consumer, "Yaoundé", &Intent{Slug: "get_location", Lat: 3.848, Lng: 11.5021},
+			"Great to have you here. Are you a farmer or a consumer?", nil},
+		{consumer, "consumer", &Intent{Slug: "get_type_buyer"},
+			"Welcome to the market. You can now look for organic food or find a local farmer.", nil},
+		{consumer, "buy 4 plantains for 4$", &Intent{Slug: "buy", Product: "plantains", Number: 4, Price: Money{4, "USD"}},
+			"Please choose a PIN of 4 to 6 digits first. You will need it to confirm purchases and account changes.", nil},
+	}, register)
+}
+
+func TestSweepOffers(t *testing.T) {
+	store := NewMemoryStore()
+	machine := NewMachine(store, &scriptedClassifier{next: &Intent{Slug: "sell", Product: "cassava", Mass: 5000, Price: Money{3, "USD"}}})
+	var outbox []sent
+	machine.SendMessage = func(id int64, message string) error {
+		outbox = append(outbox, sent{To: id, Text: message})
+		return nil
+	}
+	newTestUser(t, store, farmer, "Amina", 3.848, 11.5021, "farmer")
+	_, err := machine.Generate(farmer, "sell 5kg cassava for 3$")
+	mustNil(t, err)
+
+	mustNil(t, machine.SweepOffers())
+	if len(outbox) != 0 {
+		t.Fatalf("expected no expired offers, got %v", outbox)
+	}
+
+	machine.Now = func() time.Time { return time.Now().Add(8 * 24 * time.Hour) }
+	mustNil(t, machine.SweepOffers())
+	expected := []sent{{farmer, "Your offer of 5 kg of cassava expired. Please create a new offer if you still want to sell it."}}
+	if fmt.Sprint(outbox) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, outbox)
+	}
+	if len(store.offers) != 1 {
+		t.Fatalf("expected expired offer to be kept for a day, got %d offers", len(store.offers))
+	}
+
+	machine.Now = func() time.Time { return time.Now().Add(10 * 24 * time.Hour) }
+	mustNil(t, machine.SweepOffers())
+	if len(outbox) != 1 || len(store.offers) != 0 || len(store.archived) != 1 {
+		t.Fatalf("expected archived offer, got %v %d", outbox, len(store.offers))
+	}
+}
+
+func TestExpireProposals(t *testing.T) {
+	store := NewMemoryStore()
+	machine := NewMachine(store, &scriptedClassifier{})
+	var outbox []sent
+	machine.SendMessage = func(id int64, message string) error {
+		outbox = append(outbox, sent{To: id, Text: message})
+		return nil
+	}
+	seller := newTestUser(t, store, farmer, "Amina", 3.848, 11.5021, "farmer")
+	buyer := newTestUser(t, store, consumer, "Paul", 3.848, 11.5021, "consumer")
+	product, err := store.FindOrCreateProduct("cassava")
+	mustNil(t, err)
+	_, err = store.CreateMassOffer(seller.ID, product.ID, 3, 5000, never)
+	mustNil(t, err)
+
+	reply, err := machine.BuyProduct(buyer, &Intent{Slug: "buy", Product: "cassava", Mass: 5000, Price: Money{3, "USD"}})
+	mustNil(t, err)
+	if !strings.HasSuffix(reply, "Do you want to buy it? Please answer with your PIN to confirm or no to cancel.") {
+		t.Fatalf("expected proposal, got %q", reply)
+	}
+
+	mustNil(t, machine.ExpireProposals())
+	if len(outbox) != 0 {
+		t.Fatalf("expected no expired proposals, got %v", outbox)
+	}
+
+	machine.Now = func() time.Time { return time.Now().Add(time.Hour) }
+	mustNil(t, machine.ExpireProposals())
+	expected := []sent{{consumer, "Your purchase proposal expired. Please send your buy request again."}}
+	if fmt.Sprint(outbox) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, outbox)
+	}
+	if user := mustUser(t, store, consumer); user.Action != "" {
+		t.Fatalf("expected reset buyer state, got %s", user.Action)
+	}
+	offers, err := store.SellerOffers(seller.ID)
+	if err != nil || len(offers) != 1 || offers[0].Mass != 5000 {
+		t.Fatalf("expected released offer, got %v, %v", offers, err)
+	}
+}
+
+func TestCurrencies(t *testing.T) {
+	runDialogue(t, dialogue(onboard(farmer, "Amina", 3.848, 11.5021, "get_type_farmer"),
+		onboard(consumer, "Paul", 3.848, 11.5021, "get_type_buyer"), []step{
+			{farmer, "sell 10 plantains for 2000 FCFA", &Intent{Slug: "sell", Product: "plantains", Number: 10, Price: Money{2000, "XAF"}},
+				"We created a new offer. You are selling 10 plantains for 2000 FCFA.", nil},
+			{farmer, "sell 5kg cassava for 3$", &Intent{Slug: "sell", Product: "cassava", Mass: 5000, Price: Money{3, "USD"}},
+				"We created a new offer. You are selling 5 kg of cassava for 1800 FCFA.", nil},
+			{farmer, "sell 5kg yams for 3000 naira", &Intent{Slug: "sell", Product: "yams", Mass: 5000, Price: Money{3000, "NGN"}},
+				"We do not know the exchange rate of NGN. Please tell us the price in XAF.", nil},
+			{consumer, "buy 4 plantains for 800f", &Intent{Slug: "buy", Product: "plantains", Number: 4, Price: Money{800, "XAF"}},
+				"Amina (237600000001), 0 m away, sells you 4 plantains for 800 FCFA. Do you want to buy it? Please answer with your PIN to confirm or no to cancel.", nil},
+			{consumer, "1234", nil, "You bought 4 plantains from Amina (237600000001) for 800 FCFA.",
+				[]sent{{farmer, "Paul (237600000003) bought 4 plantains for 800 FCFA from you."}}},
+			{farmer, "price of plantains", &Intent{Slug: "price-question", Product: "plantains"},
+				"Prices of plantains within 50.0 km in the last 30 days:\n" +
+					"- per piece: median 200 FCFA, min 200 FCFA, max 200 FCFA from 1 trade", nil},
+			{farmer, "change offer 1", &Intent{Slug: "update_offer", Reference: 1},
+				"Please tell us the new price or quantity of your offer, e.g. \"change offer 1 to 3000 FCFA\".", nil},
+		}), func(m *Machine) {
+		m.Currencies = NewCurrencies("XAF")
+		delete(m.Currencies.Rates, "NGN")
+	})
+}
+
+func TestPriceTrend(t *testing.T) {
+	store := NewMemoryStore()
+	machine := NewMachine(store, &scriptedClassifier{})
+	machine.Currencies = NewCurrencies("USD")
+	now := time.Date(2019, 7, 1, 12, 0, 0, 0, time.UTC)
+	machine.Now = func() time.Time { return now }
+	seller := newTestUser(t, store, farmer, "Amina", 3.848, 11.5021, "farmer")
+	product, err := store.FindOrCreateProduct("cassava")
+	mustNil(t, err)
+	_, err = store.CreateMassOffer(seller.ID, product.ID, 2, 1000, never)
+	mustNil(t, err)
+	setPrice := func(price float64) {
+		t.Helper()
+		offers, err := store.SellerOffers(seller.ID)
+		mustNil(t, err)
+		ok, err := store.UpdateOffer(&offers[0], price, offers[0].Mass, offers[0].Units)
+		if err != nil || !ok {
+			t.Fatalf("expected updated offer, got %v, %v", ok, err)
+		}
+	}
+	trend := func(expected string) {
+		t.Helper()
+		reply, err := machine.PriceTrend(&Intent{Slug: "price-trend", Product: "cassava"})
+		if err != nil || reply != expected {
+			t.Fatalf("expected reply %q, got %q, %v", expected, reply, err)
+		}
+	}
+
+	mustNil(t, machine.SnapshotPrices())
+	trend("We do not have enough price history of cassava yet. Please ask again in a few days.")
+	setPrice(4)
+	mustNil(t, machine.SnapshotPrices())
+	trend("We do not have enough price history of cassava yet. Please ask again in a few days.")
+
+	now = now.AddDate(0, 0, 20)
+	setPrice(3)
+	mustNil(t, machine.SnapshotPrices())
+	trend("Price trend of cassava:\n- per kg: 3.00$, up 50% over the last month")
+
+	now = now.AddDate(0, 0, 7)
+	setPrice(2.4)
+	mustNil(t, machine.SnapshotPrices())
+	trend("Price trend of cassava:\n- per kg: 2.40$, down 20% over the last week and up 20% over the last month")
+
+	now = now.AddDate(0, 0, 25)
+	trend("We do not have enough price history of cassava yet. Please ask again in a few days.")
+}
+
+func TestDescribeTrend(t *testing.T) {
+	cases := []struct {
+		From     float64
+		To       float64
+		Expected string
+	}{
+		{2, 3, "up 50%"},
+		{3, 2.4, "down 20%"},
+		{100, 100.5, "stable"},
+		{0, 3, "no trend"},
+		{0, 0, "no trend"},
+	}
+	for _, c := range cases {
+		if trend := describeTrend(c.From, c.To); trend != c.Expected {
+			t.Errorf("expected trend %q from %f to %f, got %q", c.Expected, c.From, c.To, trend)
+		}
+	}
+}
@@ -0,0 +1,790 @@
+package main
+
+import (
+	"errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// earthRadius is the mean radius of the earth in meters, as used by MongoDB for spherical queries.
+const earthRadius = 6378100.0
+
+// MemoryStore is an in-memory Store for tests and simulations.
+type MemoryStore struct {
+	mutex    sync.Mutex
+	users    []*User
+	products []*Product
+	offers   []*Offer
+	archived []*Offer
+	trades   []*Trade
+	history  []*PriceSnapshot
+	orders   []*Order
+}
+
+// NewMemoryStore initializes an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{}
+}
+
+// Haversine returns the great-circle distance in meters between two geo points.
+func Haversine(lat1 float64, lng1 float64, lat2 float64, lng2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLng := (lng2 - lng1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// user returns the stored user with the given ID.
+func (ms *MemoryStore) user(id primitive.ObjectID) *User {
+	for _, user := range ms.users {
+		if user.ID == id {
+			return user
+		}
+	}
+	return nil
+}
+
+// offer returns the stored offer with the given ID.
+func (ms *MemoryStore) offer(id primitive.ObjectID) *Offer {
+	for _, offer := range ms.offers {
+		if offer.ID == id {
+			return offer
+		}
+	}
+	return nil
+}
+
+// copyUser returns a copy of a user which does not share state with the store.
+func copyUser(user *User) *User {
+	copied := *user
+	if user.Name != nil {
+		name := *user.Name
+		copied.Name = &name
+	}
+	if user.Location != nil {
+		location := *user.Location
+		location.Coords = append([]float64{}, user.Location.Coords...)
+		copied.Location = &location
+	}
+	if user.Kind != nil {
+		kind := *user.Kind
+		copied.Kind = &kind
+	}
+	if user.PIN != nil {
+		pin := *user.PIN
+		copied.PIN = &pin
+	}
+	copied.Reqs = append([]string{}, user.Reqs...)
+	return &copied
+}
+
+// UserByPhone looks for a user by its phone number/username.
+func (ms *MemoryStore) UserByPhone(phone int64) (*User, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	for _, user := range ms.users {
+		if user.Phone == phone {
+			return copyUser(user), nil
+		}
+	}
+	return nil, nil
+}
+
+// UserByID looks for a user by its ID.
+func (ms *MemoryStore) UserByID(id primitive.ObjectID) (*User, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if user := ms.user(id); user != nil {
+		return copyUser(user), nil
+	}
+	return nil, nil
+}
+
+// NewUser adds a new user to the system.
+func (ms *MemoryStore) NewUser(phone int64) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.users = append(ms.users, &User{ID: primitive.NewObjectID(), Phone: phone,
+		Action: "onboarding", Reqs: []string{"name", "location", "pin", "type"}})
+	return nil
+}
+
+// update applies a change to a stored user.
+func (ms *MemoryStore) update(user *User, change func(stored *User)) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if stored := ms.user(user.ID); stored != nil {
+		change(stored)
+	}
+	return nil
+}
+
+// ResetUserState resets the user state.
+func (ms *MemoryStore) ResetUserState(user *User) error {
+	return ms.update(user, func(stored *User) {
+		stored.Action = ""
+		stored.Reqs = []string{}
+	})
+}
+
+// SetUserState sets the current action of the user and its requirements.
+func (ms *MemoryStore) SetUserState(user *User, action string, reqs []string) error {
+	return ms.update(user, func(stored *User) {
+		stored.Action = action
+		stored.Reqs = append([]string{}, reqs...)
+	})
+}
+
+// SetUserName sets the name of the user.
+func (ms *MemoryStore) SetUserName(user *User, name string) error {
+	return ms.update(user, func(stored *User) { stored.Name = &name })
+}
+
+// SetUserLocation sets the location of the user and its available offers.
+func (ms *MemoryStore) SetUserLocation(user *User, lat float64, lng float64) error {
+	return ms.update(user, func(stored *User) {
+		location := MakeGeoJSONPnt(lat, lng)
+		stored.Location = &location
+		for _, offer := range ms.offers {
+			if offer.Seller == stored.ID && available(offer, time.Now()) {
+				offer.Location = ms.sellerLocation(stored.ID)
+			}
+		}
+	})
+}
+
+// DeleteUser removes a user from the system. Offers and trades of the user are kept.
+func (ms *MemoryStore) DeleteUser(user *User) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	for index, stored := range ms.users {
+		if stored.ID == user.ID {
+			ms.users = append(ms.users[:index], ms.users[index+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// SetUserPIN sets the hashed PIN of the user and clears its failed attempts.
+func (ms *MemoryStore) SetUserPIN(user *User, hash string) error {
+	return ms.update(user, func(stored *User) {
+		stored.PIN = &hash
+		stored.PINFailures = 0
+		stored.LockedUntil = time.Time{}
+	})
+}
+
+// SetPINFailures records the number of consecutive wrong PINs of the user and until when it is
+// locked.
+func (ms *MemoryStore) SetPINFailures(user *User, failures int, lockedUntil time.Time) error {
+	return ms.update(user, func(stored *User) {
+		stored.PINFailures = failures
+		stored.LockedUntil = lockedUntil
+	})
+}
+
+// SetFarmerAlerts subscribes or unsubscribes the user from alerts about new farmers nearby.
+func (ms *MemoryStore) SetFarmerAlerts(user *User, enabled bool) error {
+	return ms.update(user, func(stored *User) { stored.FarmerAlerts = enabled })
+}
+
+// RecordAlert records that an alert is sent to the user at a point in time, unless the last alert
+// was sent after another point in time. It returns whether the alert was recorded.
+func (ms *MemoryStore) RecordAlert(user *User, now time.Time, before time.Time) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	stored := ms.user(user.ID)
+	if stored == nil || stored.LastAlert.After(before) {
+		return false, nil
+	}
+	stored.LastAlert = now
+	user.LastAlert = now
+	return true, nil
+}
+
+// SetUserKind sets the type of the user.
+func (ms *MemoryStore) SetUserKind(user *User, kind string) error {
+	return ms.update(user, func(stored *User) { stored.Kind = &kind })
+}
+
+// PopRequirement removes the top requirement of the current action.
+func (ms *MemoryStore) PopRequirement(user *User) error {
+	return ms.update(user, func(stored *User) {
+		if len(stored.Reqs) > 0 {
+			stored.Reqs = stored.Reqs[1:]
+		}
+	})
+}
+
+// FindFarmersNear finds users near a geo point within a specific range in meters, ordered by
+// their distance.
+func (ms *MemoryStore) FindFarmersNear(lat float64, lng float64, dist float64) ([]User, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	var users []User
+	for _, user := range ms.users {
+		if user.Location == nil {
+			continue
+		}
+		distance := Haversine(lat, lng, user.Location.Coords[1], user.Location.Coords[0])
+		if distance <= dist {
+			found := copyUser(user)
+			found.Location.Distance = distance
+			users = append(users, *found)
+		}
+	}
+	sort.SliceStable(users, func(i, j int) bool {
+		return users[i].Location.Distance < users[j].Location.Distance
+	})
+	return users, nil
+}
+
+// FindSellersNear finds the farmers near a geo point within a specific range in meters who have
+// available offers of a product, nearest first. The distance of each farmer is stored in its
+// location.
+func (ms *MemoryStore) FindSellersNear(product primitive.ObjectID, lat float64, lng float64, dist float64) ([]Seller, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	var sellers []Seller
+	for _, user := range ms.users {
+		if user.Location == nil || user.Kind == nil || *user.Kind != "farmer" {
+			continue
+		}
+		distance := Haversine(lat, lng, user.Location.Coords[1], user.Location.Coords[0])
+		if distance > dist {
+			continue
+		}
+		var offers []Offer
+		for _, offer := range ms.offers {
+			if offer.Seller == user.ID && offer.Product == product && available(offer, time.Now()) {
+				offers = append(offers, *offer)
+			}
+		}
+		if len(offers) == 0 {
+			continue
+		}
+		found := copyUser(user)
+		found.Location.Distance = distance
+		sellers = append(sellers, Seller{User: *found, Offers: offers})
+	}
+	sort.SliceStable(sellers, func(i, j int) bool {
+		return sellers[i].Location.Distance < sellers[j].Location.Distance
+	})
+	return sellers, nil
+}
+
+// FindOrCreateProduct finds a product or creates a new one.
+func (ms *MemoryStore) FindOrCreateProduct(name string) (*Product, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	for _, product := range ms.products {
+		if product.Name == name {
+			found := *product
+			return &found, nil
+		}
+	}
+	product := &Product{ID: primitive.NewObjectID(), Name: name}
+	ms.products = append(ms.products, product)
+	created := *product
+	return &created, nil
+}
+
+// ProductByID looks for a product by its ID.
+func (ms *MemoryStore) ProductByID(id primitive.ObjectID) (*Product, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	for _, product := range ms.products {
+		if product.ID == id {
+			found := *product
+			return &found, nil
+		}
+	}
+	return nil, nil
+}
+
+// Products returns all products.
+func (ms *MemoryStore) Products() ([]Product, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	products := make([]Product, len(ms.products))
+	for index, product := range ms.products {
+		products[index] = *product
+	}
+	return products, nil
+}
+
+// CreateMassOffer creates a new offer based on a specific mass.
+func (ms *MemoryStore) CreateMassOffer(user primitive.ObjectID, product primitive.ObjectID,
+	price float64, mass float64, expires time.Time) (*Offer, error) {
+	return ms.createOffer(&Offer{Product: product, Seller: user, Price: price, Mass: mass,
+		NormalizedPrice: price / mass, Expires: expires})
+}
+
+// CreateUnitOffer creates a new offer based on a number of units to sell.
+func (ms *MemoryStore) CreateUnitOffer(user primitive.ObjectID, product primitive.ObjectID,
+	price float64, units uint64, expires time.Time) (*Offer, error) {
+	return ms.createOffer(&Offer{Product: product, Seller: user, Price: price, Units: units,
+		NormalizedPrice: price / float64(units), Expires: expires})
+}
+
+// createOffer stores an open offer located at the current location of its seller.
+func (ms *MemoryStore) createOffer(offer *Offer) (*Offer, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	offer.ID = primitive.NewObjectID()
+	offer.Location = ms.sellerLocation(offer.Seller)
+	offer.Status = OfferOpen
+	offer.Created = time.Now().UTC()
+	ms.offers = append(ms.offers, offer)
+	created := *offer
+	return &created, nil
+}
+
+// closed returns whether an offer was closed.
+func closed(offer *Offer) bool {
+	for _, status := range closedOffers {
+		if offer.Status == status {
+			return true
+		}
+	}
+	return false
+}
+
+// available returns whether an offer can be traded at a point in time.
+func available(offer *Offer, now time.Time) bool {
+	return !closed(offer) && (offer.Expires.IsZero() || offer.Expires.After(now))
+}
+
+// updateStatus updates the status of an offer after its mass or units changed.
+func updateStatus(offer *Offer) {
+	if offer.Mass <= 0 && offer.Units == 0 {
+		if offer.Status == OfferOpen || offer.Status == OfferPartiallyFilled {
+			offer.Status = OfferSoldOut
+			offer.Closed = time.Now().UTC()
+		}
+	} else if offer.Status == OfferOpen || offer.Status == OfferSoldOut {
+		offer.Status = OfferPartiallyFilled
+		offer.Closed = time.Time{}
+	}
+}
+
+// sellerLocation returns the current location of a seller for a new offer.
+func (ms *MemoryStore) sellerLocation(id primitive.ObjectID) *GeoJSON {
+	seller := ms.user(id)
+	if seller == nil || seller.Location == nil {
+		return nil
+	}
+	location := MakeGeoJSONPnt(seller.Location.Coords[1], seller.Location.Coords[0])
+	return &location
+}
+
+// FindOffers finds the mass or unit offers of a product with a normalized price not above the
+// given one, located within a range in meters, cheapest first. The distance of each offer is
+// stored in its location.
+func (ms *MemoryStore) FindOffers(product primitive.ObjectID, units bool, price float64, lat float64,
+	lng float64, dist float64) ([]Offer, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	var offers []Offer
+	for _, offer := range ms.offers {
+		if offer.Product != product || offer.NormalizedPrice > price || offer.Location == nil ||
+			(units && offer.Units == 0) || (!units && offer.Mass <= 0) || !available(offer, time.Now()) {
+			continue
+		}
+		distance := Haversine(lat, lng, offer.Location.Coords[1], offer.Location.Coords[0])
+		if distance > dist {
+			continue
+		}
+		found := *offer
+		location := *offer.Location
+		location.Distance = distance
+		found.Location = &location
+		offers = append(offers, found)
+	}
+	sort.SliceStable(offers, func(i, j int) bool {
+		return offers[i].NormalizedPrice < offers[j].NormalizedPrice
+	})
+	return offers, nil
+}
+
+// ReserveOffer atomically finds an offer with at least the traded quantity at a normalized price
+// not above the bid, reduces it and records the trade at the price of the offer.
+func (ms *MemoryStore) ReserveOffer(trade *Trade) (*Offer, *User, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	for _, offer := range ms.offers {
+		if offer.Product != trade.Product || (!trade.Offer.IsZero() && offer.ID != trade.Offer) ||
+			!available(offer, now) {
+			continue
+		}
+		if trade.Units > 0 {
+			if offer.Units < trade.Units || offer.NormalizedPrice > trade.Price/float64(trade.Units) {
+				continue
+			}
+			offer.Units -= trade.Units
+		} else {
+			if offer.Mass < trade.Mass || offer.NormalizedPrice > trade.Price/trade.Mass {
+				continue
+			}
+			offer.Mass -= trade.Mass
+		}
+		updateStatus(offer)
+
+		seller := ms.user(offer.Seller)
+		if seller == nil {
+			return nil, nil, errors.New("Unknown seller")
+		}
+		trade.ID = primitive.NewObjectID()
+		trade.Created = now
+		trade.Price = tradePrice(offer, trade)
+		trade.Offer = offer.ID
+		trade.Seller = offer.Seller
+		trade.Location = offer.Location
+		if trade.Status == "" {
+			trade.Status = TradeCompleted
+		}
+		stored := *trade
+		ms.trades = append(ms.trades, &stored)
+		found := *offer
+		return &found, copyUser(seller), nil
+	}
+
+	return nil, nil, nil
+}
+
+// trade returns the stored trade with the given ID.
+func (ms *MemoryStore) trade(id primitive.ObjectID) *Trade {
+	for _, trade := range ms.trades {
+		if trade.ID == id {
+			return trade
+		}
+	}
+	return nil
+}
+
+// TradeByID looks for a trade by its ID.
+func (ms *MemoryStore) TradeByID(id primitive.ObjectID) (*Trade, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if trade := ms.trade(id); trade != nil {
+		found := *trade
+		return &found, nil
+	}
+	return nil, nil
+}
+
+// SetTradeStatus changes the status of a trade if it still has the expected status.
+func (ms *MemoryStore) SetTradeStatus(trade *Trade, from string, to string) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	stored := ms.trade(trade.ID)
+	if stored == nil || stored.Status != from {
+		return false, nil
+	}
+	stored.Status = to
+	trade.Status = to
+	return true, nil
+}
+
+// ReleaseOffer returns the reserved mass or units of a trade to its offer. Sold out offers become
+// partially filled again.
+func (ms *MemoryStore) ReleaseOffer(trade *Trade) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if offer := ms.offer(trade.Offer); offer != nil {
+		offer.Mass += trade.Mass
+		offer.Units += trade.Units
+		updateStatus(offer)
+	}
+	return nil
+}
+
+// RecoverReservations does nothing, since offers are reduced and trades recorded at once.
+func (ms *MemoryStore) RecoverReservations(before time.Time) error {
+	return nil
+}
+
+// SellerOffers returns the available offers of a seller, oldest first.
+func (ms *MemoryStore) SellerOffers(seller primitive.ObjectID) ([]Offer, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	var offers []Offer
+	for _, offer := range ms.offers {
+		if offer.Seller == seller && available(offer, time.Now()) {
+			offers = append(offers, *offer)
+		}
+	}
+	sort.SliceStable(offers, func(i, j int) bool {
+		return offers[i].Created.Before(offers[j].Created)
+	})
+	return offers, nil
+}
+
+// UpdateOffer changes the price and quantity of an available offer of a seller, unless its mass
+// or units changed since it was read. It returns whether the offer was changed.
+func (ms *MemoryStore) UpdateOffer(offer *Offer, price float64, mass float64, units uint64) (bool,
+	error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	stored := ms.offer(offer.ID)
+	if stored == nil || stored.Seller != offer.Seller || !available(stored, time.Now()) ||
+		stored.Mass != offer.Mass || stored.Units != offer.Units {
+		return false, nil
+	}
+	stored.Price = price
+	if stored.Units > 0 {
+		stored.Units = units
+		stored.NormalizedPrice = price / float64(units)
+	} else {
+		stored.Mass = mass
+		stored.NormalizedPrice = price / mass
+	}
+	return true, nil
+}
+
+// WithdrawOffer closes an available offer of a seller. Reservations of pending trades are not
+// affected. It returns whether the offer was withdrawn.
+func (ms *MemoryStore) WithdrawOffer(offer *Offer) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	stored := ms.offer(offer.ID)
+	if stored == nil || stored.Seller != offer.Seller || !available(stored, time.Now()) {
+		return false, nil
+	}
+	stored.Status = OfferWithdrawn
+	stored.Closed = time.Now().UTC()
+	return true, nil
+}
+
+// ExpireOffers closes all available offers whose expiry date passed and returns them.
+func (ms *MemoryStore) ExpireOffers(now time.Time) ([]Offer, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	var expired []Offer
+	for _, offer := range ms.offers {
+		if closed(offer) || offer.Expires.IsZero() || offer.Expires.After(now) {
+			continue
+		}
+		offer.Status = OfferExpired
+		offer.Closed = now
+		expired = append(expired, *offer)
+	}
+	return expired, nil
+}
+
+// ArchiveOffers moves all offers which were closed before a point in time out of the offers. It
+// returns the number of archived offers.
+func (ms *MemoryStore) ArchiveOffers(before time.Time) (int, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	var offers []*Offer
+	for _, offer := range ms.offers {
+		if closed(offer) && offer.Closed.Before(before) {
+			ms.archived = append(ms.archived, offer)
+		} else {
+			offers = append(offers, offer)
+		}
+	}
+	archived := len(ms.offers) - len(offers)
+	ms.offers = offers
+	return archived, nil
+}
+
+// StaleTrades returns all trades with a status which were created before a point in time.
+func (ms *MemoryStore) StaleTrades(status string, before time.Time) ([]Trade, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	var trades []Trade
+	for _, trade := range ms.trades {
+		if trade.Status == status && trade.Created.Before(before) {
+			trades = append(trades, *trade)
+		}
+	}
+	return trades, nil
+}
+
+// SellerTrades returns the trades of a seller with a status, oldest first.
+func (ms *MemoryStore) SellerTrades(seller primitive.ObjectID, status string) ([]Trade, error) {
+	return ms.partyTrades(func(trade *Trade) bool { return trade.Seller == seller && trade.Status == status })
+}
+
+// BuyerTrades returns the trades of a buyer with a status, oldest first.
+func (ms *MemoryStore) BuyerTrades(buyer primitive.ObjectID, status string) ([]Trade, error) {
+	return ms.partyTrades(func(trade *Trade) bool { return trade.Buyer == buyer && trade.Status == status })
+}
+
+// partyTrades returns the trades matching a filter, oldest first.
+func (ms *MemoryStore) partyTrades(filter func(trade *Trade) bool) ([]Trade, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	var trades []Trade
+	for _, trade := range ms.trades {
+		if filter(trade) {
+			trades = append(trades, *trade)
+		}
+	}
+	return trades, nil
+}
+
+// TradesByUser returns the latest trades with a status in which a user was buyer or seller.
+func (ms *MemoryStore) TradesByUser(user primitive.ObjectID, status string, limit int64) ([]Trade, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	var trades []Trade
+	for index := len(ms.trades) - 1; index >= 0 && int64(len(trades)) < limit; index-- {
+		if (ms.trades[index].Buyer == user || ms.trades[index].Seller == user) && ms.trades[index].Status == status {
+			trades = append(trades, *ms.trades[index])
+		}
+	}
+	return trades, nil
+}
+
+// OfferPrices returns the normalized prices of the available mass or unit offers of a product
+// which were created since a point in time within a radius around a geo point.
+func (ms *MemoryStore) OfferPrices(query PriceQuery) ([]float64, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	var prices []float64
+	for _, offer := range ms.offers {
+		if offer.Product != query.Product || offer.Created.Before(query.Since) || !available(offer, time.Now()) ||
+			(query.Units && offer.Units == 0) || (!query.Units && offer.Mass <= 0) || !query.covers(offer.Location) {
+			continue
+		}
+		prices = append(prices, offer.NormalizedPrice)
+	}
+	return prices, nil
+}
+
+// TradePrices returns the normalized prices of the completed mass or unit trades of a product
+// since a point in time within a radius around a geo point.
+func (ms *MemoryStore) TradePrices(query PriceQuery) ([]float64, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	var prices []float64
+	for _, trade := range ms.trades {
+		if trade.Product != query.Product || trade.Status != TradeCompleted || trade.Created.Before(query.Since) ||
+			!query.covers(trade.Location) {
+			continue
+		}
+		if query.Units && trade.Units > 0 {
+			prices = append(prices, trade.Price/float64(trade.Units))
+		} else if !query.Units && trade.Mass > 0 {
+			prices = append(prices, trade.Price/trade.Mass)
+		}
+	}
+	return prices, nil
+}
+
+// SavePriceSnapshot stores a price snapshot, replacing the snapshot of the same product, day and
+// pricing.
+func (ms *MemoryStore) SavePriceSnapshot(snapshot *PriceSnapshot) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	stored := *snapshot
+	for index, existing := range ms.history {
+		if existing.Product == snapshot.Product && existing.Day.Equal(snapshot.Day) && existing.Units == snapshot.Units {
+			stored.ID = existing.ID
+			snapshot.ID = existing.ID
+			ms.history[index] = &stored
+			return nil
+		}
+	}
+	stored.ID = primitive.NewObjectID()
+	snapshot.ID = stored.ID
+	ms.history = append(ms.history, &stored)
+	return nil
+}
+
+// PriceHistory returns the price snapshots of a product per gram or per unit since a day, oldest
+// first.
+func (ms *MemoryStore) PriceHistory(product primitive.ObjectID, units bool, since time.Time) ([]PriceSnapshot, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	var history []PriceSnapshot
+	for _, snapshot := range ms.history {
+		if snapshot.Product == product && snapshot.Units == units && !snapshot.Day.Before(since) {
+			history = append(history, *snapshot)
+		}
+	}
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].Day.Before(history[j].Day)
+	})
+	return history, nil
+}
+
+// CreateOrder stores a new open standing buy order.
+func (ms *MemoryStore) CreateOrder(order *Order) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	order.ID = primitive.NewObjectID()
+	order.Status = OrderOpen
+	order.Created = time.Now().UTC().Truncate(time.Millisecond)
+	stored := *order
+	ms.orders = append(ms.orders, &stored)
+	return nil
+}
+
+// FindOrders finds the open mass or unit orders of a product with a normalized price not below the
+// given one, located within a range in meters, oldest first.
+func (ms *MemoryStore) FindOrders(product primitive.ObjectID, units bool, price float64, lat float64,
+	lng float64, dist float64) ([]Order, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	now := time.Now()
+	var orders []Order
+	for _, order := range ms.orders {
+		if order.Product != product || order.NormalizedPrice < price || order.Location == nil ||
+			order.Status != OrderOpen || (!order.Expires.IsZero() && !order.Expires.After(now)) ||
+			(units && order.Units == 0) || (!units && order.Mass <= 0) {
+			continue
+		}
+		distance := Haversine(lat, lng, order.Location.Coords[1], order.Location.Coords[0])
+		if distance > dist {
+			continue
+		}
+		found := *order
+		location := *order.Location
+		location.Distance = distance
+		found.Location = &location
+		orders = append(orders, found)
+	}
+	return orders, nil
+}
+
+// BuyerOrders returns the open orders of a buyer, oldest first.
+func (ms *MemoryStore) BuyerOrders(buyer primitive.ObjectID) ([]Order, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	var orders []Order
+	for _, order := range ms.orders {
+		if order.Buyer == buyer && order.Status == OrderOpen {
+			orders = append(orders, *order)
+		}
+	}
+	return orders, nil
+}
+
+// SetOrderStatus changes the status of an order if it still has the expected status. It returns
+// whether the status was changed.
+func (ms *MemoryStore) SetOrderStatus(order *Order, from string, to string) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	for _, stored := range ms.orders {
+		if stored.ID == order.ID {
+			if stored.Status != from {
+				return false, nil
+			}
+			stored.Status = to
+			order.Status = to
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount in a currency given by its ISO 4217 code.
+type Money struct {
+	Amount   float64
+	Currency string
+}
+
+// Currency describes how amounts of a currency are written.
+type Currency struct {
+	Code     string
+	Decimals int
+	// Format formats the amount with the currency symbol, e.g. "%s FCFA".
+	Format  string
+	Aliases []string
+}
+
+// Currencies converts and formats amounts of money. Prices are stored in the Default currency.
+type Currencies struct {
+	Default string
+	Known   []Currency
+	// Rates maps currency codes to their value in a common reference unit.
+	Rates map[string]float64
+}
+
+// NewCurrencies initializes the currencies used in Cameroon with the given default currency. The
+// reference unit of the rates is the CFA franc, which is pegged to the euro.
+func NewCurrencies(defaultCurrency string) *Currencies {
+	return &Currencies{
+		Default: strings.ToUpper(defaultCurrency),
+		Known: []Currency{
+			{"XAF", 0, "%s FCFA", []string{"fcfa", "f cfa", "cfa", "xaf", "francs", "franc", "frs", "fr", "f"}},
+			{"USD", 2, "%s$", []string{"$", "dollars", "dollar", "usd", "bucks"}},
+			{"EUR", 2, "%s€", []string{"€", "euros", "euro", "eur"}},
+			{"NGN", 0, "%s NGN", []string{"₦", "naira", "ngn"}},
+		},
+		Rates: map[string]float64{"XAF": 1, "EUR": 655.957, "USD": 600, "NGN": 0.4},
+	}
+}
+
+// Lookup looks up a currency by its code, symbol or name.
+func (c *Currencies) Lookup(word string) *Currency {
+	word = strings.ToLower(strings.Join(strings.Fields(word), " "))
+	for index := range c.Known {
+		currency := &c.Known[index]
+		if word == strings.ToLower(currency.Code) {
+			return currency
+		}
+		for _, alias := range currency.Aliases {
+			if word == alias {
+				return currency
+			}
+		}
+	}
+	return nil
+}
+
+// SetRates parses a rate table like "USD=600,EUR=655.957" and updates the rates of the given
+// currencies.
+func (c *Currencies) SetRates(table string) error {
+	for _, entry := range strings.Split(table, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Invalid exchange rate %s", entry)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || rate <= 0 {
+			return fmt.Errorf("Invalid exchange rate %s", entry)
+		}
+		c.Rates[strings.ToUpper(strings.TrimSpace(parts[0]))] = rate
+	}
+	return nil
+}
+
+// Convert converts money into the default currency. Amounts without currency are taken as
+// default currency. It returns false if there is no exchange rate for the currency.
+func (c *Currencies) Convert(money Money) (float64, bool) {
+	code := strings.ToUpper(money.Currency)
+	if code == "" || code == c.Default {
+		return money.Amount, true
+	}
+	from, ok := c.Rates[code]
+	to, okDefault := c.Rates[c.Default]
+	if !ok || !okDefault {
+		return 0, false
+	}
+	return money.Amount * from / to, true
+}
+
+// Format formats an amount of the default currency, e.g. "1500 FCFA". Amounts below one unit of
+// currencies without decimals are shown with two decimals, e.g. prices per gram.
+func (c *Currencies) Format(amount float64) string {
+	currency := c.Lookup(c.Default)
+	if currency == nil {
+		return strconv.FormatFloat(amount, 'f', 2, 64) + " " + c.Default
+	}
+	decimals := currency.Decimals
+	if decimals == 0 && amount != 0 && math.Abs(amount) < 1 {
+		decimals = 2
+	}
+	return fmt.Sprintf(currency.Format, strconv.FormatFloat(amount, 'f', decimals, 64))
+}
+
+// Example formats a typical price given in dollars in the default currency for usage examples,
+// rounded to a whole number.
+func (c *Currencies) Example(dollars float64) string {
+	amount, ok := c.Convert(Money{dollars, "USD"})
+	if !ok {
+		amount = dollars
+	}
+	currency := c.Lookup(c.Default)
+	if currency == nil {
+		return c.Format(math.Round(amount))
+	}
+	return fmt.Sprintf(currency.Format, strconv.FormatFloat(math.Round(amount), 'f', -1, 64))
+}
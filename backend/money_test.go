@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCurrenciesConvert(t *testing.T) {
+	currencies := NewCurrencies("XAF")
+	mustNil(t, currencies.SetRates("USD=610, eur=655.957"))
+	cases := []struct {
+		Money    Money
+		Expected float64
+		OK       bool
+	}{
+		{Money{1500, "XAF"}, 1500, true},
+		{Money{1500, ""}, 1500, true},
+		{Money{3, "USD"}, 1830, true},
+		{Money{2, "EUR"}, 1311.914, true},
+		{Money{5, "GBP"}, 0, false},
+	}
+	for _, c := range cases {
+		if converted, ok := currencies.Convert(c.Money); converted != c.Expected || ok != c.OK {
+			t.Errorf("expected %v to be %v XAF (%v), got %v (%v)", c.Money, c.Expected, c.OK, converted, ok)
+		}
+	}
+
+	if err := currencies.SetRates("USD:600"); err == nil {
+		t.Error("expected error for invalid rate table")
+	}
+}
+
+func TestCurrenciesFormat(t *testing.T) {
+	cases := []struct {
+		Currency string
+		Amount   float64
+		Expected string
+	}{
+		{"XAF", 1500, "1500 FCFA"},
+		{"XAF", 1499.6, "1500 FCFA"},
+		{"XAF", 0.36, "0.36 FCFA"},
+		{"USD", 3, "3.00$"},
+		{"EUR", 2.5, "2.50€"},
+		{"GBP", 4, "4.00 GBP"},
+	}
+	for _, c := range cases {
+		if formatted := NewCurrencies(c.Currency).Format(c.Amount); formatted != c.Expected {
+			t.Errorf("expected %q, got %q", c.Expected, formatted)
+		}
+	}
+}
+
+func TestRuleMoney(t *testing.T) {
+	rc := NewRuleClassifier()
+	cases := []struct {
+		Message string
+		Price   Money
+		Product string
+	}{
+		{"sell 5kg cassava for 1500 FCFA", Money{1500, "XAF"}, "cassava"},
+		{"I sell 10 plantains for 2000f", Money{2000, "XAF"}, "plantains"},
+		{"buy 2kg tomatoes at 800 francs", Money{800, "XAF"}, "tomatoes"},
+		{"buy 3kg rice for 5€", Money{5, "EUR"}, "rice"},
+		{"sell 5kg cassava for $3.50", Money{3.5, "USD"}, "cassava"},
+		{"sell 5kg cassava for 1,500 FCFA", Money{1500, "XAF"}, "cassava"},
+		{"sell 5kg cassava for 1.500 FCFA", Money{1500, "XAF"}, "cassava"},
+		{"sell 5kg cassava for 1 500 FCFA", Money{1500, "XAF"}, "cassava"},
+		{"sell 2 bags of maize for 25.000f", Money{25000, "XAF"}, "maize"},
+		{"buy 3 bags of maize for 1 250 000 frs", Money{1250000, "XAF"}, "maize"},
+		{"sell 1kg pepper for 0.50 FCFA", Money{0.5, "XAF"}, "pepper"},
+		{"sell 2kg rice for 2,5€", Money{2.5, "EUR"}, "rice"},
+		{"sell 2kg rice for 1,500$", Money{1.5, "USD"}, "rice"},
+		{"sell 20 eggs for 2000", Money{2000, ""}, "eggs"},
+		{"buy 2kg tomatoes at 1.500", Money{1500, ""}, "tomatoes"},
+		{"sell 20 eggs for 2 500", Money{2500, ""}, "eggs"},
+		{"sell eggs for 2 weeks", Money{}, "eggs"},
+	}
+	for _, c := range cases {
+		intent, err := rc.Intent(c.Message)
+		if err != nil || intent.Price != c.Price || intent.Product != c.Product {
+			t.Errorf("unexpected intent of %q: %+v, %v", c.Message, intent, err)
+		}
+	}
+}
+
+func TestCAIMoney(t *testing.T) {
+	fake := NewFakeCAI([]CAIFixture{
+		{Text: "sell 20 eggs for 2000", Intent: "sell", Entities: map[string][]caiEntity{
+			"money": {{Amount: 2000, Scalar: 2000, Raw: "2000"}}}},
+		{Text: "sell 20 eggs for 3$", Intent: "sell", Entities: map[string][]caiEntity{
+			"money": {{Amount: 3, Currency: "USD", Dollars: 3, Scalar: 3, Raw: "3$"}}}},
+	})
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	cai := NewCAI("token")
+	cai.Endpoint = server.URL
+
+	cases := []struct {
+		Message string
+		Price   Money
+	}{
+		{"sell 20 eggs for 2000", Money{2000, ""}},
+		{"sell 20 eggs for 3$", Money{3, "USD"}},
+	}
+	for _, c := range cases {
+		intent, err := cai.Intent(c.Message)
+		if err != nil || intent.Price != c.Price {
+			t.Errorf("unexpected intent of %q: %+v, %v", c.Message, intent, err)
+		}
+	}
+}
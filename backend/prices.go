@@ -0,0 +1,63 @@
+package main
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sort"
+	"time"
+)
+
+// PriceQuery selects the normalized prices of a product for market price statistics, either per
+// gram or per unit. Only prices since a point in time and within a radius in meters around a geo
+// point are considered. A radius of zero considers prices everywhere.
+type PriceQuery struct {
+	Product primitive.ObjectID
+	Units   bool
+	Since   time.Time
+	Lat     float64
+	Lng     float64
+	Radius  float64
+}
+
+// covers returns whether a location lies within the radius of the query. Without a radius, all
+// locations are covered, otherwise unknown locations are not.
+func (query PriceQuery) covers(location *GeoJSON) bool {
+	if query.Radius <= 0 {
+		return true
+	}
+	return location != nil && Haversine(query.Lat, query.Lng, location.Coords[1], location.Coords[0]) <= query.Radius
+}
+
+// PriceStats summarizes normalized prices.
+type PriceStats struct {
+	Count  int     `bson:"count"`
+	Median float64 `bson:"median"`
+	Min    float64 `bson:"min"`
+	Max    float64 `bson:"max"`
+}
+
+// PriceSnapshot records the market prices of a product per gram or per unit on a day. The prices
+// are taken from the completed trades of the previous 24 hours, or from the available offers if
+// there were no trades.
+type PriceSnapshot struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	Product    primitive.ObjectID `bson:"product"`
+	Day        time.Time          `bson:"day"`
+	Units      bool               `bson:"units"`
+	Source     string             `bson:"source"`
+	PriceStats `bson:",inline"`
+}
+
+// NewPriceStats computes the statistics of normalized prices. It returns nil without prices.
+func NewPriceStats(prices []float64) *PriceStats {
+	if len(prices) == 0 {
+		return nil
+	}
+	sorted := append([]float64(nil), prices...)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	median := sorted[middle]
+	if len(sorted)%2 == 0 {
+		median = (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return &PriceStats{Count: len(sorted), Median: median, Min: sorted[0], Max: sorted[len(sorted)-1]}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNewPriceStats(t *testing.T) {
+	cases := []struct {
+		Prices   []float64
+		Expected *PriceStats
+	}{
+		{nil, nil},
+		{[]float64{3}, &PriceStats{Count: 1, Median: 3, Min: 3, Max: 3}},
+		{[]float64{4, 1, 3}, &PriceStats{Count: 3, Median: 3, Min: 1, Max: 4}},
+		{[]float64{5, 1, 2, 9}, &PriceStats{Count: 4, Median: 3.5, Min: 1, Max: 9}},
+	}
+	for _, c := range cases {
+		stats := NewPriceStats(c.Prices)
+		if (stats == nil) != (c.Expected == nil) || stats != nil && *stats != *c.Expected {
+			t.Errorf("expected stats %+v of %v, got %+v", c.Expected, c.Prices, stats)
+		}
+	}
+}
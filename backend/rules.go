@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// IntentRule maps a message pattern to an intent slug.
+type IntentRule struct {
+	Slug    string
+	Pattern *regexp.Regexp
+}
+
+// Place is a well-known location which can be resolved without a geocoding service.
+type Place struct {
+	Name string
+	Lat  float64
+	Lng  float64
+}
+
+// RuleClassifier is an offline intent classifier based on a keyword and regular expression
+// grammar. It produces the same intents and entities as the SAP CAI project.
+type RuleClassifier struct {
+	Rules      []IntentRule
+	Places     map[string]Place
+	Products   []string
+	Units      *Units
+	Currencies *Currencies
+}
+
+// ruleAmount matches an amount of money, either with thousands grouped by commas, dots or spaces
+// like "1 500" or as a decimal number like "2,5".
+const ruleAmount = `(\d{1,3}(?:[ .,]\d{3})+|\d+(?:[.,]\d+)?)`
+
+var (
+	ruleCoords    = regexp.MustCompile(`(-?\d{1,2}\.\d+)\s*,\s*(-?\d{1,3}\.\d+)`)
+	ruleMoney     = regexp.MustCompile(`(?i)(?:([$€₦])\s*` + ruleAmount + `)|(?:` + ruleAmount + `\s*(\$|€|₦|dollars?\b|usd\b|bucks\b|euros?\b|eur\b|naira\b|ngn\b|f\s?cfa\b|cfa\b|xaf\b|francs?\b|frs?\b|f\b))`)
+	ruleBareMoney = regexp.MustCompile(`(?i)\b(?:for|at)\s+` + ruleAmount + `(\s*\pL+)?`)
+	ruleGroups    = regexp.MustCompile(`^\d{1,3}(?:[.,]\d{3})+$`)
+	ruleMass      = regexp.MustCompile(`(?i)(\d+(?:[.,]\d+)?)\s*(kg|kgs|kilos?|kilograms?|g|grams?|t|tons?|tonnes?)\b`)
+	ruleNumber    = regexp.MustCompile(`\b(\d+)\b`)
+	ruleMeasure   = regexp.MustCompile(`(?i)(?:(\d+(?:[.,]\d+)?)\s*|\b(?:an?|one)\s+)(\pL+)`)
+	ruleQuantity  = regexp.MustCompile(`(?i)\b\d+\s+(?:of\s+)?([a-z]+)`)
+	ruleSubject   = regexp.MustCompile(`(?i)\b(?:trends? of|price of|prices of|price for|cost of|much is|much are|much for)\s+(?:a\s+|the\s+)?([a-z]+)`)
+	ruleName      = regexp.MustCompile(`(?i)\b(?:my name is|my name's|call me|i am|i'm|this is)\s+([a-z][a-z'\-]*(?:\s+[a-z][a-z'\-]*){0,3})`)
+	ruleBareName  = regexp.MustCompile(`(?i)^\s*([a-z][a-z'\-]*(?:\s+[a-z][a-z'\-]*){0,2})\s*[.!]?\s*$`)
+	ruleWithdraw  = regexp.MustCompile(`(?i)\b(withdraw|remove|delete|cancel|stop)\b.*\boffers?\b`)
+	ruleUpdate    = regexp.MustCompile(`(?i)\b(change|update|edit|modify|set)\b.*\boffers?\b`)
+	ruleNewName   = regexp.MustCompile(`(?i)\bname\s+(?:to|is now|is)\s+([a-z][a-z'\-]*(?:\s+[a-z][a-z'\-]*){0,3})`)
+	ruleOfferRef  = regexp.MustCompile(`(?i)\b(?:offers?|number|no\.?)\s*#?\s*(\d+)\b|#\s*(\d+)\b`)
+)
+
+// NewRuleClassifier initializes a rule-based classifier with the default grammar.
+func NewRuleClassifier() *RuleClassifier {
+	return &RuleClassifier{
+		Rules: []IntentRule{
+			{"withdraw_offer", ruleWithdraw},
+			{"delete_account", regexp.MustCompile(`(?i)\b(delete|remove|close)\b.*\b(account|profile)\b`)},
+			{"update_offer", ruleUpdate},
+			{"my_offers", regexp.MustCompile(`(?i)\b(my offers|list offers|show offers|offers of mine)\b`)},
+			{"unsubscribe_farmers", regexp.MustCompile(`(?i)\b(stop|unsubscribe|no more|disable|turn off)\b.*\b(alerts?|notifications?|farmers?)\b`)},
+			{"subscribe_farmers", regexp.MustCompile(`(?i)\b(notify|alert|subscribe)\b.*\b(farmers?|alerts?)\b|\b(enable|turn on|start)\b.*\balerts?\b`)},
+			{"change_name", regexp.MustCompile(`(?i)\b(change|update|correct|fix)\b.*\bmy name\b|\bmy new name\b`)},
+			{"change_location", regexp.MustCompile(`(?i)\b(moved|relocated|new address|new location)\b|\b(change|update)\b.*\b(location|address)\b`)},
+			{"become_farmer", regexp.MustCompile(`(?i)\b(switch|change|become|be|turn)\b.*\b(farmer|seller|producer|grower)\b`)},
+			{"become_consumer", regexp.MustCompile(`(?i)\b(switch|change|become|be|turn)\b.*\b(consumer|buyer|customer|client)\b`)},
+			{"pos_list", regexp.MustCompile(`(?i)\b(near|nearby|around|close to me|neighbou?rhood)\b`)},
+			{"price-trend", regexp.MustCompile(`(?i)\b(trend|trends|tendance|going up|going down|rising|falling)\b`)},
+			{"price-question", regexp.MustCompile(`(?i)\b(price|prices|cost|costs|how much|worth)\b`)},
+			{"history", regexp.MustCompile(`(?i)\b(history|my trades|my purchases|my sales|what did i (buy|sell|sold))\b`)},
+			{"sell", regexp.MustCompile(`(?i)\b(sell|selling|offer|offering)\b`)},
+			{"buy", regexp.MustCompile(`(?i)\b(buy|buying|purchase|need|want)\b`)},
+			{"get_type_farmer", regexp.MustCompile(`(?i)\b(farmer|grower|producer|vendor)\b`)},
+			{"get_type_buyer", regexp.MustCompile(`(?i)\b(consumer|customer|buyer|client)\b`)},
+			{"get_location", regexp.MustCompile(`(?i)\b(i live|live in|living in|located|address|i am from|i'm from)\b`)},
+			{"get_name", ruleName},
+			{"greetings", regexp.MustCompile(`(?i)^\s*(hi|hello|hey|good (morning|afternoon|evening)|bonjour|salut)\b`)},
+		},
+		Places: map[string]Place{
+			"yaounde":    {"Yaoundé", 3.8480, 11.5021},
+			"douala":     {"Douala", 4.0511, 9.7679},
+			"bamenda":    {"Bamenda", 5.9631, 10.1591},
+			"bafoussam":  {"Bafoussam", 5.4781, 10.4176},
+			"garoua":     {"Garoua", 9.3014, 13.3977},
+			"maroua":     {"Maroua", 10.5956, 14.3247},
+			"ngaoundere": {"Ngaoundéré", 7.3277, 13.5847},
+			"bertoua":    {"Bertoua", 4.5774, 13.6846},
+			"buea":       {"Buea", 4.1527, 9.2410},
+			"limbe":      {"Limbe", 4.0242, 9.2149},
+			"kribi":      {"Kribi", 2.9373, 9.9077},
+			"ebolowa":    {"Ebolowa", 2.9000, 11.1500},
+			"kumba":      {"Kumba", 4.6363, 9.4469},
+			"dschang":    {"Dschang", 5.4500, 10.0500},
+			"edea":       {"Edéa", 3.8000, 10.1333},
+			"nkongsamba": {"Nkongsamba", 4.9547, 9.9404},
+			"foumban":    {"Foumban", 5.7267, 10.9008},
+		},
+		Products: []string{"avocado", "banana", "bean", "cabbage", "carrot", "cassava", "cocoa",
+			"coffee", "corn", "egg", "groundnut", "maize", "mango", "millet", "okra", "onion",
+			"orange", "peanut", "pepper", "pineapple", "plantain", "potato", "rice", "sorghum",
+			"tomato", "yam"},
+		Units:      NewUnits(),
+		Currencies: NewCurrencies("XAF"),
+	}
+}
+
+// Intent returns the intent of a message.
+func (rc *RuleClassifier) Intent(message string) (*Intent, error) {
+	intent := &Intent{}
+	rest := message
+
+	if match := ruleCoords.FindStringSubmatchIndex(rest); match != nil {
+		intent.Lat, _ = strconv.ParseFloat(rest[match[2]:match[3]], 64)
+		intent.Lng, _ = strconv.ParseFloat(rest[match[4]:match[5]], 64)
+		intent.Address = rest[match[0]:match[1]]
+		rest = blank(rest, match[0], match[1])
+	} else if place, ok := rc.place(message); ok {
+		intent.Lat = place.Lat
+		intent.Lng = place.Lng
+		intent.Address = place.Name
+	}
+
+	// Offer commands refer to an offer by its number, which must not be taken as quantity or
+	// product.
+	subject := message
+	if ruleWithdraw.MatchString(message) || ruleUpdate.MatchString(message) {
+		if match := ruleOfferRef.FindStringSubmatchIndex(rest); match != nil {
+			if match[2] >= 0 {
+				intent.Reference = uint(parseDecimal(rest[match[2]:match[3]]))
+			} else {
+				intent.Reference = uint(parseDecimal(rest[match[4]:match[5]]))
+			}
+			rest = blank(rest, match[0], match[1])
+			subject = blank(subject, match[0], match[1])
+		}
+	}
+
+	if match := ruleMoney.FindStringSubmatchIndex(rest); match != nil {
+		var symbol, amount string
+		if match[2] >= 0 {
+			symbol, amount = rest[match[2]:match[3]], rest[match[4]:match[5]]
+		} else {
+			amount, symbol = rest[match[6]:match[7]], rest[match[8]:match[9]]
+		}
+		currency := rc.Currencies.Lookup(symbol)
+		if currency != nil {
+			intent.Price.Currency = currency.Code
+		}
+		intent.Price.Amount = parseAmount(amount, currency)
+		rest = blank(rest, match[0], match[1])
+	} else if match := ruleBareMoney.FindStringSubmatchIndex(rest); match != nil && match[4] < 0 {
+		// Amounts without currency like "for 2000" are given in the default currency.
+		intent.Price.Amount = parseAmount(rest[match[2]:match[3]], rc.Currencies.Lookup(rc.Currencies.Default))
+		rest = blank(rest, match[0], match[1])
+	}
+
+	if match := ruleMass.FindStringSubmatchIndex(rest); match != nil {
+		intent.Mass = parseDecimal(rest[match[2]:match[3]]) * gramsPer(rest[match[4]:match[5]])
+		rest = blank(rest, match[0], match[1])
+	}
+
+	if number, measure, start, end := rc.measure(rest); measure != "" && intent.Mass == 0.0 {
+		intent.Number = number
+		intent.Measure = measure
+		rest = blank(rest, start, end)
+	} else if match := ruleNumber.FindStringSubmatch(rest); match != nil && intent.Mass == 0.0 {
+		number, _ := strconv.ParseUint(match[1], 10, 32)
+		intent.Number = uint(number)
+	}
+
+	intent.Product = rc.product(subject)
+
+	for _, rule := range rc.Rules {
+		if rule.Pattern.MatchString(message) {
+			intent.Slug = rule.Slug
+			break
+		}
+	}
+
+	if intent.Slug == "" && intent.Lat != 0.0 && intent.Lng != 0.0 {
+		intent.Slug = "get_location"
+	}
+	if intent.Slug == "get_name" {
+		intent.FullName = strings.TrimSpace(ruleName.FindStringSubmatch(message)[1])
+	} else if intent.Slug == "change_name" {
+		if match := ruleNewName.FindStringSubmatch(message); match != nil {
+			intent.FullName = strings.TrimSpace(match[1])
+		}
+	} else if intent.Slug == "" {
+		if match := ruleBareName.FindStringSubmatch(message); match != nil {
+			intent.Slug = "get_name"
+			intent.FullName = strings.TrimSpace(match[1])
+		}
+	}
+
+	if intent.Slug == "" {
+		return nil, errors.New("No intent")
+	}
+
+	return intent, nil
+}
+
+// place looks up a well-known place mentioned in the message.
+func (rc *RuleClassifier) place(message string) (Place, bool) {
+	for _, word := range strings.FieldsFunc(foldAccents(strings.ToLower(message)), isSeparator) {
+		if place, ok := rc.Places[word]; ok {
+			return place, true
+		}
+	}
+	return Place{}, false
+}
+
+// measure looks up a number followed by a measure like "2 bags" or "a crate". It returns the
+// number, the name of the measure and the position of the match.
+func (rc *RuleClassifier) measure(message string) (uint, string, int, int) {
+	if rc.Units == nil {
+		return 0, "", 0, 0
+	}
+	for _, match := range ruleMeasure.FindAllStringSubmatchIndex(message, -1) {
+		measure := rc.Units.Measure(message[match[4]:match[5]])
+		if measure == nil {
+			continue
+		}
+		number := uint(1)
+		if match[2] >= 0 {
+			number = uint(parseDecimal(message[match[2]:match[3]]))
+		}
+		return number, measure.Name, match[0], match[1]
+	}
+	return 0, "", 0, 0
+}
+
+// product looks up a known product mentioned in the message. Otherwise, the word following a
+// quantity or a price question is used.
+func (rc *RuleClassifier) product(message string) string {
+	for _, word := range strings.FieldsFunc(message, isSeparator) {
+		lower := strings.ToLower(word)
+		for _, product := range rc.Products {
+			if lower == product || lower == product+"s" || lower == product+"es" {
+				return word
+			}
+		}
+	}
+
+	stripped := ruleMoney.ReplaceAllString(message, " ")
+	stripped = ruleMass.ReplaceAllString(stripped, "1 ")
+	if _, measure, start, end := rc.measure(stripped); measure != "" {
+		stripped = stripped[:start] + "1 " + stripped[end:]
+	}
+	for _, pattern := range []*regexp.Regexp{ruleQuantity, ruleSubject} {
+		if match := pattern.FindStringSubmatch(stripped); match != nil {
+			switch strings.ToLower(match[1]) {
+			case "for", "at", "and", "to", "dollars", "dollar", "usd", "fcfa", "cfa", "francs", "frs", "units", "pieces":
+				continue
+			}
+			return match[1]
+		}
+	}
+
+	return ""
+}
+
+// gramsPer returns the number of grams of a mass unit.
+func gramsPer(unit string) float64 {
+	switch strings.ToLower(unit) {
+	case "g", "gram", "grams":
+		return 1
+	case "t", "ton", "tons", "tonne", "tonnes":
+		return 1000000
+	default:
+		return 1000
+	}
+}
+
+// parseDecimal parses a decimal number which may use a comma as decimal separator.
+func parseDecimal(value string) float64 {
+	number, _ := strconv.ParseFloat(strings.Replace(value, ",", ".", 1), 64)
+	return number
+}
+
+// parseAmount parses an amount of money in a currency. Amounts of currencies without decimals may
+// group their thousands with commas, dots or spaces, e.g. "1.500 FCFA" or "1 500 FCFA".
+func parseAmount(value string, currency *Currency) float64 {
+	value = strings.Replace(value, " ", "", -1)
+	if currency != nil && currency.Decimals == 0 && ruleGroups.MatchString(value) {
+		value = strings.NewReplacer(",", "", ".", "").Replace(value)
+	}
+	return parseDecimal(value)
+}
+
+// blank replaces a section of a string with spaces such that it is not matched again.
+func blank(s string, start int, end int) string {
+	return s[:start] + strings.Repeat(" ", end-start) + s[end:]
+}
+
+// foldAccents replaces accented characters used in Cameroonian place names.
+func foldAccents(s string) string {
+	return strings.NewReplacer("é", "e", "è", "e", "ê", "e", "à", "a", "ô", "o", "ï", "i").Replace(s)
+}
+
+// isSeparator returns whether a rune separates two words.
+func isSeparator(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '-' || r == '\'' || r > 127)
+}
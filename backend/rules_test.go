@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRuleIntents(t *testing.T) {
+	rc := NewRuleClassifier()
+	cases := []struct {
+		Message string
+		Intent  Intent
+	}{
+		{"Hello", Intent{Slug: "greetings"}},
+		{"Bonjour", Intent{Slug: "greetings"}},
+		{"My name is Amina Bello", Intent{Slug: "get_name", FullName: "Amina Bello"}},
+		{"Paul", Intent{Slug: "get_name", FullName: "Paul"}},
+		{"I live in Yaoundé", Intent{Slug: "get_location", Lat: 3.848, Lng: 11.5021, Address: "Yaoundé"}},
+		{"I am from Douala", Intent{Slug: "get_location", Lat: 4.0511, Lng: 9.7679, Address: "Douala"}},
+		{"3.848, 11.5021", Intent{Slug: "get_location", Lat: 3.848, Lng: 11.5021, Address: "3.848, 11.5021"}},
+		{"I am a farmer", Intent{Slug: "get_type_farmer"}},
+		{"consumer", Intent{Slug: "get_type_buyer"}},
+		{"sell 5kg cassava for 1500 FCFA", Intent{Slug: "sell", Product: "cassava", Mass: 5000, Price: Money{1500, "XAF"}}},
+		{"sell 500g pepper for 300f", Intent{Slug: "sell", Product: "pepper", Mass: 500, Price: Money{300, "XAF"}}},
+		{"sell 1.5kg okra for 2,5€", Intent{Slug: "sell", Product: "okra", Mass: 1500, Price: Money{2.5, "EUR"}}},
+		{"sell 20 eggs for 2000", Intent{Slug: "sell", Product: "eggs", Number: 20, Price: Money{2000, ""}}},
+		{"sell 2 tons of yams for 100000 francs", Intent{Slug: "sell", Product: "yams", Mass: 2000000, Price: Money{100000, "XAF"}}},
+		{"sell a crate of tomatoes for 3000f", Intent{Slug: "sell", Product: "tomatoes", Number: 1, Measure: "crate", Price: Money{3000, "XAF"}}},
+		{"I want to buy 2 bags of maize for 20000 FCFA", Intent{Slug: "buy", Product: "maize", Number: 2, Measure: "bag", Price: Money{20000, "XAF"}}},
+		{"price of cassava", Intent{Slug: "price-question", Product: "cassava"}},
+		{"how much are mangoes?", Intent{Slug: "price-question", Product: "mangoes"}},
+		{"is the price of maize going up?", Intent{Slug: "price-trend", Product: "maize"}},
+		{"which farmers are near me?", Intent{Slug: "pos_list"}},
+		{"who sells tomatoes near me", Intent{Slug: "pos_list", Product: "tomatoes"}},
+		{"my trades", Intent{Slug: "history"}},
+		{"my offers", Intent{Slug: "my_offers"}},
+		{"change offer 2 to 3000 FCFA", Intent{Slug: "update_offer", Reference: 2, Price: Money{3000, "XAF"}}},
+		{"withdraw offer #3", Intent{Slug: "withdraw_offer", Reference: 3}},
+		{"change my name to Jean Nkomo", Intent{Slug: "change_name", FullName: "Jean Nkomo"}},
+		{"I moved to Bamenda", Intent{Slug: "change_location", Lat: 5.9631, Lng: 10.1591, Address: "Bamenda"}},
+		{"switch to consumer", Intent{Slug: "become_consumer"}},
+		{"delete my account", Intent{Slug: "delete_account"}},
+		{"remove offer 2 from my profile", Intent{Slug: "withdraw_offer", Reference: 2}},
+		{"notify me about new farmers", Intent{Slug: "subscribe_farmers"}},
+		{"stop farmer alerts", Intent{Slug: "unsubscribe_farmers"}},
+		{"turn on farmer alerts", Intent{Slug: "subscribe_farmers"}},
+		{"Can you tell me which farmers are near me?", Intent{Slug: "pos_list"}},
+		{"tell me the farmers nearby", Intent{Slug: "pos_list"}},
+	}
+	for _, c := range cases {
+		intent, err := rc.Intent(c.Message)
+		if err != nil || *intent != c.Intent {
+			t.Errorf("expected intent of %q to be %+v, got %+v, %v", c.Message, c.Intent, intent, err)
+		}
+	}
+
+	if intent, err := rc.Intent("???"); err == nil {
+		t.Errorf("expected no intent, got %+v", intent)
+	}
+}
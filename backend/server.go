@@ -2,23 +2,46 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
-	"github.com/go-telegram-bot-api/telegram-bot-api"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 )
 
 func main() {
-	log.Printf("Starting Chat4Bread Backend.")
+	command := "serve"
+	if len(os.Args) > 1 {
+		command = os.Args[1]
+	}
+
+	switch command {
+	case "serve":
+		serve()
+	case "simulate":
+		simulate(os.Args[2:])
+	case "fake-cai":
+		fakeCAI(os.Args[2:])
+	case "migrate-prices":
+		migratePrices(os.Args[2:])
+	default:
+		log.Fatalf("Unknown command %s, use serve, simulate, fake-cai or migrate-prices.", command)
+	}
+}
 
-	// Connect with MongoDB
-	ctx, _ := context.WithTimeout(context.Background(), 30*time.Second)
-	dburi := fmt.Sprintf("mongodb://%s:%s@database:27017", os.Getenv("MONGO_USERNAME"), os.Getenv("MONGO_PASSWORD"))
+// connectORM connects with the MongoDB database given by MONGO_URI or the docker-compose setup.
+func connectORM() *ORM {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	dburi := os.Getenv("MONGO_URI")
+	if dburi == "" {
+		dburi = fmt.Sprintf("mongodb://%s:%s@database:27017", os.Getenv("MONGO_USERNAME"), os.Getenv("MONGO_PASSWORD"))
+	}
 	log.Printf("Connecting to MongoDB database: %s.", dburi)
 	db, err := mongo.Connect(ctx, options.Client().ApplyURI(dburi))
 	if err != nil {
@@ -31,69 +54,212 @@ func main() {
 
 	log.Printf("Connected to MongoDB database.")
 
-	// Setup state machine
 	orm := NewORM(db, "chat4bread")
 	err = orm.CreateIndicies()
 	if err != nil {
 		log.Panic(err)
 	}
-
-	cai := NewCAI(os.Getenv("CAI_TOKEN"))
-	machine := NewMachine(orm, cai)
-
-	// Connect with Telegram
-	bot, err := tgbotapi.NewBotAPI(os.Getenv("TELEGRAM_TOKEN"))
+	err = orm.RecoverReservations(time.Now())
 	if err != nil {
 		log.Panic(err)
 	}
-	//bot.Debug = true
-	machine.SendMessage = func(id int64, message string) error {
-		msg := tgbotapi.NewMessage(id, message)
-		_, err := bot.Send(msg)
-		return err
+	err = orm.LocateOffers()
+	if err != nil {
+		log.Panic(err)
 	}
 
-	// Process messages
-	log.Printf("Authorized on Telegram bot account %s", bot.Self.UserName)
+	return orm
+}
 
-	var updates tgbotapi.UpdatesChannel
+// serve runs the chat bot.
+func serve() {
+	log.Printf("Starting Chat4Bread Backend.")
 
-	if os.Getenv("TELEGRAM_WEBHOOK_URL") == "" {
-		u := tgbotapi.NewUpdate(0)
-		u.Timeout = 60
-		updates, err = bot.GetUpdatesChan(u)
+	// Setup state machine
+	orm := connectORM()
+	nlp, err := NewIntentClassifier(os.Getenv("INTENT_CLASSIFIER"))
+	if err != nil {
+		log.Panic(err)
+	}
+	machine := NewMachine(orm, nlp)
+	machine.SellerAcceptance = os.Getenv("SELLER_ACCEPTANCE") == "true"
+	if radius := os.Getenv("MAX_DISTANCE"); radius != "" {
+		machine.MaxDistance, err = strconv.ParseFloat(radius, 64)
 		if err != nil {
 			log.Panic(err)
 		}
-	} else {
-		_, err = bot.SetWebhook(tgbotapi.NewWebhook(os.Getenv("TELEGRAM_WEBHOOK_URL") + bot.Token))
+	}
+	if lifetime := os.Getenv("OFFER_LIFETIME"); lifetime != "" {
+		machine.OfferLifetime, err = time.ParseDuration(lifetime)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	if radius := os.Getenv("PRICE_RADIUS"); radius != "" {
+		machine.PriceRadius, err = strconv.ParseFloat(radius, 64)
 		if err != nil {
-			log.Fatal(err)
+			log.Panic(err)
 		}
-		info, err := bot.GetWebhookInfo()
+	}
+	if window := os.Getenv("PRICE_WINDOW"); window != "" {
+		machine.PriceWindow, err = time.ParseDuration(window)
 		if err != nil {
-			log.Fatal(err)
+			log.Panic(err)
 		}
-		if info.LastErrorDate != 0 {
-			log.Printf("Telegram callback last failed: %s", info.LastErrorMessage)
+	}
+	if radius := os.Getenv("SEARCH_RADIUS"); radius != "" {
+		machine.SearchRadius, err = strconv.ParseFloat(radius, 64)
+		if err != nil {
+			log.Panic(err)
 		}
-		updates = bot.ListenForWebhook("/" + bot.Token)
-		go http.ListenAndServe("0.0.0.0:8080", nil)
 	}
-	for update := range updates {
-		//log.Printf("[%s] %s", update.Message.From.UserName, update.Message.Text)
-		reply, err := machine.Generate(update.Message.Chat.ID, update.Message.Text)
+	if radius := os.Getenv("ALERT_RADIUS"); radius != "" {
+		machine.AlertRadius, err = strconv.ParseFloat(radius, 64)
 		if err != nil {
-			log.Printf("Error: %s", err.Error())
-			reply = fmt.Sprintf("Error: %s", err.Error())
+			log.Panic(err)
 		}
-
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID, reply)
-		_, err = bot.Send(msg)
+	}
+	if interval := os.Getenv("ALERT_INTERVAL"); interval != "" {
+		machine.AlertInterval, err = time.ParseDuration(interval)
 		if err != nil {
 			log.Panic(err)
 		}
 	}
+	if currency := os.Getenv("CURRENCY"); currency != "" {
+		machine.Currencies = NewCurrencies(currency)
+	}
+	err = machine.Currencies.SetRates(os.Getenv("CURRENCY_RATES"))
+	if err != nil {
+		log.Panic(err)
+	}
+	err = orm.CheckPrices(machine.Currencies)
+	if err != nil {
+		log.Panic(err)
+	}
+	catalog := os.Getenv("PRODUCT_CATALOG")
+	if catalog == "" {
+		catalog = "products.json"
+	}
+	machine.Catalog, err = LoadCatalog(catalog)
+	if err != nil {
+		log.Panic(err)
+	}
+	err = orm.MergeProducts(machine.Catalog)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// Connect with messaging channel
+	channel, err := NewChannel(os.Getenv("CHANNEL"))
+	if err != nil {
+		log.Panic(err)
+	}
+
+	// Process messages
+	err = Serve(channel, machine)
+	if err != nil {
+		log.Panic(err)
+	}
 
 	log.Printf("Stopping Chat4Bread Backend.")
 }
+
+// simulate runs conversations in the terminal.
+func simulate(args []string) {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	classifier := flags.String("classifier", "rules", "intent classifier backend (cai or rules)")
+	phone := flags.Int64("phone", 237600000001, "phone number to start chatting with")
+	mongodb := flags.Bool("mongo", false, "use the MongoDB database instead of an in-memory store")
+	acceptance := flags.Bool("acceptance", false, "require sellers to accept purchases")
+	radius := flags.Float64("radius", 50000, "maximum distance in meters between buyers and offers")
+	currency := flags.String("currency", "XAF", "default currency of prices")
+	rates := flags.String("rates", "", "exchange rates into CFA francs, e.g. USD=600,EUR=655.957")
+	catalog := flags.String("catalog", "products.json", "JSON file with the product catalog (empty to accept any product)")
+	flags.Parse(args)
+
+	nlp, err := NewIntentClassifier(*classifier)
+	if err != nil {
+		log.Panic(err)
+	}
+	var store Store = NewMemoryStore()
+	var orm *ORM
+	if *mongodb {
+		orm = connectORM()
+		store = orm
+	}
+	machine := NewMachine(store, nlp)
+	machine.SellerAcceptance = *acceptance
+	machine.MaxDistance = *radius
+	machine.Currencies = NewCurrencies(*currency)
+	err = machine.Currencies.SetRates(*rates)
+	if err != nil {
+		log.Panic(err)
+	}
+	if orm != nil {
+		err = orm.CheckPrices(machine.Currencies)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	if *catalog != "" {
+		machine.Catalog, err = LoadCatalog(*catalog)
+		if err != nil {
+			log.Panic(err)
+		}
+		if orm != nil {
+			err = orm.MergeProducts(machine.Catalog)
+			if err != nil {
+				log.Panic(err)
+			}
+		}
+	}
+
+	err = NewSimulator(machine, os.Stdin, os.Stdout, *phone).Run()
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// fakeCAI runs a local stand-in for the SAP CAI request API.
+func fakeCAI(args []string) {
+	flags := flag.NewFlagSet("fake-cai", flag.ExitOnError)
+	addr := flags.String("addr", "0.0.0.0:8090", "address to listen on")
+	fixtures := flags.String("fixtures", "fixtures/cai.json", "JSON file with utterance fixtures")
+	rules := flags.Bool("rules", true, "answer unknown utterances using the rule-based classifier")
+	flags.Parse(args)
+
+	fake, err := LoadFakeCAI(*fixtures)
+	if err != nil {
+		log.Panic(err)
+	}
+	if *rules {
+		fake.Fallback = NewRuleClassifier()
+	}
+
+	http.Handle("/v2/request", fake)
+	log.Printf("Serving fake CAI with %d fixtures on %s.", len(fake.Fixtures), *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+// migratePrices converts the stored prices into the default currency.
+func migratePrices(args []string) {
+	flags := flag.NewFlagSet("migrate-prices", flag.ExitOnError)
+	defaultCurrency := os.Getenv("CURRENCY")
+	if defaultCurrency == "" {
+		defaultCurrency = "XAF"
+	}
+	from := flags.String("from", "", "currency of prices stored before currencies were introduced, e.g. USD")
+	currency := flags.String("currency", defaultCurrency, "default currency to convert prices into")
+	rates := flags.String("rates", os.Getenv("CURRENCY_RATES"), "exchange rates into CFA francs, e.g. USD=600,EUR=655.957")
+	flags.Parse(args)
+
+	currencies := NewCurrencies(*currency)
+	err := currencies.SetRates(*rates)
+	if err != nil {
+		log.Panic(err)
+	}
+	err = connectORM().MigratePrices(*from, currencies)
+	if err != nil {
+		log.Panic(err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Simulator runs conversations of several fake phone numbers against a Machine in a terminal.
+type Simulator struct {
+	Machine *Machine
+	In      io.Reader
+	Out     io.Writer
+	Phone   int64
+	phones  map[int64]bool
+}
+
+// NewSimulator initializes a simulator which starts chatting with the given phone number.
+func NewSimulator(machine *Machine, in io.Reader, out io.Writer, phone int64) *Simulator {
+	sim := &Simulator{Machine: machine, In: in, Out: out, Phone: phone,
+		phones: map[int64]bool{phone: true}}
+	machine.SendMessage = func(id int64, message string) error {
+		sim.phones[id] = true
+		fmt.Fprintf(sim.Out, "[to %d] %s\n", id, message)
+		return nil
+	}
+	return sim
+}
+
+// Run reads messages and commands line by line until the input ends or /quit is entered.
+func (sim *Simulator) Run() error {
+	fmt.Fprintln(sim.Out, "Chat4Bread simulator. Type /help for a list of commands.")
+	scanner := bufio.NewScanner(sim.In)
+	for {
+		fmt.Fprintf(sim.Out, "%d> ", sim.Phone)
+		if !scanner.Scan() {
+			fmt.Fprintln(sim.Out)
+			return scanner.Err()
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		} else if strings.HasPrefix(line, "/") {
+			if !sim.command(strings.Fields(line)) {
+				return nil
+			}
+			continue
+		}
+
+		reply, err := sim.Machine.Generate(sim.Phone, line)
+		if err != nil {
+			reply = fmt.Sprintf("Error: %s", err.Error())
+		}
+		fmt.Fprintf(sim.Out, "bot> %s\n", reply)
+	}
+}
+
+// command executes a simulator command and returns whether the simulation continues.
+func (sim *Simulator) command(args []string) bool {
+	switch args[0] {
+	case "/as":
+		if len(args) != 2 {
+			fmt.Fprintln(sim.Out, "Usage: /as <phone>")
+			break
+		}
+		phone, err := strconv.ParseInt(strings.TrimPrefix(args[1], "+"), 10, 64)
+		if err != nil || phone <= 0 {
+			fmt.Fprintf(sim.Out, "Invalid phone number %s\n", args[1])
+			break
+		}
+		sim.Phone = phone
+		sim.phones[phone] = true
+	case "/phones":
+		var phones []int64
+		for phone := range sim.phones {
+			phones = append(phones, phone)
+		}
+		sort.Slice(phones, func(i, j int) bool { return phones[i] < phones[j] })
+		for _, phone := range phones {
+			fmt.Fprintf(sim.Out, "%d\n", phone)
+		}
+	case "/sweep":
+		sweep(sim.Machine)
+	case "/wait":
+		if len(args) != 2 {
+			fmt.Fprintln(sim.Out, "Usage: /wait <duration>")
+			break
+		}
+		duration, err := time.ParseDuration(args[1])
+		if err != nil || duration < 0 {
+			fmt.Fprintf(sim.Out, "Invalid duration %s\n", args[1])
+			break
+		}
+		// The clock keeps running, the machine is just ahead of the real time.
+		now := sim.Machine.Now
+		sim.Machine.Now = func() time.Time { return now().Add(duration) }
+		fmt.Fprintf(sim.Out, "It is %s now.\n", sim.Machine.Now().Format("2006-01-02 15:04"))
+		sweep(sim.Machine)
+	case "/quit", "/exit":
+		return false
+	default:
+		fmt.Fprintln(sim.Out, "Commands:\n"+
+			"  /as <phone>  continue chatting as another phone number\n"+
+			"  /phones      list the phone numbers seen in this session\n"+
+			"  /sweep       expire proposals and offers and record prices like the server every minute\n"+
+			"  /wait <d>    advance the clock by a duration like 30m or 48h and sweep\n"+
+			"  /quit        end the simulation")
+	}
+	return true
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gsm7Basic is the GSM 03.38 basic character set.
+const gsm7Basic = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+	"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+
+// gsm7Extension is the GSM 03.38 extension table. Its characters take two septets.
+const gsm7Extension = "\f^{}\\[~]|€"
+
+// SMSChannel delivers messages through a generic HTTP SMS gateway like Kannel or RapidPro.
+// Inbound messages are received through a webhook with the parameters "from" and "text", outbound
+// messages are sent to the gateway URL with the parameters "to" and "text".
+type SMSChannel struct {
+	GatewayURL    string
+	GatewayMethod string
+	Addr          string
+	Path          string
+	Secret        string
+	CountryCode   string
+	UDH           bool
+	Client        *http.Client
+	// mutex guards the concatenation reference of the last message.
+	mutex     sync.Mutex
+	reference uint8
+}
+
+// NewSMSChannel initializes a SMS channel sending messages through the given gateway URL.
+func NewSMSChannel(gatewayURL string) (*SMSChannel, error) {
+	if gatewayURL == "" {
+		return nil, errors.New("Missing SMS gateway URL")
+	}
+
+	return &SMSChannel{GatewayURL: gatewayURL, GatewayMethod: "GET", Addr: "0.0.0.0:8080",
+		Path: "/sms", CountryCode: "237", Client: http.DefaultClient}, nil
+}
+
+// Receive starts the webhook listening for inbound messages.
+func (sc *SMSChannel) Receive() (<-chan Message, error) {
+	messages := make(chan Message)
+	mux := http.NewServeMux()
+	mux.HandleFunc(sc.Path, func(w http.ResponseWriter, r *http.Request) {
+		if sc.Secret != "" && r.FormValue("secret") != sc.Secret {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		phone, err := ParseMSISDN(r.FormValue("from"), sc.CountryCode)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		messages <- Message{From: phone, Text: r.FormValue("text")}
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	go func() {
+		log.Printf("Listening for SMS on %s%s", sc.Addr, sc.Path)
+		err := http.ListenAndServe(sc.Addr, mux)
+		log.Printf("Error: %s", err.Error())
+		close(messages)
+	}()
+
+	return messages, nil
+}
+
+// Send delivers a message to a phone number, split into concatenated parts if necessary.
+func (sc *SMSChannel) Send(to int64, text string) error {
+	parts := SplitSMS(text)
+	reference := sc.nextReference()
+	for index, part := range parts {
+		params := url.Values{"to": {"+" + strconv.FormatInt(to, 10)}, "text": {part}}
+		if sc.UDH && len(parts) > 1 {
+			udh := []byte{0x05, 0x00, 0x03, reference, byte(len(parts)), byte(index + 1)}
+			params.Set("udh", string(udh))
+		}
+
+		err := sc.post(params)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// nextReference returns the concatenation reference of the next message. Concurrently sent
+// messages get different references, such that their parts are not mixed up.
+func (sc *SMSChannel) nextReference() uint8 {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	sc.reference++
+	return sc.reference
+}
+
+// post sends a request with the given parameters to the SMS gateway.
+func (sc *SMSChannel) post(params url.Values) error {
+	var req *http.Request
+	var err error
+	if sc.GatewayMethod == "POST" {
+		req, err = http.NewRequest("POST", sc.GatewayURL, strings.NewReader(params.Encode()))
+		if err == nil {
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		separator := "?"
+		if strings.Contains(sc.GatewayURL, "?") {
+			separator = "&"
+		}
+		req, err = http.NewRequest("GET", sc.GatewayURL+separator+params.Encode(), nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := sc.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("SMS gateway failed with status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// ParseMSISDN parses a phone number in international format. National numbers without a leading
+// plus or zeros are prefixed with the given country code if they are nine digits long.
+func ParseMSISDN(phone string, countryCode string) (int64, error) {
+	digits := strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' || r == '(' || r == ')' || r == '.' {
+			return -1
+		}
+		return r
+	}, phone)
+
+	if strings.HasPrefix(digits, "+") {
+		digits = digits[1:]
+	} else if strings.HasPrefix(digits, "00") {
+		digits = digits[2:]
+	} else if len(digits) == 9 {
+		digits = countryCode + digits
+	}
+
+	if len(digits) < 8 || len(digits) > 15 {
+		return 0, fmt.Errorf("Invalid phone number %s", phone)
+	}
+	msisdn, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || msisdn <= 0 {
+		return 0, fmt.Errorf("Invalid phone number %s", phone)
+	}
+
+	return msisdn, nil
+}
+
+// SplitSMS splits a text into the parts of a concatenated SMS. Texts fitting into the GSM-7
+// alphabet use 160 septets for a single message or 153 septets per part, all other texts are
+// sent as UCS-2 with 70 or 67 characters.
+func SplitSMS(text string) []string {
+	single, multi := 160, 153
+	cost := func(r rune) int {
+		if strings.ContainsRune(gsm7Extension, r) {
+			return 2
+		}
+		return 1
+	}
+	for _, r := range text {
+		if !strings.ContainsRune(gsm7Basic, r) && !strings.ContainsRune(gsm7Extension, r) {
+			single, multi = 70, 67
+			cost = func(r rune) int {
+				if r > 0xFFFF {
+					return 2
+				}
+				return 1
+			}
+			break
+		}
+	}
+
+	length := 0
+	for _, r := range text {
+		length += cost(r)
+	}
+	if length <= single {
+		return []string{text}
+	}
+
+	var parts []string
+	var part []rune
+	size := 0
+	for _, r := range text {
+		if size+cost(r) > multi {
+			parts = append(parts, string(part))
+			part, size = nil, 0
+		}
+		part = append(part, r)
+		size += cost(r)
+	}
+	if len(part) > 0 {
+		parts = append(parts, string(part))
+	}
+
+	return parts
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseMSISDN(t *testing.T) {
+	cases := []struct {
+		Phone    string
+		Expected int64
+		OK       bool
+	}{
+		{"+237600000001", 237600000001, true},
+		{"00237600000001", 237600000001, true},
+		{"237600000001", 237600000001, true},
+		{"600000001", 237600000001, true},
+		{"6 00 00 00 01", 237600000001, true},
+		{"+237 (6) 00-00.00.01", 237600000001, true},
+		{"+49 151 12345678", 4915112345678, true},
+		{"1234567", 0, false},
+		{"+1234567890123456", 0, false},
+		{"+237abc000001", 0, false},
+		{"", 0, false},
+	}
+	for _, c := range cases {
+		msisdn, err := ParseMSISDN(c.Phone, "237")
+		if msisdn != c.Expected || (err == nil) != c.OK {
+			t.Errorf("expected %q to be %d (%v), got %d, %v", c.Phone, c.Expected, c.OK, msisdn, err)
+		}
+	}
+}
+
+func TestSplitSMS(t *testing.T) {
+	cases := []struct {
+		Name  string
+		Text  string
+		Parts []int
+	}{
+		{"Empty", "", []int{0}},
+		{"GSM-7 single", strings.Repeat("a", 160), []int{160}},
+		{"GSM-7 concatenated", strings.Repeat("a", 161), []int{153, 8}},
+		{"GSM-7 accents", strings.Repeat("é", 160), []int{160}},
+		{"GSM-7 extension single", strings.Repeat("€", 80), []int{80}},
+		{"GSM-7 extension concatenated", strings.Repeat("€", 81), []int{76, 5}},
+		{"GSM-7 extension at boundary", strings.Repeat("a", 152) + "{" + strings.Repeat("a", 7), []int{152, 8}},
+		{"UCS-2 single", strings.Repeat("a", 69) + "ê", []int{70}},
+		{"UCS-2 concatenated", strings.Repeat("a", 70) + "ê", []int{67, 4}},
+		{"UCS-2 surrogate pair", strings.Repeat("😀", 35), []int{35}},
+		{"UCS-2 surrogate pairs concatenated", strings.Repeat("😀", 36), []int{33, 3}},
+	}
+	for _, c := range cases {
+		parts := SplitSMS(c.Text)
+		var lengths []int
+		for _, part := range parts {
+			lengths = append(lengths, len([]rune(part)))
+		}
+		if strings.Join(parts, "") != c.Text || len(lengths) != len(c.Parts) {
+			t.Errorf("%s: expected parts of %v characters, got %v", c.Name, c.Parts, lengths)
+			continue
+		}
+		for index := range lengths {
+			if lengths[index] != c.Parts[index] {
+				t.Errorf("%s: expected parts of %v characters, got %v", c.Name, c.Parts, lengths)
+				break
+			}
+		}
+	}
+}
+
+func TestSMSConcurrentReferences(t *testing.T) {
+	var mutex sync.Mutex
+	references := map[string][]byte{}
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		udh := []byte(r.FormValue("udh"))
+		if len(udh) != 6 {
+			t.Errorf("expected concatenation header, got %v", udh)
+			return
+		}
+		references[r.FormValue("to")] = append(references[r.FormValue("to")], udh[3])
+	}))
+	defer gateway.Close()
+
+	sc, err := NewSMSChannel(gateway.URL)
+	mustNil(t, err)
+	sc.UDH = true
+	var wg sync.WaitGroup
+	for phone := int64(237600000001); phone <= 237600000020; phone++ {
+		wg.Add(1)
+		go func(phone int64) {
+			defer wg.Done()
+			if err := sc.Send(phone, strings.Repeat("a", 200)); err != nil {
+				t.Error(err)
+			}
+		}(phone)
+	}
+	wg.Wait()
+
+	used := map[byte]bool{}
+	for to, parts := range references {
+		if len(parts) != 2 || parts[0] != parts[1] || used[parts[0]] {
+			t.Errorf("expected unique reference for both parts to %s, got %v", to, parts)
+		}
+		used[parts[0]] = true
+	}
+	if len(references) != 20 {
+		t.Errorf("expected messages to 20 phones, got %d", len(references))
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// Store is the repository of users, products, offers and trades used by the Machine.
+type Store interface {
+	// UserByPhone looks for a user by its phone number/username.
+	UserByPhone(phone int64) (*User, error)
+	// UserByID looks for a user by its ID.
+	UserByID(id primitive.ObjectID) (*User, error)
+	// NewUser adds a new user to the system.
+	NewUser(phone int64) error
+	// ResetUserState resets the user state.
+	ResetUserState(user *User) error
+	// SetUserState sets the current action of the user and its requirements.
+	SetUserState(user *User, action string, reqs []string) error
+	// SetUserName sets the name of the user.
+	SetUserName(user *User, name string) error
+	// SetUserLocation sets the location of the user and its available offers.
+	SetUserLocation(user *User, lat float64, lng float64) error
+	// SetUserPIN sets the hashed PIN of the user and clears its failed attempts.
+	SetUserPIN(user *User, hash string) error
+	// SetPINFailures records the number of consecutive wrong PINs of the user and until when it
+	// is locked.
+	SetPINFailures(user *User, failures int, lockedUntil time.Time) error
+	// SetFarmerAlerts subscribes or unsubscribes the user from alerts about new farmers nearby.
+	SetFarmerAlerts(user *User, enabled bool) error
+	// RecordAlert records that an alert is sent to the user at a point in time, unless the last
+	// alert was sent after another point in time. It returns whether the alert was recorded.
+	RecordAlert(user *User, now time.Time, before time.Time) (bool, error)
+	// SetUserKind sets the type of the user.
+	SetUserKind(user *User, kind string) error
+	// DeleteUser removes a user from the system. Offers and trades of the user are kept.
+	DeleteUser(user *User) error
+	// PopRequirement removes the top requirement of the current action.
+	PopRequirement(user *User) error
+	// FindFarmersNear finds users near a geo point within a specific range in meters.
+	FindFarmersNear(lat float64, lng float64, dist float64) ([]User, error)
+	// FindSellersNear finds the farmers near a geo point within a specific range in meters who
+	// have available offers of a product, nearest first.
+	FindSellersNear(product primitive.ObjectID, lat float64, lng float64, dist float64) ([]Seller, error)
+	// FindOrCreateProduct finds a product or creates a new one.
+	FindOrCreateProduct(name string) (*Product, error)
+	// ProductByID looks for a product by its ID.
+	ProductByID(id primitive.ObjectID) (*Product, error)
+	// Products returns all products.
+	Products() ([]Product, error)
+	// CreateMassOffer creates a new offer based on a specific mass, located at the seller, and
+	// returns it. A zero expiry date means that the offer never expires.
+	CreateMassOffer(user primitive.ObjectID, product primitive.ObjectID, price float64,
+		mass float64, expires time.Time) (*Offer, error)
+	// CreateUnitOffer creates a new offer based on a number of units to sell, located at the
+	// seller, and returns it. A zero expiry date means that the offer never expires.
+	CreateUnitOffer(user primitive.ObjectID, product primitive.ObjectID, price float64,
+		units uint64, expires time.Time) (*Offer, error)
+	// FindOffers finds the mass or unit offers of a product with a normalized price not above
+	// the given one, located within a range in meters, cheapest first. The distance of each
+	// offer is stored in its location.
+	FindOffers(product primitive.ObjectID, units bool, price float64, lat float64, lng float64,
+		dist float64) ([]Offer, error)
+	// SellerOffers returns the available offers of a seller, oldest first.
+	SellerOffers(seller primitive.ObjectID) ([]Offer, error)
+	// UpdateOffer changes the price and quantity of an available offer of a seller, unless its
+	// mass or units changed since it was read. It returns whether the offer was changed.
+	UpdateOffer(offer *Offer, price float64, mass float64, units uint64) (bool, error)
+	// WithdrawOffer closes an available offer of a seller. Reservations of pending trades are
+	// not affected. It returns whether the offer was withdrawn.
+	WithdrawOffer(offer *Offer) (bool, error)
+	// ExpireOffers closes all available offers whose expiry date passed and returns them.
+	ExpireOffers(now time.Time) ([]Offer, error)
+	// ArchiveOffers moves all offers which were closed before a point in time out of the offers.
+	// It returns the number of archived offers.
+	ArchiveOffers(before time.Time) (int, error)
+	// ReserveOffer atomically finds an offer with at least the traded quantity at a normalized
+	// price not above the bid, reduces it and records the trade. The price of the trade is the bid
+	// on input and the price of the traded quantity at the normalized price of the offer on
+	// output. If the trade refers to an offer, only this offer is considered. It returns nil if no
+	// offer matches.
+	ReserveOffer(trade *Trade) (*Offer, *User, error)
+	// TradeByID looks for a trade by its ID.
+	TradeByID(id primitive.ObjectID) (*Trade, error)
+	// SetTradeStatus changes the status of a trade if it still has the expected status. It
+	// returns whether the status was changed.
+	SetTradeStatus(trade *Trade, from string, to string) (bool, error)
+	// ReleaseOffer returns the reserved mass or units of a trade to its offer. Sold out offers
+	// become partially filled again.
+	ReleaseOffer(trade *Trade) error
+	// RecoverReservations releases all offer reservations which were made before a point in time
+	// and whose trade was not recorded.
+	RecoverReservations(before time.Time) error
+	// StaleTrades returns all trades with a status which were created before a point in time.
+	StaleTrades(status string, before time.Time) ([]Trade, error)
+	// SellerTrades returns the trades of a seller with a status, oldest first.
+	SellerTrades(seller primitive.ObjectID, status string) ([]Trade, error)
+	// BuyerTrades returns the trades of a buyer with a status, oldest first.
+	BuyerTrades(buyer primitive.ObjectID, status string) ([]Trade, error)
+	// TradesByUser returns the latest trades with a status in which a user was buyer or seller.
+	TradesByUser(user primitive.ObjectID, status string, limit int64) ([]Trade, error)
+	// OfferPrices returns the normalized prices of the available mass or unit offers of a product
+	// which were created since a point in time within a radius around a geo point.
+	OfferPrices(query PriceQuery) ([]float64, error)
+	// TradePrices returns the normalized prices of the completed mass or unit trades of a product
+	// since a point in time within a radius around a geo point.
+	TradePrices(query PriceQuery) ([]float64, error)
+	// SavePriceSnapshot stores a price snapshot, replacing the snapshot of the same product, day
+	// and pricing.
+	SavePriceSnapshot(snapshot *PriceSnapshot) error
+	// CreateOrder stores a new open standing buy order.
+	CreateOrder(order *Order) error
+	// FindOrders finds the open mass or unit orders of a product with a normalized price not
+	// below the given one, located within a range in meters, oldest first. The distance of each
+	// order is stored in its location.
+	FindOrders(product primitive.ObjectID, units bool, price float64, lat float64, lng float64,
+		dist float64) ([]Order, error)
+	// BuyerOrders returns the open orders of a buyer, oldest first.
+	BuyerOrders(buyer primitive.ObjectID) ([]Order, error)
+	// SetOrderStatus changes the status of an order if it still has the expected status. It
+	// returns whether the status was changed.
+	SetOrderStatus(order *Order, from string, to string) (bool, error)
+	// PriceHistory returns the price snapshots of a product per gram or per unit since a day,
+	// oldest first.
+	PriceHistory(product primitive.ObjectID, units bool, since time.Time) ([]PriceSnapshot, error)
+}
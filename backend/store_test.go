@@ -0,0 +1,957 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStore runs the conformance test suite against a store implementation. Every subtest gets
+// an empty store from newStore.
+func testStore(t *testing.T, newStore func(t *testing.T) Store) {
+	t.Run("Users", func(t *testing.T) {
+		store := newStore(t)
+		user, err := store.UserByPhone(1)
+		if err != nil || user != nil {
+			t.Fatalf("expected no user, got %v, %v", user, err)
+		}
+
+		mustNil(t, store.NewUser(1))
+		user = mustUser(t, store, 1)
+		if user.Action != "onboarding" || len(user.Reqs) != 4 || user.Reqs[0] != "name" {
+			t.Fatalf("unexpected new user state %s %v", user.Action, user.Reqs)
+		}
+		if user.Name != nil || user.Location != nil || user.Kind != nil || user.PIN != nil {
+			t.Fatalf("expected empty profile, got %+v", user)
+		}
+
+		mustNil(t, store.SetUserName(user, "Amina"))
+		mustNil(t, store.PopRequirement(user))
+		mustNil(t, store.SetUserLocation(user, 3.848, 11.5021))
+		mustNil(t, store.PopRequirement(user))
+		user = mustUser(t, store, 1)
+		if len(user.Reqs) != 2 || user.Reqs[0] != "pin" {
+			t.Fatalf("expected requirement pin, got %v", user.Reqs)
+		}
+		if *user.Name != "Amina" || user.Location.Coords[0] != 11.5021 ||
+			user.Location.Coords[1] != 3.848 {
+			t.Fatalf("unexpected profile %s %v", *user.Name, user.Location.Coords)
+		}
+
+		locked := time.Now().Add(time.Minute).Truncate(time.Millisecond)
+		mustNil(t, store.SetPINFailures(user, 2, time.Time{}))
+		user = mustUser(t, store, 1)
+		if user.PINFailures != 2 || !user.LockedUntil.IsZero() {
+			t.Fatalf("expected failed attempts, got %d, %v", user.PINFailures, user.LockedUntil)
+		}
+		mustNil(t, store.SetPINFailures(user, 0, locked))
+		user = mustUser(t, store, 1)
+		if user.PINFailures != 0 || !user.LockedUntil.Equal(locked) {
+			t.Fatalf("expected locked user, got %d, %v", user.PINFailures, user.LockedUntil)
+		}
+		mustNil(t, store.SetUserPIN(user, "hash"))
+		mustNil(t, store.PopRequirement(user))
+		user = mustUser(t, store, 1)
+		if user.PIN == nil || *user.PIN != "hash" || user.PINFailures != 0 || !user.LockedUntil.IsZero() {
+			t.Fatalf("expected PIN without failed attempts, got %+v", user)
+		}
+
+		mustNil(t, store.SetUserKind(user, "farmer"))
+		mustNil(t, store.ResetUserState(user))
+		user = mustUser(t, store, 1)
+		if *user.Kind != "farmer" || user.Action != "" || len(user.Reqs) != 0 {
+			t.Fatalf("unexpected user state %s %s %v", *user.Kind, user.Action, user.Reqs)
+		}
+	})
+
+	t.Run("FindFarmersNear", func(t *testing.T) {
+		store := newStore(t)
+		newTestUser(t, store, 1, "Far", 3.948, 11.5021, "farmer")
+		newTestUser(t, store, 2, "Near", 3.8570, 11.5021, "farmer")
+		newTestUser(t, store, 3, "Here", 3.848, 11.5021, "consumer")
+		mustNil(t, store.NewUser(4))
+
+		users, err := store.FindFarmersNear(3.848, 11.5021, 2000)
+		mustNil(t, err)
+		if len(users) != 2 || *users[0].Name != "Here" || *users[1].Name != "Near" {
+			t.Fatalf("expected users Here and Near, got %v", users)
+		}
+		if math.Abs(users[1].Location.Distance-1000) > 10 {
+			t.Fatalf("expected a distance of about 1000 m, got %f", users[1].Location.Distance)
+		}
+	})
+
+	t.Run("FindSellersNear", func(t *testing.T) {
+		store := newStore(t)
+		near := newTestUser(t, store, 1, "Near", 3.857, 11.5021, "farmer")
+		here := newTestUser(t, store, 2, "Here", 3.848, 11.5021, "farmer")
+		far := newTestUser(t, store, 3, "Far", 3.948, 11.5021, "farmer")
+		consumer := newTestUser(t, store, 4, "Consumer", 3.848, 11.5021, "consumer")
+		newTestUser(t, store, 5, "Idle", 3.848, 11.5021, "farmer")
+		product, err := store.FindOrCreateProduct("tomatoes")
+		mustNil(t, err)
+		other, err := store.FindOrCreateProduct("cassava")
+		mustNil(t, err)
+		_, err = store.CreateMassOffer(near.ID, product.ID, 3, 5000, never)
+		mustNil(t, err)
+		_, err = store.CreateUnitOffer(near.ID, product.ID, 2, 10, never)
+		mustNil(t, err)
+		_, err = store.CreateMassOffer(here.ID, product.ID, 1, 1000, never)
+		mustNil(t, err)
+		_, err = store.CreateMassOffer(here.ID, product.ID, 1, 1000, time.Now().Add(-time.Minute))
+		mustNil(t, err)
+		_, err = store.CreateMassOffer(here.ID, other.ID, 1, 1000, never)
+		mustNil(t, err)
+		_, err = store.CreateMassOffer(far.ID, product.ID, 1, 1000, never)
+		mustNil(t, err)
+		_, err = store.CreateMassOffer(consumer.ID, product.ID, 1, 1000, never)
+		mustNil(t, err)
+
+		sellers, err := store.FindSellersNear(product.ID, 3.848, 11.5021, 2000)
+		mustNil(t, err)
+		if len(sellers) != 2 || sellers[0].ID != here.ID || sellers[1].ID != near.ID {
+			t.Fatalf("expected sellers Here and Near, got %+v", sellers)
+		}
+		if len(sellers[0].Offers) != 1 || sellers[0].Offers[0].Product != product.ID {
+			t.Fatalf("expected available offer of the product, got %+v", sellers[0].Offers)
+		}
+		if len(sellers[1].Offers) != 2 || sellers[1].Offers[0].Mass != 5000 || sellers[1].Offers[1].Units != 10 {
+			t.Fatalf("expected oldest offer first, got %+v", sellers[1].Offers)
+		}
+		if math.Abs(sellers[1].Location.Distance-1000) > 10 {
+			t.Fatalf("expected a distance of about 1000 m, got %f", sellers[1].Location.Distance)
+		}
+	})
+
+	t.Run("FindOrCreateProduct", func(t *testing.T) {
+		store := newStore(t)
+		cassava, err := store.FindOrCreateProduct("cassava")
+		mustNil(t, err)
+		again, err := store.FindOrCreateProduct("cassava")
+		mustNil(t, err)
+		yam, err := store.FindOrCreateProduct("yam")
+		mustNil(t, err)
+		if cassava.ID != again.ID || cassava.ID == yam.ID || yam.Name != "yam" {
+			t.Fatalf("unexpected products %v %v %v", cassava, again, yam)
+		}
+	})
+
+	t.Run("MassOffers", func(t *testing.T) {
+		store := newStore(t)
+		seller := newTestUser(t, store, 1, "Seller", 3.848, 11.5021, "farmer")
+		product, err := store.FindOrCreateProduct("cassava")
+		mustNil(t, err)
+		offer, err := store.CreateMassOffer(seller.ID, product.ID, 3, 5000, never)
+		mustNil(t, err)
+
+		offers, err := store.SellerOffers(seller.ID)
+		mustNil(t, err)
+		if len(offers) != 1 || offers[0].ID != offer.ID || offer.Location == nil || offer.Mass != 5000 ||
+			offers[0].Product != product.ID || offers[0].Mass != 5000 ||
+			offers[0].Price != 3 || offers[0].NormalizedPrice != 3.0/5000 || offers[0].Status != OfferOpen {
+			t.Fatalf("expected offer of seller, got %+v", offers)
+		}
+	})
+
+	t.Run("UnitOffers", func(t *testing.T) {
+		store := newStore(t)
+		seller := newTestUser(t, store, 1, "Seller", 3.848, 11.5021, "farmer")
+		product, err := store.FindOrCreateProduct("plantain")
+		mustNil(t, err)
+		offer, err := store.CreateUnitOffer(seller.ID, product.ID, 4, 10, never)
+		mustNil(t, err)
+
+		offers, err := store.SellerOffers(seller.ID)
+		mustNil(t, err)
+		if len(offers) != 1 || offers[0].ID != offer.ID || offer.Units != 10 || offers[0].Units != 10 || offers[0].Mass != 0 ||
+			offers[0].NormalizedPrice != 0.4 || offers[0].Status != OfferOpen {
+			t.Fatalf("expected offer of seller, got %+v", offers)
+		}
+	})
+
+	t.Run("FindOffers", func(t *testing.T) {
+		store := newStore(t)
+		near := newTestUser(t, store, 1, "Near", 3.848, 11.5021, "farmer")
+		cheap := newTestUser(t, store, 2, "Cheap", 3.857, 11.5021, "farmer")
+		far := newTestUser(t, store, 3, "Far", 4.0511, 9.7679, "farmer")
+		product, err := store.FindOrCreateProduct("cassava")
+		mustNil(t, err)
+		_, err = store.CreateMassOffer(near.ID, product.ID, 5, 5000, never)
+		mustNil(t, err)
+		_, err = store.CreateMassOffer(cheap.ID, product.ID, 3, 5000, never)
+		mustNil(t, err)
+		_, err = store.CreateMassOffer(far.ID, product.ID, 1, 5000, never)
+		mustNil(t, err)
+		_, err = store.CreateMassOffer(near.ID, product.ID, 10, 5000, never)
+		mustNil(t, err)
+		_, err = store.CreateUnitOffer(near.ID, product.ID, 1, 10, never)
+		mustNil(t, err)
+
+		offers, err := store.FindOffers(product.ID, false, 0.001, 3.848, 11.5021, 2000)
+		mustNil(t, err)
+		if len(offers) != 2 || offers[0].Seller != cheap.ID || offers[1].Seller != near.ID {
+			t.Fatalf("expected cheapest nearby mass offers first, got %v", offers)
+		}
+		if math.Abs(offers[0].Location.Distance-1000) > 10 || offers[1].Location.Distance > 1 {
+			t.Fatalf("expected offer distances, got %v %v", offers[0].Location, offers[1].Location)
+		}
+		offers, err = store.FindOffers(product.ID, true, 1, 3.848, 11.5021, 2000)
+		mustNil(t, err)
+		if len(offers) != 1 || offers[0].Units != 10 {
+			t.Fatalf("expected unit offer, got %v", offers)
+		}
+		offers, err = store.FindOffers(product.ID, false, 0.001, 3.848, 11.5021, 500000)
+		mustNil(t, err)
+		if len(offers) != 3 || offers[0].Seller != far.ID {
+			t.Fatalf("expected distant offer first, got %v", offers)
+		}
+	})
+
+	t.Run("ReserveOffer", func(t *testing.T) {
+		store := newStore(t)
+		seller := newTestUser(t, store, 1, "Seller", 3.848, 11.5021, "farmer")
+		buyer := newTestUser(t, store, 2, "Buyer", 3.848, 11.5021, "consumer")
+		product, err := store.FindOrCreateProduct("cassava")
+		mustNil(t, err)
+		_, err = store.CreateMassOffer(seller.ID, product.ID, 3, 5000, never)
+		mustNil(t, err)
+
+		for _, bid := range [][]float64{{1, 2000}, {10, 6000}} {
+			offer, _, err := store.ReserveOffer(&Trade{Buyer: buyer.ID, Product: product.ID,
+				Mass: bid[1], Price: bid[0]})
+			if err != nil || offer != nil {
+				t.Fatalf("expected no offer for bid %v, got %v, %v", bid, offer, err)
+			}
+		}
+
+		trade := &Trade{Buyer: buyer.ID, Product: product.ID, Mass: 2000, Price: 2}
+		offer, merchant, err := store.ReserveOffer(trade)
+		mustNil(t, err)
+		if offer == nil || offer.Mass != 3000 || merchant.ID != seller.ID {
+			t.Fatalf("expected reduced offer of seller, got %v %v", offer, merchant)
+		}
+		if trade.ID.IsZero() || trade.Status != TradeCompleted || trade.Created.IsZero() ||
+			trade.Offer != offer.ID || trade.Seller != seller.ID {
+			t.Fatalf("expected completed trade, got %+v", trade)
+		}
+
+		for _, user := range []*User{seller, buyer} {
+			trades, err := store.TradesByUser(user.ID, TradeCompleted, 10)
+			mustNil(t, err)
+			if len(trades) != 1 || trades[0].ID != trade.ID || trades[0].Status != TradeCompleted ||
+				trades[0].Mass != 2000 || !trades[0].Created.Equal(trade.Created) {
+				t.Fatalf("expected trade %+v, got %+v", trade, trades)
+			}
+		}
+
+		offer, _, err = store.ReserveOffer(&Trade{Buyer: buyer.ID, Product: product.ID,
+			Offer: offer.ID, Mass: 3000, Price: 1.8})
+		if err != nil || offer == nil || offer.Mass != 0 {
+			t.Fatalf("expected sold out offer, got %v, %v", offer, err)
+		}
+		offer, _, err = store.ReserveOffer(&Trade{Buyer: buyer.ID, Product: product.ID,
+			Offer: product.ID, Mass: 1, Price: 100})
+		if err != nil || offer != nil {
+			t.Fatalf("expected no offer for an unknown offer ID, got %v, %v", offer, err)
+		}
+
+		found, err := store.UserByID(seller.ID)
+		if err != nil || found == nil || found.Phone != 1 {
+			t.Fatalf("expected seller, got %v, %v", found, err)
+		}
+		name, err := store.ProductByID(product.ID)
+		if err != nil || name == nil || name.Name != "cassava" {
+			t.Fatalf("expected product, got %v, %v", name, err)
+		}
+	})
+
+	t.Run("TradesByUser", func(t *testing.T) {
+		store := newStore(t)
+		seller := newTestUser(t, store, 1, "Seller", 3.848, 11.5021, "farmer")
+		buyer := newTestUser(t, store, 2, "Buyer", 3.848, 11.5021, "consumer")
+		product, err := store.FindOrCreateProduct("plantain")
+		mustNil(t, err)
+		_, err = store.CreateUnitOffer(seller.ID, product.ID, 10, 10, never)
+		mustNil(t, err)
+		completed := &Trade{Buyer: buyer.ID, Product: product.ID, Units: 1, Price: 1}
+		_, _, err = store.ReserveOffer(completed)
+		mustNil(t, err)
+		for index := 0; index < 3; index++ {
+			_, _, err = store.ReserveOffer(&Trade{Buyer: buyer.ID, Product: product.ID, Units: 1, Price: 1,
+				Status: TradeProposed})
+			mustNil(t, err)
+		}
+
+		for _, user := range []*User{seller, buyer} {
+			trades, err := store.TradesByUser(user.ID, TradeCompleted, 2)
+			if err != nil || len(trades) != 1 || trades[0].ID != completed.ID {
+				t.Fatalf("expected only the completed trade, got %+v, %v", trades, err)
+			}
+		}
+		trades, err := store.TradesByUser(buyer.ID, TradeProposed, 2)
+		if err != nil || len(trades) != 2 || trades[0].Status != TradeProposed {
+			t.Fatalf("expected 2 proposed trades, got %+v, %v", trades, err)
+		}
+	})
+
+	t.Run("OfferLifecycle", func(t *testing.T) {
+		store := newStore(t)
+		seller := newTestUser(t, store, 1, "Seller", 3.848, 11.5021, "farmer")
+		buyer := newTestUser(t, store, 2, "Buyer", 3.848, 11.5021, "consumer")
+		product, err := store.FindOrCreateProduct("plantain")
+		mustNil(t, err)
+		now := time.Now().UTC()
+		_, err = store.CreateUnitOffer(seller.ID, product.ID, 10, 10, never)
+		mustNil(t, err)
+		_, err = store.CreateMassOffer(seller.ID, product.ID, 10, 1000, now.Add(time.Hour))
+		mustNil(t, err)
+		status := func(units bool) string {
+			offers, err := store.FindOffers(product.ID, units, 100, 3.848, 11.5021, 1000)
+			mustNil(t, err)
+			if len(offers) == 0 {
+				return "unavailable"
+			}
+			return offers[0].Status
+		}
+		if status(true) != OfferOpen || status(false) != OfferOpen {
+			t.Fatalf("expected open offers, got %s and %s", status(true), status(false))
+		}
+
+		first := &Trade{Buyer: buyer.ID, Product: product.ID, Units: 4, Price: 4}
+		offer, _, err := store.ReserveOffer(first)
+		mustNil(t, err)
+		if offer == nil || status(true) != OfferPartiallyFilled {
+			t.Fatalf("expected partially filled offer, got %v %s", offer, status(true))
+		}
+		second := &Trade{Buyer: buyer.ID, Product: product.ID, Units: 6, Price: 6}
+		offer, _, err = store.ReserveOffer(second)
+		mustNil(t, err)
+		if offer == nil || status(true) != "unavailable" {
+			t.Fatalf("expected sold out offer, got %v %s", offer, status(true))
+		}
+		mustNil(t, store.ReleaseOffer(second))
+		if status(true) != OfferPartiallyFilled {
+			t.Fatalf("expected released offer to be partially filled, got %s", status(true))
+		}
+
+		expired, err := store.ExpireOffers(now)
+		if err != nil || len(expired) != 0 {
+			t.Fatalf("expected no expired offers, got %v, %v", expired, err)
+		}
+		expired, err = store.ExpireOffers(now.Add(2 * time.Hour))
+		if err != nil || len(expired) != 1 || expired[0].Mass != 1000 || expired[0].Status != OfferExpired {
+			t.Fatalf("expected expired mass offer, got %v, %v", expired, err)
+		}
+		expired, err = store.ExpireOffers(now.Add(2 * time.Hour))
+		if err != nil || len(expired) != 0 {
+			t.Fatalf("expected offer to expire once, got %v, %v", expired, err)
+		}
+
+		archived, err := store.ArchiveOffers(now.Add(time.Hour))
+		if err != nil || archived != 0 {
+			t.Fatalf("expected no archived offers, got %d, %v", archived, err)
+		}
+		archived, err = store.ArchiveOffers(now.Add(3 * time.Hour))
+		if err != nil || archived != 1 {
+			t.Fatalf("expected archived expired offer, got %d, %v", archived, err)
+		}
+		if status(true) != OfferPartiallyFilled {
+			t.Fatalf("expected unit offer to stay, got %s", status(true))
+		}
+	})
+
+	t.Run("SellerOffers", func(t *testing.T) {
+		store := newStore(t)
+		seller := newTestUser(t, store, 1, "Seller", 3.848, 11.5021, "farmer")
+		other := newTestUser(t, store, 2, "Other", 3.848, 11.5021, "farmer")
+		product, err := store.FindOrCreateProduct("cassava")
+		mustNil(t, err)
+		_, err = store.CreateMassOffer(seller.ID, product.ID, 3, 5000, never)
+		mustNil(t, err)
+		_, err = store.CreateMassOffer(other.ID, product.ID, 3, 5000, never)
+		mustNil(t, err)
+		_, err = store.CreateUnitOffer(seller.ID, product.ID, 4, 10, never)
+		mustNil(t, err)
+
+		offers, err := store.SellerOffers(seller.ID)
+		mustNil(t, err)
+		if len(offers) != 2 || offers[0].Mass != 5000 || offers[1].Units != 10 {
+			t.Fatalf("expected offers of seller oldest first, got %v", offers)
+		}
+
+		ok, err := store.UpdateOffer(&offers[0], 4, 4000, 0)
+		if err != nil || !ok {
+			t.Fatalf("expected updated offer, got %v, %v", ok, err)
+		}
+		ok, err = store.UpdateOffer(&offers[0], 5, 5000, 0)
+		if err != nil || ok {
+			t.Fatalf("expected outdated offer not to be updated, got %v, %v", ok, err)
+		}
+		stranger := offers[1]
+		stranger.Seller = other.ID
+		ok, err = store.UpdateOffer(&stranger, 8, 0, 20)
+		if err != nil || ok {
+			t.Fatalf("expected offer of another seller not to be updated, got %v, %v", ok, err)
+		}
+		ok, err = store.UpdateOffer(&offers[1], 8, 0, 20)
+		if err != nil || !ok {
+			t.Fatalf("expected updated offer, got %v, %v", ok, err)
+		}
+
+		ok, err = store.WithdrawOffer(&offers[0])
+		if err != nil || !ok {
+			t.Fatalf("expected withdrawn offer, got %v, %v", ok, err)
+		}
+		ok, err = store.WithdrawOffer(&offers[0])
+		if err != nil || ok {
+			t.Fatalf("expected offer to be withdrawn once, got %v, %v", ok, err)
+		}
+		offers, err = store.SellerOffers(seller.ID)
+		mustNil(t, err)
+		if len(offers) != 1 || offers[0].Units != 20 || offers[0].Price != 8 ||
+			offers[0].NormalizedPrice != 0.4 {
+			t.Fatalf("expected updated unit offer, got %v", offers)
+		}
+	})
+
+	t.Run("ProfileChanges", func(t *testing.T) {
+		store := newStore(t)
+		seller := newTestUser(t, store, 1, "Seller", 3.848, 11.5021, "farmer")
+		buyer := newTestUser(t, store, 2, "Buyer", 3.848, 11.5021, "consumer")
+		product, err := store.FindOrCreateProduct("plantain")
+		mustNil(t, err)
+		_, err = store.CreateUnitOffer(seller.ID, product.ID, 10, 10, never)
+		mustNil(t, err)
+
+		mustNil(t, store.SetUserLocation(seller, 4.0511, 9.7679))
+		offers, err := store.FindOffers(product.ID, true, 1, 4.0511, 9.7679, 1000)
+		if err != nil || len(offers) != 1 {
+			t.Fatalf("expected offer to move with the seller, got %v, %v", offers, err)
+		}
+		offers, err = store.FindOffers(product.ID, true, 1, 3.848, 11.5021, 1000)
+		if err != nil || len(offers) != 0 {
+			t.Fatalf("expected no offer at the old location, got %v, %v", offers, err)
+		}
+
+		trade := &Trade{Buyer: buyer.ID, Product: product.ID, Units: 4, Price: 4, Status: TradeProposed}
+		offer, _, err := store.ReserveOffer(trade)
+		if err != nil || offer == nil {
+			t.Fatalf("expected reserved offer, got %v, %v", offer, err)
+		}
+		trades, err := store.BuyerTrades(buyer.ID, TradeProposed)
+		if err != nil || len(trades) != 1 || trades[0].ID != trade.ID {
+			t.Fatalf("expected proposed trade of buyer, got %v, %v", trades, err)
+		}
+		trades, err = store.BuyerTrades(seller.ID, TradeProposed)
+		if err != nil || len(trades) != 0 {
+			t.Fatalf("expected no trades of seller as buyer, got %v, %v", trades, err)
+		}
+
+		mustNil(t, store.DeleteUser(seller))
+		user, err := store.UserByPhone(1)
+		if err != nil || user != nil {
+			t.Fatalf("expected deleted user, got %v, %v", user, err)
+		}
+		user, err = store.UserByID(seller.ID)
+		if err != nil || user != nil {
+			t.Fatalf("expected deleted user, got %v, %v", user, err)
+		}
+		found, err := store.TradeByID(trade.ID)
+		if err != nil || found == nil {
+			t.Fatalf("expected trade to be kept, got %v, %v", found, err)
+		}
+		mustNil(t, store.NewUser(1))
+		user = mustUser(t, store, 1)
+		if user.ID == seller.ID || user.Name != nil {
+			t.Fatalf("expected new user, got %+v", user)
+		}
+	})
+
+	t.Run("TradeStatus", func(t *testing.T) {
+		store := newStore(t)
+		seller := newTestUser(t, store, 1, "Seller", 3.848, 11.5021, "farmer")
+		buyer := newTestUser(t, store, 2, "Buyer", 3.848, 11.5021, "consumer")
+		product, err := store.FindOrCreateProduct("plantain")
+		mustNil(t, err)
+		_, err = store.CreateUnitOffer(seller.ID, product.ID, 10, 10, never)
+		mustNil(t, err)
+
+		trade := &Trade{Buyer: buyer.ID, Product: product.ID, Units: 4, Price: 4, Status: TradeProposed}
+		offer, _, err := store.ReserveOffer(trade)
+		if err != nil || offer == nil || offer.Units != 6 {
+			t.Fatalf("expected reserved offer, got %v, %v", offer, err)
+		}
+		mustNil(t, store.SetUserState(buyer, "confirm_trade", []string{trade.ID.Hex()}))
+		user := mustUser(t, store, 2)
+		if user.Action != "confirm_trade" || len(user.Reqs) != 1 || user.Reqs[0] != trade.ID.Hex() {
+			t.Fatalf("unexpected user state %s %v", user.Action, user.Reqs)
+		}
+
+		stale, err := store.StaleTrades(TradeProposed, time.Now().Add(-time.Minute))
+		if err != nil || len(stale) != 0 {
+			t.Fatalf("expected no stale trades, got %v, %v", stale, err)
+		}
+		stale, err = store.StaleTrades(TradeProposed, time.Now().Add(time.Minute))
+		if err != nil || len(stale) != 1 || stale[0].ID != trade.ID {
+			t.Fatalf("expected stale trade, got %v, %v", stale, err)
+		}
+
+		requests, err := store.SellerTrades(seller.ID, TradeProposed)
+		if err != nil || len(requests) != 1 || requests[0].ID != trade.ID {
+			t.Fatalf("expected proposed trade of seller, got %v, %v", requests, err)
+		}
+		requests, err = store.SellerTrades(buyer.ID, TradeProposed)
+		if err != nil || len(requests) != 0 {
+			t.Fatalf("expected no trades of buyer as seller, got %v, %v", requests, err)
+		}
+
+		ok, err := store.SetTradeStatus(trade, TradeProposed, TradeCancelled)
+		if err != nil || !ok || trade.Status != TradeCancelled {
+			t.Fatalf("expected cancelled trade, got %v, %v", ok, err)
+		}
+		ok, err = store.SetTradeStatus(trade, TradeProposed, TradeCompleted)
+		if err != nil || ok {
+			t.Fatalf("expected no status change, got %v, %v", ok, err)
+		}
+		found, err := store.TradeByID(trade.ID)
+		if err != nil || found == nil || found.Status != TradeCancelled {
+			t.Fatalf("expected cancelled trade, got %v, %v", found, err)
+		}
+
+		mustNil(t, store.ReleaseOffer(trade))
+		offers, err := store.SellerOffers(seller.ID)
+		if err != nil || len(offers) != 1 || offers[0].Units != 10 {
+			t.Fatalf("expected released offer, got %v, %v", offers, err)
+		}
+	})
+
+	t.Run("ConcurrentReservations", func(t *testing.T) {
+		store := newStore(t)
+		seller := newTestUser(t, store, 1, "Seller", 3.848, 11.5021, "farmer")
+		buyer := newTestUser(t, store, 2, "Buyer", 3.848, 11.5021, "consumer")
+		product, err := store.FindOrCreateProduct("plantain")
+		mustNil(t, err)
+		_, err = store.CreateUnitOffer(seller.ID, product.ID, 10, 10, never)
+		mustNil(t, err)
+		_, err = store.CreateMassOffer(seller.ID, product.ID, 10, 10000, never)
+		mustNil(t, err)
+
+		var wg sync.WaitGroup
+		var mutex sync.Mutex
+		var reservedUnits, reservedMass int
+		for index := 0; index < 20; index++ {
+			wg.Add(1)
+			go func(index int) {
+				defer wg.Done()
+				trade := &Trade{Buyer: buyer.ID, Product: product.ID, Units: 3, Price: 30}
+				if index%2 == 0 {
+					trade = &Trade{Buyer: buyer.ID, Product: product.ID, Mass: 3000, Price: 30}
+				}
+				offer, _, err := store.ReserveOffer(trade)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if offer == nil {
+					return
+				}
+				if offer.Mass < 0 || offer.Units > 10 {
+					t.Errorf("offer oversold: %+v", offer)
+				}
+				mutex.Lock()
+				defer mutex.Unlock()
+				reservedUnits += int(trade.Units)
+				reservedMass += int(trade.Mass)
+			}(index)
+		}
+		wg.Wait()
+
+		if reservedUnits != 9 || reservedMass != 9000 {
+			t.Fatalf("expected 9 units and 9000 g reserved, got %d and %d", reservedUnits, reservedMass)
+		}
+		trades, err := store.TradesByUser(buyer.ID, TradeCompleted, 100)
+		mustNil(t, err)
+		if len(trades) != 6 {
+			t.Fatalf("expected 6 trades, got %d", len(trades))
+		}
+	})
+
+	t.Run("Prices", func(t *testing.T) {
+		store := newStore(t)
+		seller := newTestUser(t, store, 1, "Seller", 3.848, 11.5021, "farmer")
+		far := newTestUser(t, store, 2, "Far", 4.0511, 9.7679, "farmer")
+		buyer := newTestUser(t, store, 3, "Buyer", 3.848, 11.5021, "consumer")
+		product, err := store.FindOrCreateProduct("cassava")
+		mustNil(t, err)
+		query := PriceQuery{Product: product.ID, Since: time.Now().Add(-time.Hour), Lat: 3.848, Lng: 11.5021,
+			Radius: 50000}
+		prices, err := store.OfferPrices(query)
+		if err != nil || len(prices) != 0 {
+			t.Fatalf("expected no prices, got %v, %v", prices, err)
+		}
+
+		_, err = store.CreateMassOffer(seller.ID, product.ID, 2, 1000, never)
+		mustNil(t, err)
+		_, err = store.CreateMassOffer(seller.ID, product.ID, 4, 1000, never)
+		mustNil(t, err)
+		_, err = store.CreateUnitOffer(seller.ID, product.ID, 6, 3, never)
+		mustNil(t, err)
+		_, err = store.CreateMassOffer(far.ID, product.ID, 1, 1000, never)
+		mustNil(t, err)
+		prices, err = store.OfferPrices(query)
+		mustNil(t, err)
+		sort.Float64s(prices)
+		if fmt.Sprint(prices) != "[0.002 0.004]" {
+			t.Fatalf("expected mass prices of nearby offers, got %v", prices)
+		}
+		query.Units = true
+		prices, err = store.OfferPrices(query)
+		if err != nil || fmt.Sprint(prices) != "[2]" {
+			t.Fatalf("expected unit prices of nearby offers, got %v, %v", prices, err)
+		}
+		query.Units, query.Radius = false, 0
+		prices, err = store.OfferPrices(query)
+		if err != nil || len(prices) != 3 {
+			t.Fatalf("expected mass prices of all offers, got %v, %v", prices, err)
+		}
+		query.Since = time.Now().Add(time.Hour)
+		prices, err = store.OfferPrices(query)
+		if err != nil || len(prices) != 0 {
+			t.Fatalf("expected no prices of older offers, got %v, %v", prices, err)
+		}
+
+		_, _, err = store.ReserveOffer(&Trade{Buyer: buyer.ID, Product: product.ID, Mass: 500, Price: 1.5})
+		mustNil(t, err)
+		_, _, err = store.ReserveOffer(&Trade{Buyer: buyer.ID, Product: product.ID, Units: 1, Price: 2,
+			Status: TradeProposed})
+		mustNil(t, err)
+		query = PriceQuery{Product: product.ID, Since: time.Now().Add(-time.Hour), Lat: 3.848, Lng: 11.5021,
+			Radius: 50000}
+		prices, err = store.TradePrices(query)
+		if err != nil || len(prices) != 1 || math.Abs(prices[0]-0.002) > 1e-9 {
+			t.Fatalf("expected price of completed trade, got %v, %v", prices, err)
+		}
+		query.Units = true
+		prices, err = store.TradePrices(query)
+		if err != nil || len(prices) != 0 {
+			t.Fatalf("expected no price of proposed trade, got %v, %v", prices, err)
+		}
+	})
+
+	t.Run("Orders", func(t *testing.T) {
+		store := newStore(t)
+		buyer := newTestUser(t, store, 1, "Buyer", 3.848, 11.5021, "consumer")
+		product, err := store.FindOrCreateProduct("cassava")
+		mustNil(t, err)
+		location := MakeGeoJSONPnt(3.848, 11.5021)
+		old := &Order{Buyer: buyer.ID, Product: product.ID, Price: 2, NormalizedPrice: 0.001, Mass: 2000,
+			Location: &location, Expires: never}
+		mustNil(t, store.CreateOrder(old))
+		mustNil(t, store.CreateOrder(&Order{Buyer: buyer.ID, Product: product.ID, Price: 5,
+			NormalizedPrice: 0.5, Units: 10, Location: &location, Expires: never}))
+		// Orders without an expiry date never expire.
+		mustNil(t, store.CreateOrder(&Order{Buyer: buyer.ID, Product: product.ID, Price: 3,
+			NormalizedPrice: 0.003, Mass: 1000, Location: &location}))
+		mustNil(t, store.CreateOrder(&Order{Buyer: buyer.ID, Product: product.ID, Price: 9,
+			NormalizedPrice: 0.009, Mass: 1000, Location: &location, Expires: time.Now().Add(-time.Minute)}))
+		if old.Status != OrderOpen || old.ID.IsZero() {
+			t.Fatalf("expected open order, got %+v", old)
+		}
+
+		orders, err := store.FindOrders(product.ID, false, 0.001, 3.848, 11.5021, 1000)
+		mustNil(t, err)
+		if len(orders) != 2 || orders[0].ID != old.ID || orders[1].Price != 3 {
+			t.Fatalf("expected 2 mass orders, oldest first, got %+v", orders)
+		}
+		orders, err = store.FindOrders(product.ID, false, 0.002, 3.848, 11.5021, 1000)
+		if err != nil || len(orders) != 1 || orders[0].Price != 3 {
+			t.Fatalf("expected order with higher price, got %+v, %v", orders, err)
+		}
+		orders, err = store.FindOrders(product.ID, true, 0.4, 3.848, 11.5021, 1000)
+		if err != nil || len(orders) != 1 || orders[0].Units != 10 {
+			t.Fatalf("expected unit order, got %+v, %v", orders, err)
+		}
+		orders, err = store.FindOrders(product.ID, false, 0.001, 4.0511, 9.7679, 50000)
+		if err != nil || len(orders) != 0 {
+			t.Fatalf("expected no distant orders, got %+v, %v", orders, err)
+		}
+
+		ok, err := store.SetOrderStatus(old, OrderOpen, OrderMatched)
+		if err != nil || !ok || old.Status != OrderMatched {
+			t.Fatalf("expected matched order, got %v, %v", ok, err)
+		}
+		ok, err = store.SetOrderStatus(old, OrderOpen, OrderMatched)
+		if err != nil || ok {
+			t.Fatalf("expected unchanged order, got %v, %v", ok, err)
+		}
+		orders, err = store.FindOrders(product.ID, false, 0.001, 3.848, 11.5021, 1000)
+		if err != nil || len(orders) != 1 {
+			t.Fatalf("expected only open orders, got %+v, %v", orders, err)
+		}
+		orders, err = store.BuyerOrders(buyer.ID)
+		if err != nil || len(orders) != 3 || orders[0].Price != 5 || orders[2].Price != 9 {
+			t.Fatalf("expected open orders of buyer, oldest first, got %+v, %v", orders, err)
+		}
+	})
+
+	t.Run("FarmerAlerts", func(t *testing.T) {
+		store := newStore(t)
+		user := newTestUser(t, store, 1, "Paul", 3.848, 11.5021, "consumer")
+		mustNil(t, store.SetFarmerAlerts(user, true))
+		users, err := store.FindFarmersNear(3.848, 11.5021, 1000)
+		if err != nil || len(users) != 1 || !users[0].FarmerAlerts {
+			t.Fatalf("expected subscribed user, got %+v, %v", users, err)
+		}
+
+		now := time.Now().Truncate(time.Millisecond)
+		ok, err := store.RecordAlert(user, now, now.Add(-time.Hour))
+		if err != nil || !ok || !user.LastAlert.Equal(now) {
+			t.Fatalf("expected recorded alert, got %v, %v", ok, err)
+		}
+		ok, err = store.RecordAlert(user, now.Add(time.Minute), now.Add(-time.Hour))
+		if err != nil || ok {
+			t.Fatalf("expected no alert within the interval, got %v, %v", ok, err)
+		}
+		ok, err = store.RecordAlert(user, now.Add(2*time.Hour), now.Add(time.Hour))
+		if err != nil || !ok {
+			t.Fatalf("expected alert after the interval, got %v, %v", ok, err)
+		}
+
+		mustNil(t, store.SetFarmerAlerts(user, false))
+		users, err = store.FindFarmersNear(3.848, 11.5021, 1000)
+		if err != nil || len(users) != 1 || users[0].FarmerAlerts {
+			t.Fatalf("expected unsubscribed user, got %+v, %v", users, err)
+		}
+	})
+
+	t.Run("PriceHistory", func(t *testing.T) {
+		store := newStore(t)
+		product, err := store.FindOrCreateProduct("cassava")
+		mustNil(t, err)
+		other, err := store.FindOrCreateProduct("maize")
+		mustNil(t, err)
+		products, err := store.Products()
+		if err != nil || len(products) != 2 {
+			t.Fatalf("expected 2 products, got %v, %v", products, err)
+		}
+
+		day := time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+		for _, snapshot := range []PriceSnapshot{
+			{Product: product.ID, Day: day.AddDate(0, 0, 1), Source: "offers", PriceStats: PriceStats{1, 3, 3, 3}},
+			{Product: product.ID, Day: day, Source: "offers", PriceStats: PriceStats{1, 1, 1, 1}},
+			{Product: product.ID, Day: day, Units: true, Source: "offers", PriceStats: PriceStats{1, 5, 5, 5}},
+			{Product: other.ID, Day: day, Source: "offers", PriceStats: PriceStats{1, 7, 7, 7}},
+			{Product: product.ID, Day: day, Source: "trades", PriceStats: PriceStats{2, 2, 1, 3}},
+		} {
+			mustNil(t, store.SavePriceSnapshot(&snapshot))
+		}
+
+		history, err := store.PriceHistory(product.ID, false, day)
+		mustNil(t, err)
+		if len(history) != 2 || history[0].Median != 2 || history[0].Source != "trades" || history[1].Median != 3 {
+			t.Fatalf("expected 2 snapshots per gram, oldest first, got %+v", history)
+		}
+		history, err = store.PriceHistory(product.ID, false, day.AddDate(0, 0, 1))
+		if err != nil || len(history) != 1 || !history[0].Day.Equal(day.AddDate(0, 0, 1)) {
+			t.Fatalf("expected latest snapshot, got %+v, %v", history, err)
+		}
+		history, err = store.PriceHistory(product.ID, true, day)
+		if err != nil || len(history) != 1 || history[0].Median != 5 {
+			t.Fatalf("expected snapshot per unit, got %+v, %v", history, err)
+		}
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store { return NewMemoryStore() })
+}
+
+func TestMongoStore(t *testing.T) {
+	client := connectTestClient(t)
+	defer client.Disconnect(context.Background())
+
+	testStore(t, func(t *testing.T) Store { return newTestORM(t, client) })
+}
+
+func TestMongoPrices(t *testing.T) {
+	client := connectTestClient(t)
+	defer client.Disconnect(context.Background())
+
+	t.Run("NewDatabase", func(t *testing.T) {
+		orm := newTestORM(t, client)
+		mustNil(t, orm.CheckPrices(NewCurrencies("XAF")))
+		mustNil(t, orm.CheckPrices(NewCurrencies("XAF")))
+		if err := orm.CheckPrices(NewCurrencies("USD")); err == nil {
+			t.Error("expected error for prices in another currency")
+		}
+	})
+
+	t.Run("Migration", func(t *testing.T) {
+		orm := newTestORM(t, client)
+		seller := newTestUser(t, orm, 237600000001, "Amina", 3.848, 11.5021, "farmer")
+		product, err := orm.FindOrCreateProduct("cassava")
+		mustNil(t, err)
+		_, err = orm.CreateMassOffer(seller.ID, product.ID, 2, 1000, never)
+		mustNil(t, err)
+		price := func() float64 {
+			offers, err := orm.SellerOffers(seller.ID)
+			mustNil(t, err)
+			if len(offers) != 1 {
+				t.Fatalf("expected one offer, got %v", offers)
+			}
+			return offers[0].Price
+		}
+
+		currencies := NewCurrencies("XAF")
+		if err := orm.CheckPrices(currencies); err == nil {
+			t.Error("expected error for prices without currency")
+		}
+		if err := orm.MigratePrices("", currencies); err == nil {
+			t.Error("expected error for migration without currency")
+		}
+		mustNil(t, orm.MigratePrices("usd", currencies))
+		mustNil(t, orm.CheckPrices(currencies))
+		if price() != 1200 {
+			t.Errorf("expected price of 1200 FCFA, got %v", price())
+		}
+		// Running the migration again does not convert prices twice.
+		mustNil(t, orm.MigratePrices("usd", currencies))
+		if price() != 1200 {
+			t.Errorf("expected price of 1200 FCFA after second migration, got %v", price())
+		}
+
+		currencies = NewCurrencies("USD")
+		if err := orm.CheckPrices(currencies); err == nil {
+			t.Error("expected error for prices in another currency")
+		}
+		mustNil(t, orm.MigratePrices("", currencies))
+		mustNil(t, orm.CheckPrices(currencies))
+		if math.Abs(price()-2) > 1e-9 {
+			t.Errorf("expected price of 2$, got %v", price())
+		}
+	})
+}
+
+func TestMongoProducts(t *testing.T) {
+	client := connectTestClient(t)
+	defer client.Disconnect(context.Background())
+	orm := newTestORM(t, client)
+	catalog, err := LoadCatalog("products.json")
+	mustNil(t, err)
+
+	seller := newTestUser(t, orm, 237600000001, "Amina", 3.848, 11.5021, "farmer")
+	tomato, err := orm.FindOrCreateProduct("tomato")
+	mustNil(t, err)
+	manioc, err := orm.FindOrCreateProduct("manioc")
+	mustNil(t, err)
+	cassava, err := orm.FindOrCreateProduct("cassava")
+	mustNil(t, err)
+	_, err = orm.FindOrCreateProduct("fufu")
+	mustNil(t, err)
+	_, err = orm.CreateMassOffer(seller.ID, tomato.ID, 1, 1000, never)
+	mustNil(t, err)
+	_, err = orm.CreateMassOffer(seller.ID, manioc.ID, 2, 1000, never)
+	mustNil(t, err)
+	day := time.Date(2019, 7, 1, 0, 0, 0, 0, time.UTC)
+	for _, snapshot := range []PriceSnapshot{
+		{Product: manioc.ID, Day: day, Source: "offers", PriceStats: PriceStats{1, 1, 1, 1}},
+		{Product: manioc.ID, Day: day.AddDate(0, 0, 1), Source: "offers", PriceStats: PriceStats{1, 2, 2, 2}},
+		{Product: cassava.ID, Day: day, Source: "offers", PriceStats: PriceStats{1, 3, 3, 3}},
+	} {
+		mustNil(t, orm.SavePriceSnapshot(&snapshot))
+	}
+
+	mustNil(t, orm.MergeProducts(catalog))
+	products, err := orm.Products()
+	mustNil(t, err)
+	names := map[string]primitive.ObjectID{}
+	for _, product := range products {
+		names[product.Name] = product.ID
+	}
+	if len(names) != 3 || names["tomatoes"] != tomato.ID || names["cassava"] != cassava.ID ||
+		names["fufu"].IsZero() {
+		t.Fatalf("expected tomatoes, cassava and fufu, got %v", products)
+	}
+	offers, err := orm.SellerOffers(seller.ID)
+	if err != nil || len(offers) != 2 || offers[0].Product != tomato.ID || offers[1].Product != cassava.ID {
+		t.Fatalf("expected offers of tomatoes and cassava, got %v, %v", offers, err)
+	}
+	history, err := orm.PriceHistory(cassava.ID, false, day)
+	if err != nil || len(history) != 2 || history[0].Median != 3 || history[1].Median != 2 {
+		t.Fatalf("expected merged price history, got %+v, %v", history, err)
+	}
+
+	// Merging again changes nothing.
+	mustNil(t, orm.MergeProducts(catalog))
+	products, err = orm.Products()
+	if err != nil || len(products) != 3 {
+		t.Fatalf("expected 3 products, got %v, %v", products, err)
+	}
+}
+
+// connectTestClient connects with the MongoDB server given by MONGO_TEST_URI or skips the test.
+func connectTestClient(t *testing.T) *mongo.Client {
+	t.Helper()
+	uri := os.Getenv("MONGO_TEST_URI")
+	if uri == "" {
+		t.Skip("MONGO_TEST_URI is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	mustNil(t, err)
+	return client
+}
+
+// newTestORM returns an ORM for an empty test database.
+func newTestORM(t *testing.T, client *mongo.Client) *ORM {
+	t.Helper()
+	orm := NewORM(client, "chat4bread_test")
+	mustNil(t, orm.DB.Drop(context.Background()))
+	mustNil(t, orm.CreateIndicies())
+	return orm
+}
+
+// mustNil fails the test if the error is not nil.
+func mustNil(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mustUser fails the test if the user with the given phone does not exist.
+func mustUser(t *testing.T, store Store, phone int64) *User {
+	t.Helper()
+	user, err := store.UserByPhone(phone)
+	mustNil(t, err)
+	if user == nil {
+		t.Fatalf("expected user %d", phone)
+	}
+	return user
+}
+
+// never is the expiry date of offers which never expire.
+var never time.Time
+
+// newTestUser adds a user who completed the onboarding.
+func newTestUser(t *testing.T, store Store, phone int64, name string, lat float64, lng float64,
+	kind string) *User {
+	t.Helper()
+	mustNil(t, store.NewUser(phone))
+	user := mustUser(t, store, phone)
+	mustNil(t, store.SetUserName(user, name))
+	mustNil(t, store.SetUserLocation(user, lat, lng))
+	mustNil(t, store.SetUserKind(user, kind))
+	mustNil(t, store.ResetUserState(user))
+	return mustUser(t, store, phone)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/go-telegram-bot-api/telegram-bot-api"
+	"log"
+	"net/http"
+)
+
+// TelegramChannel delivers messages through the Telegram Bot API.
+type TelegramChannel struct {
+	Bot        *tgbotapi.BotAPI
+	WebhookURL string
+}
+
+// NewTelegramChannel connects to the Telegram Bot API. If a webhook URL is given, updates are
+// received through the webhook instead of long polling.
+func NewTelegramChannel(token string, webhookURL string) (*TelegramChannel, error) {
+	bot, err := tgbotapi.NewBotAPI(token)
+	if err != nil {
+		return nil, err
+	}
+	//bot.Debug = true
+	log.Printf("Authorized on Telegram bot account %s", bot.Self.UserName)
+
+	return &TelegramChannel{Bot: bot, WebhookURL: webhookURL}, nil
+}
+
+// Receive starts listening for Telegram updates.
+func (tc *TelegramChannel) Receive() (<-chan Message, error) {
+	var updates tgbotapi.UpdatesChannel
+	var err error
+
+	if tc.WebhookURL == "" {
+		u := tgbotapi.NewUpdate(0)
+		u.Timeout = 60
+		updates, err = tc.Bot.GetUpdatesChan(u)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		_, err = tc.Bot.SetWebhook(tgbotapi.NewWebhook(tc.WebhookURL + tc.Bot.Token))
+		if err != nil {
+			return nil, err
+		}
+		info, err := tc.Bot.GetWebhookInfo()
+		if err != nil {
+			return nil, err
+		}
+		if info.LastErrorDate != 0 {
+			log.Printf("Telegram callback last failed: %s", info.LastErrorMessage)
+		}
+		updates = tc.Bot.ListenForWebhook("/" + tc.Bot.Token)
+		go http.ListenAndServe("0.0.0.0:8080", nil)
+	}
+
+	messages := make(chan Message)
+	go func() {
+		defer close(messages)
+		for update := range updates {
+			if update.Message == nil {
+				continue
+			}
+			//log.Printf("[%s] %s", update.Message.From.UserName, update.Message.Text)
+			messages <- Message{From: update.Message.Chat.ID, Text: update.Message.Text}
+		}
+	}()
+
+	return messages, nil
+}
+
+// Send delivers a message to a Telegram chat.
+func (tc *TelegramChannel) Send(to int64, text string) error {
+	_, err := tc.Bot.Send(tgbotapi.NewMessage(to, text))
+	return err
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Measure is a unit in which products are traded. Mass measures are converted to grams and count
+// measures to pieces, either with a fixed size or with a size depending on the product.
+type Measure struct {
+	Name    string
+	Plural  string
+	Aliases []string
+	Size    Size
+}
+
+// Size is the amount of a product in a measure, either in grams or in pieces.
+type Size struct {
+	Grams  float64
+	Pieces uint64
+}
+
+// Units converts quantities given in measures into grams or pieces of a product and formats them
+// for replies.
+type Units struct {
+	Measures []Measure
+	// Products maps the singular name of a product to the sizes of its local measures.
+	Products map[string]map[string]Size
+}
+
+// NewUnits initializes the units with the common measures of Cameroonian markets.
+func NewUnits() *Units {
+	return &Units{
+		Measures: []Measure{
+			{"g", "g", []string{"gram", "grams", "gramme", "grammes"}, Size{Grams: 1}},
+			{"kg", "kg", []string{"kgs", "kilo", "kilos", "kilogram", "kilograms", "kilogramme", "kilogrammes"}, Size{Grams: 1000}},
+			{"t", "t", []string{"ton", "tons", "tonne", "tonnes"}, Size{Grams: 1000000}},
+			{"piece", "pieces", []string{"pcs", "unit", "units", "pièce", "pièces"}, Size{Pieces: 1}},
+			{"dozen", "dozens", []string{"douzaine", "douzaines"}, Size{Pieces: 12}},
+			{"bag", "bags", []string{"sack", "sacks", "sac", "sacs"}, Size{}},
+			{"crate", "crates", []string{"cageot", "cageots", "box", "boxes"}, Size{}},
+			{"tray", "trays", []string{"plateau", "plateaux"}, Size{}},
+			{"bucket", "buckets", []string{"seau", "seaux"}, Size{}},
+			{"basin", "basins", []string{"bassine", "bassines"}, Size{}},
+			{"bunch", "bunches", []string{"régime", "régimes", "regime", "regimes"}, Size{}},
+			{"heap", "heaps", []string{"tas"}, Size{}},
+		},
+		Products: map[string]map[string]Size{
+			"banana":    {"bunch": {Pieces: 80}},
+			"bean":      {"bag": {Grams: 100000}, "bucket": {Grams: 15000}},
+			"cassava":   {"bag": {Grams: 50000}, "basin": {Grams: 20000}},
+			"cocoa":     {"bag": {Grams: 65000}},
+			"coffee":    {"bag": {Grams: 60000}},
+			"corn":      {"bag": {Grams: 100000}, "bucket": {Grams: 15000}},
+			"egg":       {"tray": {Pieces: 30}, "crate": {Pieces: 360}},
+			"groundnut": {"bag": {Grams: 70000}, "bucket": {Grams: 12000}},
+			"maize":     {"bag": {Grams: 100000}, "bucket": {Grams: 15000}},
+			"onion":     {"bag": {Grams: 50000}, "heap": {Grams: 1000}},
+			"peanut":    {"bag": {Grams: 70000}, "bucket": {Grams: 12000}},
+			"plantain":  {"bunch": {Pieces: 15}},
+			"potato":    {"bag": {Grams: 50000}, "bucket": {Grams: 10000}},
+			"rice":      {"bag": {Grams: 50000}},
+			"tomato":    {"crate": {Grams: 25000}, "basin": {Grams: 15000}, "heap": {Grams: 1000}},
+		},
+	}
+}
+
+// Measure looks up a measure by its name, plural or an alias.
+func (u *Units) Measure(word string) *Measure {
+	word = strings.ToLower(word)
+	for index := range u.Measures {
+		measure := &u.Measures[index]
+		if word == measure.Name || word == measure.Plural {
+			return measure
+		}
+		for _, alias := range measure.Aliases {
+			if word == alias {
+				return measure
+			}
+		}
+	}
+	return nil
+}
+
+// Size returns the size of a measure for a product. It returns false if the size of the measure
+// is not known for the product.
+func (u *Units) Size(product string, measure string) (Size, bool) {
+	found := u.Measure(measure)
+	if found == nil {
+		return Size{}, false
+	}
+	if found.Size.Grams > 0 || found.Size.Pieces > 0 {
+		return found.Size, true
+	}
+	size, ok := u.sizes(product)[found.Name]
+	return size, ok
+}
+
+// Convert converts an amount of a measure into grams or pieces of a product. It returns false if
+// the size of the measure is not known for the product.
+func (u *Units) Convert(product string, amount float64, measure string) (float64, uint64, bool) {
+	size, ok := u.Size(product, measure)
+	if !ok {
+		return 0, 0, false
+	}
+	if size.Pieces > 0 {
+		return 0, uint64(math.Round(amount * float64(size.Pieces))), true
+	}
+	return amount * size.Grams, 0, true
+}
+
+// Format returns a mass in grams or a number of pieces of a product in a human readable form, e.g.
+// "100 kg of cassava (2 bags)" or "30 plantains (2 bunches)".
+func (u *Units) Format(mass float64, units uint64, product string) string {
+	var quantity string
+	var amount float64
+	if units > 0 {
+		quantity = fmt.Sprintf("%d %s", units, product)
+		amount = float64(units)
+	} else {
+		quantity = formatMass(mass) + " of " + product
+		amount = mass
+	}
+
+	// Mention the largest local measure which fits a whole number of times.
+	var best *Measure
+	var bestSize float64
+	for name, size := range u.sizes(product) {
+		measure := u.Measure(name)
+		per := size.Grams
+		if units > 0 {
+			per = float64(size.Pieces)
+		}
+		count := amount / per
+		if measure == nil || per == 0 || count < 1 || math.Abs(count-math.Round(count)) > 1e-9 {
+			continue
+		}
+		if per > bestSize || per == bestSize && measure.Name < best.Name {
+			best, bestSize = measure, per
+		}
+	}
+	if best != nil {
+		count := math.Round(amount / bestSize)
+		name := best.Plural
+		if count == 1 {
+			name = best.Name
+		}
+		quantity += fmt.Sprintf(" (%.0f %s)", count, name)
+	}
+
+	return quantity
+}
+
+// sizes returns the sizes of the local measures of a product, accepting plural product names.
+func (u *Units) sizes(product string) map[string]Size {
+	product = strings.ToLower(product)
+	for _, name := range []string{product, strings.TrimSuffix(product, "es"), strings.TrimSuffix(product, "s")} {
+		if sizes, ok := u.Products[name]; ok {
+			return sizes
+		}
+	}
+	return nil
+}
+
+// formatMass returns a mass in grams with the largest fitting metric unit, e.g. "2.5 kg".
+func formatMass(grams float64) string {
+	value, unit := grams, "g"
+	if grams >= 1000000 {
+		value, unit = grams/1000000, "t"
+	} else if grams >= 1000 {
+		value, unit = grams/1000, "kg"
+	}
+	return strconv.FormatFloat(math.Round(value*100)/100, 'f', -1, 64) + " " + unit
+}
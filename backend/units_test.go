@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestUnitsConvert(t *testing.T) {
+	units := NewUnits()
+	cases := []struct {
+		Product string
+		Amount  float64
+		Measure string
+		Mass    float64
+		Units   uint64
+		OK      bool
+	}{
+		{"cassava", 2, "bags", 100000, 0, true},
+		{"Cassava", 1, "sac", 50000, 0, true},
+		{"tomatoes", 3, "crate", 75000, 0, true},
+		{"eggs", 2, "trays", 0, 60, true},
+		{"eggs", 1, "dozen", 0, 12, true},
+		{"plantains", 2, "bunches", 0, 30, true},
+		{"yam", 3, "kilos", 3000, 0, true},
+		{"yam", 4, "pieces", 0, 4, true},
+		{"yam", 1, "bag", 0, 0, false},
+		{"cassava", 1, "bottle", 0, 0, false},
+	}
+	for _, c := range cases {
+		mass, count, ok := units.Convert(c.Product, c.Amount, c.Measure)
+		if mass != c.Mass || count != c.Units || ok != c.OK {
+			t.Errorf("expected %v %s of %s to be %vg, %v pieces (%v), got %vg, %v pieces (%v)", c.Amount,
+				c.Measure, c.Product, c.Mass, c.Units, c.OK, mass, count, ok)
+		}
+	}
+}
+
+func TestUnitsFormat(t *testing.T) {
+	units := NewUnits()
+	cases := []struct {
+		Mass     float64
+		Units    uint64
+		Product  string
+		Expected string
+	}{
+		{500, 0, "pepper", "500 g of pepper"},
+		{2500, 0, "cassava", "2.5 kg of cassava"},
+		{100000, 0, "cassava", "100 kg of cassava (2 bags)"},
+		{50000, 0, "cassava", "50 kg of cassava (1 bag)"},
+		{60000, 0, "cassava", "60 kg of cassava (3 basins)"},
+		{1500000, 0, "maize", "1.5 t of maize (15 bags)"},
+		{333.333, 0, "okra", "333.33 g of okra"},
+		{0, 10, "plantains", "10 plantains"},
+		{0, 30, "plantains", "30 plantains (2 bunches)"},
+		{0, 24, "eggs", "24 eggs"},
+		{0, 60, "eggs", "60 eggs (2 trays)"},
+	}
+	for _, c := range cases {
+		if formatted := units.Format(c.Mass, c.Units, c.Product); formatted != c.Expected {
+			t.Errorf("expected %q, got %q", c.Expected, formatted)
+		}
+	}
+}
+
+func TestRuleMeasures(t *testing.T) {
+	rc := NewRuleClassifier()
+	cases := []struct {
+		Message string
+		Number  uint
+		Measure string
+		Product string
+	}{
+		{"I sell 2 bags of cassava for 40$", 2, "bag", "cassava"},
+		{"buy a crate of tomatoes at 10$", 1, "crate", "tomatoes"},
+		{"I want 3 régimes of plantain for 12$", 3, "bunch", "plantain"},
+		{"sell 10 plantains for 4$", 10, "", "plantains"},
+	}
+	for _, c := range cases {
+		intent, err := rc.Intent(c.Message)
+		if err != nil || intent.Number != c.Number || intent.Measure != c.Measure || intent.Product != c.Product {
+			t.Errorf("unexpected intent of %q: %+v, %v", c.Message, intent, err)
+		}
+	}
+}